@@ -0,0 +1,71 @@
+// Command import loads a CSV or ONIX 3.0 catalog file into the books table
+// and prints the report as JSON:
+//
+//	go run ./cmd/import -format onix catalog.xml
+//
+// The format defaults to the file extension, .csv or .xml/.onix. Migrations
+// are read from -migrations, relative to the working directory like the file.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bookstore.example/store/internal/infra"
+	"bookstore.example/store/internal/store"
+)
+
+func main() {
+	format := flag.String("format", "", "csv or onix, guessed from the file extension when empty")
+	batchSize := flag.Int("batch", 500, "books written per transaction")
+	migrations := flag.String("migrations", "migrations/storedb/", "directory of the database migrations")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatalf("usage: import [-format csv|onix] [-batch n] [-migrations dir] <file>")
+	}
+	path := flag.Arg(0)
+
+	if *format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".csv":
+			*format = string(store.ImportFormatCSV)
+		case ".xml", ".onix":
+			*format = string(store.ImportFormatONIX)
+		default:
+			log.Fatalf("Cannot tell the format of %s, use -format", path)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	db := infra.NewDB(infra.ParsePostgresDBConfig())
+	infra.Migrate(db, *migrations)
+
+	importer := store.NewBookImporter(db)
+	importer.BatchSize = *batchSize
+
+	report, err := importer.Import(file, store.ImportFormat(*format))
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encodeErr := encoder.Encode(report)
+
+	if err != nil {
+		log.Fatalf("Import stopped: %v", err)
+	}
+	if encodeErr != nil {
+		log.Fatalf("Failed to print report: %v", encodeErr)
+	}
+	if report.Failed > 0 {
+		os.Exit(2)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"log"
+
 	"bookstore.example/store/internal/infra"
 	"bookstore.example/store/internal/store"
 )
@@ -9,9 +11,26 @@ func main() {
 	db := infra.NewDB(infra.ParsePostgresDBConfig())
 	infra.Migrate(db, "../../migrations/storedb/")
 	secrets := infra.NewEnvSecrets()
+	mailer := infra.NewSMTPMailer(infra.ParseSMTPConfig())
+
+	blobCfg := infra.ParseBlobConfig()
+	var blobs store.BlobStore
+	var localBlobs *infra.LocalBlobStore
+	switch blobCfg.Backend {
+	case "local":
+		localBlobs = infra.NewLocalBlobStore(blobCfg.Dir, blobCfg.BaseURL)
+		blobs = localBlobs
+	case "s3":
+		blobs = infra.NewS3BlobStore(blobCfg)
+	default:
+		log.Fatalf("Unknown blob backend %q, use local or s3", blobCfg.Backend)
+	}
 
 	cfg := store.ParseServerConfig()
-	server := store.NewServer(cfg, &secrets, db)
+	server := store.NewServer(cfg, &secrets, db, mailer, blobs)
+	if localBlobs != nil {
+		server.Static(localBlobs.MountPath(), blobCfg.Dir)
+	}
 
 	server.Start()
 }
@@ -0,0 +1,312 @@
+package infra
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+type BlobConfig struct {
+	// Backend is local or s3.
+	Backend string `default:"local"`
+	// BaseURL is where clients download blobs from. For the local backend it
+	// defaults to /blobs and the server serves Dir at its path; for S3 it
+	// defaults to the bucket URL and may point to a CDN in front of it.
+	BaseURL string
+	Dir     string `default:"data/blobs"`
+
+	S3Endpoint  string
+	S3Region    string `default:"us-east-1"`
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+}
+
+func ParseBlobConfig() *BlobConfig {
+	cfg := BlobConfig{}
+	envconfig.MustProcess("BOOKSTORE_BLOB", &cfg)
+	return &cfg
+}
+
+// LocalBlobStore keeps blobs as files under a directory, for running
+// without an object store.
+type LocalBlobStore struct {
+	dir     string
+	baseURL string
+}
+
+func NewLocalBlobStore(dir, baseURL string) *LocalBlobStore {
+	if baseURL == "" {
+		baseURL = "/blobs"
+	}
+
+	return &LocalBlobStore{dir: dir, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// MountPath is the path of the base URL, where the server has to serve the
+// directory, or /blobs when the base URL has none.
+func (s *LocalBlobStore) MountPath() string {
+	base, err := url.Parse(s.baseURL)
+	if err != nil || strings.Trim(base.Path, "/") == "" {
+		return "/blobs"
+	}
+
+	return base.Path
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob to a temporary file first, so the file under key is
+// never seen half written.
+func (s *LocalBlobStore) Put(key, contentType string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), ".blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+func (s *LocalBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *LocalBlobStore) URL(key string) string {
+	return s.baseURL + "/" + key
+}
+
+// S3BlobStore keeps blobs in a bucket of an S3 compatible object store,
+// such as AWS S3 or MinIO. Objects are addressed path-style as
+// <endpoint>/<bucket>/<key> and requests are signed with AWS Signature
+// Version 4.
+type S3BlobStore struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	baseURL   string
+	client    *http.Client
+}
+
+func NewS3BlobStore(cfg *BlobConfig) *S3BlobStore {
+	endpoint := strings.TrimSuffix(cfg.S3Endpoint, "/")
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.S3Region + ".amazonaws.com"
+	}
+	baseURL := strings.TrimSuffix(cfg.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = endpoint + "/" + cfg.S3Bucket
+	}
+
+	return &S3BlobStore{
+		endpoint:  endpoint,
+		region:    cfg.S3Region,
+		bucket:    cfg.S3Bucket,
+		accessKey: cfg.S3AccessKey,
+		secretKey: cfg.S3SecretKey,
+		baseURL:   baseURL,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *S3BlobStore) Put(key, contentType string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	return s.do(req, data)
+}
+
+// Delete relies on S3 answering 204 No Content whether or not the object
+// existed.
+func (s *S3BlobStore) Delete(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+
+	return s.do(req, nil)
+}
+
+func (s *S3BlobStore) URL(key string) string {
+	return s.baseURL + "/" + uriEncode(key, false)
+}
+
+func (s *S3BlobStore) objectURL(key string) string {
+	return s.endpoint + "/" + uriEncode(s.bucket, true) + "/" + uriEncode(key, false)
+}
+
+func (s *S3BlobStore) do(req *http.Request, payload []byte) error {
+	s.sign(req, payload, time.Now())
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, rsp.Status, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
+
+// sign adds the headers of AWS Signature Version 4 to req, signing the
+// host, the x-amz-* headers and the content type.
+func (s *S3BlobStore) sign(req *http.Request, payload []byte, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+// canonicalQuery encodes query sorted by name and then value, with an = after
+// names without a value.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := []string{}
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, as the
+// canonical URI of Signature Version 4 requires. Slashes are kept unless
+// encodeSlash is set.
+func uriEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return encoded.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,149 @@
+package infra
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+type SMTPConfig struct {
+	Host     string `required:"true"`
+	Port     int    `default:"587"`
+	Username string
+	Password string
+	From     string `required:"true"`
+}
+
+func ParseSMTPConfig() *SMTPConfig {
+	cfg := SMTPConfig{}
+	envconfig.MustProcess("BOOKSTORE_SMTP", &cfg)
+	return &cfg
+}
+
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTPMailer(cfg *SMTPConfig) *SMTPMailer {
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+
+	return &SMTPMailer{
+		addr: fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
+		auth: auth,
+		from: cfg.From,
+	}
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	message, err := formatMessage(m.from, to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, message)
+}
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// MemoryMailer keeps every message it is asked to send, so tests can read them back.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, Message{To: to, Subject: subject, Body: body})
+
+	return nil
+}
+
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Message(nil), m.messages...)
+}
+
+// LastMessageTo returns the most recent message sent to the given address.
+func (m *MemoryMailer) LastMessageTo(to string) (Message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].To == to {
+			return m.messages[i], true
+		}
+	}
+
+	return Message{}, false
+}
+
+// FileMailer writes every message as an .eml file into a directory, which is
+// handy for local development without an SMTP server.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir, from string) *FileMailer {
+	return &FileMailer{dir: dir, from: from}
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	message, err := formatMessage(m.from, to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+
+	// The recipient is hex encoded, so no address can name a file outside dir.
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), hex.EncodeToString([]byte(to)))
+
+	return os.WriteFile(filepath.Join(m.dir, name), message, 0o644)
+}
+
+// formatMessage builds a plain text message. It refuses header values with
+// line breaks, which would let them add headers of their own.
+func formatMessage(from, to, subject, body string) ([]byte, error) {
+	for _, header := range [][2]string{{"From", from}, {"To", to}, {"Subject", subject}} {
+		if strings.ContainsAny(header[1], "\r\n") {
+			return nil, fmt.Errorf("line break in %s header", header[0])
+		}
+	}
+
+	return []byte(
+		"From: " + from + "\r\n" +
+			"To: " + to + "\r\n" +
+			"Subject: " + subject + "\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"\r\n" +
+			body + "\r\n",
+	), nil
+}
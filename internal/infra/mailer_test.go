@@ -0,0 +1,43 @@
+package infra
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer := NewFileMailer(filepath.Join(dir, "mail"), "store@domain.example")
+
+	t.Run("recipient with path separators, expect file inside dir", func(t *testing.T) {
+		require.NoError(t, mailer.Send("../../escape@domain.example", "Hello", "Body"))
+
+		entries, err := os.ReadDir(filepath.Join(dir, "mail"))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.True(t, strings.HasSuffix(entries[0].Name(), ".eml"))
+		assert.NotContains(t, entries[0].Name(), "/")
+
+		message, err := os.ReadFile(filepath.Join(dir, "mail", entries[0].Name()))
+		require.NoError(t, err)
+		assert.Contains(t, string(message), "To: ../../escape@domain.example\r\n")
+
+		outside, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Len(t, outside, 1)
+	})
+
+	t.Run("line break in header, expect error and no file", func(t *testing.T) {
+		assert.Error(t, mailer.Send("reader@domain.example\r\nBcc: other@domain.example", "Hello", "Body"))
+		assert.Error(t, mailer.Send("reader@domain.example", "Hello\nBcc: other@domain.example", "Body"))
+
+		entries, err := os.ReadDir(filepath.Join(dir, "mail"))
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+}
@@ -1,22 +1,53 @@
 package infra
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
 
 type EnvSecrets struct {
-	authKey string
+	authKey         string
+	retiredAuthKeys map[string]time.Time
 }
 
+// NewEnvSecrets reads the active auth key from BOOKSTORE_SECRETS_AUTHKEY and
+// retired keys from BOOKSTORE_SECRETS_RETIREDAUTHKEYS as a comma separated
+// list of seed@expiry, e.g. 64d4...1415@2026-11-01T00:00:00Z.
 func NewEnvSecrets() EnvSecrets {
 	secrets := struct {
-		AuthKey string `required:"true"`
+		AuthKey         string `required:"true"`
+		RetiredAuthKeys []string
 	}{}
 	envconfig.MustProcess("BOOKSTORE_SECRETS", &secrets)
 
+	retiredAuthKeys := make(map[string]time.Time, len(secrets.RetiredAuthKeys))
+	for _, retired := range secrets.RetiredAuthKeys {
+		seed, expiry, ok := strings.Cut(retired, "@")
+		if !ok {
+			panic(fmt.Sprintf("retired auth key without expiry: %s...", seed[:min(len(seed), 8)]))
+		}
+
+		expiresAt, err := time.Parse(time.RFC3339, expiry)
+		if err != nil {
+			panic(fmt.Sprintf("invalid expiry of retired auth key: %v", err))
+		}
+
+		retiredAuthKeys[seed] = expiresAt
+	}
+
 	return EnvSecrets{
-		authKey: secrets.AuthKey,
+		authKey:         secrets.AuthKey,
+		retiredAuthKeys: retiredAuthKeys,
 	}
 }
 
 func (s *EnvSecrets) GetAuthKey() string {
 	return s.authKey
 }
+
+func (s *EnvSecrets) GetRetiredAuthKeys() map[string]time.Time {
+	return s.retiredAuthKeys
+}
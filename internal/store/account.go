@@ -0,0 +1,341 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	purposeChangeEmail    = "change-email"
+	purposeReauthenticate = "reauthenticate"
+)
+
+// Reauthentication proves that the user of a session is still at the
+// keyboard before credentials change: the current password, or a token
+// mailed by RequestReauthentication, which is the only way for logins
+// created by an identity provider as they have no password.
+type Reauthentication struct {
+	CurrentPassword string
+	ReauthToken     string
+}
+
+// ChangePassword replaces the password of email after reauthentication,
+// or sets the first one of a login without. Every token issued before is
+// invalidated, so the caller gets a fresh pair to stay logged in.
+func (a *App) ChangePassword(email string, reauth Reauthentication, newPassword string, client Client) (Tokens, error) {
+	login, err := a.reauthenticate(email, reauth, client)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	if err := a.passwordPolicy.Validate("newPassword", newPassword, email); err != nil {
+		return Tokens{}, err
+	}
+
+	err = changeLoginPassword(a.db, email, a.passwordHasher.Hash(newPassword), time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		return Tokens{}, fmt.Errorf("user %s: %w", email, ErrNotFound)
+	}
+	if err != nil {
+		return Tokens{}, fmt.Errorf("failed to change password: %w: %w", err, ErrInternal)
+	}
+
+	err = a.mailer.Send(
+		email,
+		"Your password was changed",
+		"The password of your bookstore account was just changed and every other session was logged out.\n\n"+
+			"If it was not you, reset your password right away.",
+	)
+	if err != nil {
+		log.Printf("failed to notify %s of password change: %v", email, err)
+	}
+
+	return a.issueTokens(login, client)
+}
+
+// RequestEmailChange sends a confirmation link to newEmail. The email of the
+// login only changes once the link is opened, proving the new address works.
+func (a *App) RequestEmailChange(email string, reauth Reauthentication, newEmail string, client Client) error {
+	if _, err := mail.ParseAddress(newEmail); err != nil {
+		validation := ValidationError{}
+		validation.Add("newEmail", err.Error())
+		return validation.Err()
+	}
+	if strings.EqualFold(email, newEmail) {
+		validation := ValidationError{}
+		validation.Add("newEmail", "must differ from your current email")
+		return validation.Err()
+	}
+
+	if _, err := a.reauthenticate(email, reauth, client); err != nil {
+		return err
+	}
+
+	_, err := getLoginByEmail(a.db, newEmail)
+	if err == nil {
+		return fmt.Errorf("email %s already registered: %w", newEmail, ErrConflict)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to get login: %w: %w", err, ErrInternal)
+	}
+
+	nonce := newRandomID()
+	if err := setEmailChangeNonce(a.db, email, nonce); err != nil {
+		return fmt.Errorf("failed to store email change: %w: %w", err, ErrInternal)
+	}
+
+	token := a.signToken(signedPayload{
+		Purpose:   purposeChangeEmail,
+		Subject:   email,
+		Data:      newEmail,
+		Nonce:     nonce,
+		ExpiresAt: time.Now().Add(a.verificationTTL).Unix(),
+	})
+
+	link, err := linkWithToken(a.emailChangeURL, token)
+	if err != nil {
+		return fmt.Errorf("invalid email change url: %w: %w", err, ErrInternal)
+	}
+
+	err = a.mailer.Send(
+		newEmail,
+		"Confirm your new email",
+		"Someone asked to move the bookstore account of "+email+" to this address.\n\n"+
+			"Open the link below within "+a.verificationTTL.String()+" to confirm the change:\n\n"+
+			link+"\n\n"+
+			"If it was not you, you can ignore this email.",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to send email change: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
+
+// ConfirmEmailChange moves the login to the address the token was sent to.
+// Only the token of the latest request works, and only once; every token
+// issued to the old email is rejected afterwards.
+func (a *App) ConfirmEmailChange(token string) error {
+	payload, err := a.verifySignedToken(purposeChangeEmail, token)
+	if err != nil {
+		return fmt.Errorf("invalid email change token: %w: %w", err, ErrInvalid)
+	}
+
+	err = changeLoginEmail(a.db, payload.Subject, payload.Data, payload.Nonce, time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("email change already confirmed or superseded: %w", ErrInvalid)
+	}
+	if isUniqueViolation(err) {
+		return fmt.Errorf("email %s already registered: %w", payload.Data, ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to change email: %w: %w", err, ErrInternal)
+	}
+
+	err = a.mailer.Send(
+		payload.Subject,
+		"Your email was changed",
+		"Your bookstore account now uses "+payload.Data+" and this address can no longer log in.\n\n"+
+			"If it was not you, contact support right away.",
+	)
+	if err != nil {
+		log.Printf("failed to notify %s of email change: %v", payload.Subject, err)
+	}
+
+	return nil
+}
+
+// RequestReauthentication mails email a token to reauthenticate with instead
+// of the current password.
+func (a *App) RequestReauthentication(email string) error {
+	nonce := newRandomID()
+	err := setReauthNonce(a.db, email, nonce)
+	if err != nil {
+		return fmt.Errorf("failed to store reauthentication: %w: %w", err, ErrInternal)
+	}
+
+	token := a.signToken(signedPayload{
+		Purpose:   purposeReauthenticate,
+		Subject:   email,
+		Nonce:     nonce,
+		ExpiresAt: time.Now().Add(a.reauthTTL).Unix(),
+	})
+
+	link, err := linkWithToken(a.reauthURL, token)
+	if err != nil {
+		return fmt.Errorf("invalid reauthentication url: %w: %w", err, ErrInternal)
+	}
+
+	err = a.mailer.Send(
+		email,
+		"Confirm it is you",
+		"Someone asked to change the credentials or delete the bookstore account of "+email+".\n\n"+
+			"Open the link below within "+a.reauthTTL.String()+" to confirm it is you:\n\n"+
+			link+"\n\n"+
+			"If it was not you, change your password and log out your other sessions.",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to send reauthentication: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
+
+// reauthenticate checks the mailed token when there is one, or else the
+// current password.
+func (a *App) reauthenticate(email string, reauth Reauthentication, client Client) (Login, error) {
+	if reauth.ReauthToken == "" {
+		return a.checkCurrentPassword(email, reauth.CurrentPassword, client)
+	}
+
+	validation := ValidationError{}
+	payload, err := a.verifySignedToken(purposeReauthenticate, reauth.ReauthToken)
+	if err != nil || payload.Subject != email {
+		validation.Add("reauthToken", "is invalid or expired")
+		return Login{}, validation.Err()
+	}
+
+	err = consumeReauthNonce(a.db, email, payload.Nonce)
+	if errors.Is(err, sql.ErrNoRows) {
+		validation.Add("reauthToken", "was already used or superseded")
+		return Login{}, validation.Err()
+	}
+	if err != nil {
+		return Login{}, fmt.Errorf("failed to consume reauthentication: %w: %w", err, ErrInternal)
+	}
+
+	login, err := getLoginByEmail(a.db, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Login{}, fmt.Errorf("user %s: %w", email, ErrNotFound)
+	}
+	if err != nil {
+		return Login{}, fmt.Errorf("failed to get login: %w: %w", err, ErrInternal)
+	}
+
+	return login, nil
+}
+
+// checkCurrentPassword guards credential changes with the current password.
+// Wrong guesses count as failed logins, so a stolen access token cannot be
+// used to brute force the password.
+func (a *App) checkCurrentPassword(email, password string, client Client) (Login, error) {
+	if err := a.claimLoginAttempt(email, client); err != nil {
+		return Login{}, err
+	}
+
+	login, err := getLoginByEmail(a.db, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Login{}, fmt.Errorf("user %s: %w", email, ErrNotFound)
+	}
+	if err != nil {
+		return Login{}, fmt.Errorf("failed to get login: %w: %w", err, ErrInternal)
+	}
+
+	// Logins created by an identity provider have no password to guess.
+	if login.Hash == "!" {
+		if err := a.releaseLoginAttempt(email, client); err != nil {
+			return Login{}, err
+		}
+
+		validation := ValidationError{}
+		validation.Add("currentPassword", "is not set, reauthenticate by email instead")
+		return Login{}, validation.Err()
+	}
+
+	if ok, _ := a.passwordHasher.Verify(password, login.Hash); !ok {
+		validation := ValidationError{}
+		validation.Add("currentPassword", "is incorrect")
+		return Login{}, validation.Err()
+	}
+
+	if err := a.releaseLoginAttempt(email, client); err != nil {
+		return Login{}, err
+	}
+
+	return login, nil
+}
+
+// Account is the login metadata of a user, without credentials.
+type Account struct {
+	Email         string
+	Role          Role
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	VerifiedAt    *time.Time
+	TOTPEnabledAt *time.Time
+}
+
+// AccountExport is everything stored about a user, for data access requests.
+// Password hashes, TOTP secrets and recovery codes are left out, they are of
+// no use to the user and dangerous in a downloaded file.
+type AccountExport struct {
+	ExportedAt         time.Time
+	Account            Account
+	ExternalIdentities []ExternalIdentity
+	Sessions           []Session
+	APIKeys            []APIKey
+	Orders             []OrderDetail
+}
+
+func (a *App) ExportAccount(email string) (AccountExport, error) {
+	account, err := getAccount(a.db, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AccountExport{}, fmt.Errorf("user %s: %w", email, ErrNotFound)
+	}
+	if err != nil {
+		return AccountExport{}, fmt.Errorf("failed to get account: %w: %w", err, ErrInternal)
+	}
+
+	identities, err := getExternalIdentitiesByEmail(a.db, email)
+	if err != nil {
+		return AccountExport{}, fmt.Errorf("failed to get external identities: %w: %w", err, ErrInternal)
+	}
+
+	sessions, err := getActiveSessions(a.db, email)
+	if err != nil {
+		return AccountExport{}, fmt.Errorf("failed to get sessions: %w: %w", err, ErrInternal)
+	}
+
+	apiKeys, err := getAPIKeysByUser(a.db, email)
+	if err != nil {
+		return AccountExport{}, fmt.Errorf("failed to get api keys: %w: %w", err, ErrInternal)
+	}
+
+	orders, err := getOrdersByUser(a.db, email)
+	if err != nil {
+		return AccountExport{}, fmt.Errorf("failed to get orders: %w: %w", err, ErrInternal)
+	}
+
+	return AccountExport{
+		ExportedAt:         time.Now(),
+		Account:            account,
+		ExternalIdentities: identities,
+		Sessions:           sessions,
+		APIKeys:            apiKeys,
+		Orders:             orders,
+	}, nil
+}
+
+// DeleteAccount removes the login of email with its credentials. Orders are
+// kept for accounting, with the email replaced by an anonymous id that cannot
+// be traced back.
+func (a *App) DeleteAccount(email string, reauth Reauthentication, client Client) error {
+	if _, err := a.reauthenticate(email, reauth, client); err != nil {
+		return err
+	}
+
+	err := deleteLogin(a.db, email, "deleted:"+newRandomID())
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("user %s: %w", email, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete account: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
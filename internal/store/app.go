@@ -1,39 +1,107 @@
 package store
 
 import (
-	"crypto/ed25519"
 	"crypto/rand"
-	"crypto/subtle"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/mail"
+	"net/url"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/argon2"
 )
 
+// Secrets supplies hex encoded ed25519 seeds. GetAuthKey is the active key
+// that signs new tokens, GetRetiredAuthKeys maps keys that were rotated out to
+// the time until which they still verify tokens.
 type Secrets interface {
 	GetAuthKey() string
+	GetRetiredAuthKeys() map[string]time.Time
+}
+
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// BlobStore keeps the files that clients download, such as book covers,
+// under slash separated keys. URL is where clients download key from.
+type BlobStore interface {
+	Put(key, contentType string, data []byte) error
+	// Delete succeeds when key does not exist.
+	Delete(key string) error
+	URL(key string) string
 }
 
 type App struct {
-	authKey ed25519.PrivateKey
-	db      *sql.DB
+	keys             KeyRing
+	tokenValidator   *jwt.Validator
+	tokenIssuer      string
+	tokenAudience    string
+	tokenTenant      string
+	tokenUserID      bool
+	accessTokenTTL   time.Duration
+	refreshTokenTTL  time.Duration
+	passwordResetURL string
+	passwordResetTTL time.Duration
+	verificationURL  string
+	verificationTTL  time.Duration
+	emailChangeURL   string
+	reauthURL        string
+	reauthTTL        time.Duration
+	oidcLoginURL     string
+	requireVerified  bool
+	passwordPolicy   PasswordPolicy
+	passwordHasher   PasswordHasher
+	loginThrottle    LoginThrottle
+	totpIssuer       string
+	mfaChallengeTTL  time.Duration
+	oidcProviders    map[string]*oidcProvider
+	db               *sql.DB
+	mailer           Mailer
+	blobs            BlobStore
 }
 
-func NewApp(secrets Secrets, db *sql.DB) App {
-	seed, err := hex.DecodeString(secrets.GetAuthKey())
-	if err != nil {
-		panic(err)
+func NewApp(cfg ServerConfig, secrets Secrets, db *sql.DB, mailer Mailer, blobs BlobStore) App {
+	oidcProviders := make(map[string]*oidcProvider, len(cfg.OIDC))
+	for _, provider := range cfg.OIDC {
+		oidcProviders[provider.Name] = newOIDCProvider(provider)
 	}
 
 	return App{
-		authKey: ed25519.NewKeyFromSeed(seed),
-		db:      db,
+		keys:             NewKeyRing(secrets),
+		tokenValidator:   jwt.NewValidator(accessTokenOptions(cfg)...),
+		tokenIssuer:      cfg.TokenIssuer,
+		tokenAudience:    cfg.TokenAudience,
+		tokenTenant:      cfg.TokenTenant,
+		tokenUserID:      cfg.TokenUserID,
+		accessTokenTTL:   cfg.AccessTokenTTL,
+		refreshTokenTTL:  cfg.RefreshTokenTTL,
+		passwordResetURL: cfg.PasswordResetURL,
+		passwordResetTTL: cfg.PasswordResetTTL,
+		verificationURL:  cfg.VerificationURL,
+		verificationTTL:  cfg.VerificationTTL,
+		emailChangeURL:   cfg.EmailChangeURL,
+		reauthURL:        cfg.ReauthURL,
+		reauthTTL:        cfg.ReauthTTL,
+		oidcLoginURL:     cfg.OIDCLoginURL,
+		requireVerified:  cfg.RequireVerifiedEmail,
+		passwordPolicy:   NewPasswordPolicy(cfg),
+		passwordHasher:   NewPasswordHasher(cfg),
+		loginThrottle:    NewLoginThrottle(cfg),
+		totpIssuer:       cfg.TOTPIssuer,
+		mfaChallengeTTL:  cfg.MFAChallengeTTL,
+		oidcProviders:    oidcProviders,
+		db:               db,
+		mailer:           mailer,
+		blobs:            blobs,
 	}
 }
 
@@ -42,91 +110,621 @@ type User struct {
 	Password string
 }
 
+type Role string
+
+const (
+	RoleCustomer = Role("customer")
+	RoleStaff    = Role("staff")
+	RoleAdmin    = Role("admin")
+)
+
+func (r Role) Valid() bool {
+	return r == RoleCustomer || r == RoleStaff || r == RoleAdmin
+}
+
 type Login struct {
-	Email string
-	Hash  string
+	ID            int
+	Email         string
+	Hash          string
+	Role          Role
+	VerifiedAt    *time.Time
+	TOTPSecret    string
+	TOTPEnabledAt *time.Time
+}
+
+// Claims are the claims of an access token issued by LoginUser.
+type Claims struct {
+	jwt.RegisteredClaims
+	Role Role `json:"role"`
+	// SessionID ties the token to the session it was issued in, so it can
+	// be terminated from another device.
+	SessionID string `json:"sid,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	UserID    int    `json:"uid,omitempty"`
+
+	// Scopes limit requests authenticated with an API key. Access tokens
+	// have no scopes and may do everything their role allows.
+	Scopes []Scope `json:"scopes,omitempty"`
+}
+
+func (c *Claims) HasScope(scope Scope) bool {
+	return c.Scopes == nil || slices.Contains(c.Scopes, scope)
 }
 
 func (a *App) RegisterUser(user User) error {
+	validation := ValidationError{}
 	if _, err := mail.ParseAddress(user.Email); err != nil {
-		return fmt.Errorf("invalid email: %w %s", err, user.Email)
+		validation.Add("email", err.Error())
 	}
-
-	if user.Password == "" {
-		return fmt.Errorf("password is required: %w", ErrInvalid)
+	for _, problem := range a.passwordPolicy.Check(user.Password, user.Email) {
+		validation.Add("password", problem)
+	}
+	if err := validation.Err(); err != nil {
+		return err
 	}
 
-	hash := hashPassword(user.Password)
+	hash := a.passwordHasher.Hash(user.Password)
 
 	err := insertLogin(a.db, Login{Email: user.Email, Hash: hash})
 	if err != nil {
 		return fmt.Errorf("failed to insert login: %w: %w", err, ErrConflict)
 	}
 
+	// The account exists at this point, a lost email can be sent again.
+	if err := a.sendVerification(user.Email); err != nil {
+		log.Printf("failed to send verification to %s: %v", user.Email, err)
+	}
+
+	return nil
+}
+
+const purposeVerifyEmail = "verify-email"
+
+// ResendVerification sends a new verification link unless email is already verified.
+func (a *App) ResendVerification(email string) error {
+	login, err := getLoginByEmail(a.db, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("user %s: %w", email, ErrUnauthorized)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get login: %w: %w", err, ErrInternal)
+	}
+
+	if login.VerifiedAt != nil {
+		return fmt.Errorf("email already verified: %w", ErrConflict)
+	}
+
+	if err := a.sendVerification(email); err != nil {
+		return fmt.Errorf("failed to send verification: %w: %w", err, ErrInternal)
+	}
+
 	return nil
 }
 
-func (a *App) LoginUser(user User) (token jwt.RegisteredClaims, err error) {
+func (a *App) VerifyEmail(token string) error {
+	payload, err := a.verifySignedToken(purposeVerifyEmail, token)
+	if err != nil {
+		return fmt.Errorf("invalid verification token: %w: %w", err, ErrInvalid)
+	}
+
+	err = markLoginVerified(a.db, payload.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("user %s: %w", payload.Subject, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to verify email: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
+
+func (a *App) sendVerification(email string) error {
+	token := a.signToken(signedPayload{
+		Purpose:   purposeVerifyEmail,
+		Subject:   email,
+		ExpiresAt: time.Now().Add(a.verificationTTL).Unix(),
+	})
+
+	link, err := linkWithToken(a.verificationURL, token)
+	if err != nil {
+		return err
+	}
+
+	return a.mailer.Send(
+		email,
+		"Verify your email",
+		"Welcome to the bookstore!\n\n"+
+			"Open the link below within "+a.verificationTTL.String()+" to verify your email address:\n\n"+
+			link+"\n\n"+
+			"You can browse the store right away, but orders need a verified address.",
+	)
+}
+
+// Tokens is the result of a successful login or refresh. Access still has to
+// be signed with SignAccessToken, Refresh is an opaque token that is only stored hashed.
+type Tokens struct {
+	Access           Claims
+	Refresh          string
+	RefreshExpiresAt time.Time
+}
+
+type RefreshToken struct {
+	Family    string
+	Email     string
+	Hash      string
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+// LoginUser checks the password of user. Accounts with two-factor
+// authentication get an MFA challenge instead of tokens.
+func (a *App) LoginUser(user User, client Client) (LoginResult, error) {
+	if err := a.claimLoginAttempt(user.Email, client); err != nil {
+		return LoginResult{}, err
+	}
+
 	login, err := getLoginByEmail(a.db, user.Email)
 	if err != nil {
-		return jwt.RegisteredClaims{}, fmt.Errorf("login failed: %w", ErrUnauthorized)
+		return LoginResult{}, fmt.Errorf("login failed: %w", ErrUnauthorized)
+	}
+
+	ok, outdated := a.passwordHasher.Verify(user.Password, login.Hash)
+	if !ok {
+		return LoginResult{}, fmt.Errorf("login failed: %w", ErrUnauthorized)
+	}
+
+	// The password is only available in plain text right now, so this is
+	// the moment to move the hash to the current parameters.
+	if outdated {
+		if err := updateLoginHash(a.db, login.Email, login.Hash, a.passwordHasher.Hash(user.Password)); err != nil {
+			log.Printf("failed to rehash password of %s: %v", login.Email, err)
+		}
+	}
+
+	// Failures are only forgotten once the second factor is verified too.
+	if login.TOTPEnabledAt != nil {
+		if err := a.releaseLoginAttempt(user.Email, client); err != nil {
+			return LoginResult{}, err
+		}
+
+		return a.newMFAChallenge(login), nil
+	}
+
+	if err := a.recordLoginSuccess(user.Email, client); err != nil {
+		return LoginResult{}, err
+	}
+
+	tokens, err := a.issueTokens(login, client)
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	return LoginResult{Tokens: tokens}, nil
+}
+
+// RefreshTokens rotates a refresh token: the presented token is revoked and a
+// new pair is issued in the same family. Presenting an already rotated token
+// means it leaked, so the whole family is revoked.
+func (a *App) RefreshTokens(refreshToken string, client Client) (Tokens, error) {
+	hash := hashToken(refreshToken)
+
+	stored, err := getRefreshToken(a.db, hash)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("refresh failed: %w", ErrUnauthorized)
+	}
+
+	if stored.RevokedAt != nil {
+		if err := revokeRefreshTokenFamily(a.db, stored.Family); err != nil {
+			return Tokens{}, fmt.Errorf("failed to revoke token family: %w: %w", err, ErrInternal)
+		}
+
+		return Tokens{}, fmt.Errorf("refresh token reused: %w", ErrUnauthorized)
+	}
+
+	if time.Now().After(stored.ExpiresAt) {
+		return Tokens{}, fmt.Errorf("refresh token expired: %w", ErrUnauthorized)
+	}
+
+	login, err := getLoginByEmail(a.db, stored.Email)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("refresh failed: %w", ErrUnauthorized)
+	}
+
+	tokens, next := a.newTokens(login, stored.Family)
+
+	err = rotateRefreshToken(a.db, hash, next)
+	if errors.Is(err, sql.ErrNoRows) {
+		if err := revokeRefreshTokenFamily(a.db, stored.Family); err != nil {
+			return Tokens{}, fmt.Errorf("failed to revoke token family: %w: %w", err, ErrInternal)
+		}
+
+		return Tokens{}, fmt.Errorf("refresh token reused: %w", ErrUnauthorized)
+	}
+	if err != nil {
+		return Tokens{}, fmt.Errorf("failed to rotate refresh token: %w: %w", err, ErrInternal)
+	}
+
+	if err := touchSession(a.db, stored.Family, tokens.Access.ID, client); err != nil {
+		return Tokens{}, fmt.Errorf("failed to update session: %w: %w", err, ErrInternal)
+	}
+
+	return tokens, nil
+}
+
+// Logout revokes the access token and ends its session. Tokens issued before
+// sessions existed carry no session, their refresh token ends the family.
+func (a *App) Logout(claims Claims, refreshToken string) error {
+	if err := revokeAccessToken(a.db, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return fmt.Errorf("failed to revoke access token: %w: %w", err, ErrInternal)
+	}
+
+	if claims.SessionID != "" {
+		if err := revokeRefreshTokenFamily(a.db, claims.SessionID); err != nil {
+			return fmt.Errorf("failed to revoke token family: %w: %w", err, ErrInternal)
+		}
+
+		return nil
+	}
+
+	if refreshToken == "" {
+		return nil
+	}
+
+	stored, err := getRefreshToken(a.db, hashToken(refreshToken))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get refresh token: %w: %w", err, ErrInternal)
+	}
+
+	if err := revokeRefreshTokenFamily(a.db, stored.Family); err != nil {
+		return fmt.Errorf("failed to revoke token family: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
+
+// IsTokenRevoked reports whether the token was revoked by logout, belongs to a
+// terminated session, or was issued before the credentials of its subject
+// last changed.
+func (a *App) IsTokenRevoked(claims Claims) (bool, error) {
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+
+	revoked, err := isAccessTokenRevoked(a.db, claims.ID, claims.SessionID, claims.Subject, issuedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to check token revocation: %w: %w", err, ErrInternal)
+	}
+
+	return revoked, nil
+}
+
+func (a *App) SignAccessToken(claims Claims) (string, error) {
+	return a.keys.Sign(claims)
+}
+
+func (a *App) KeyFunc(token *jwt.Token) (interface{}, error) {
+	return a.keys.KeyFunc(token)
+}
+
+func accessTokenOptions(cfg ServerConfig) []jwt.ParserOption {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(cfg.TokenIssuer),
+		jwt.WithLeeway(cfg.TokenLeeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	}
+	if cfg.TokenAudience != "" {
+		options = append(options, jwt.WithAudience(cfg.TokenAudience))
+	}
+
+	return options
+}
+
+// ValidateAccessToken checks the registered claims of an access token whose
+// signature was verified, and that it belongs to the configured tenant.
+func (a *App) ValidateAccessToken(claims Claims) error {
+	if err := a.tokenValidator.Validate(claims); err != nil {
+		return err
+	}
+	if claims.Tenant != a.tokenTenant {
+		return fmt.Errorf("token is for tenant %q", claims.Tenant)
+	}
+
+	return nil
+}
+
+// ParseAccessToken verifies the signature and claims of an access token,
+// with the configured leeway.
+func (a *App) ParseAccessToken(raw string) (*jwt.Token, error) {
+	token, err := jwt.ParseWithClaims(raw, &Claims{}, a.KeyFunc, jwt.WithoutClaimsValidation())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.ValidateAccessToken(*token.Claims.(*Claims)); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (a *App) JWKS() JWKSet {
+	return a.keys.JWKS()
+}
+
+// issueTokens starts a new session of login on client.
+func (a *App) issueTokens(login Login, client Client) (Tokens, error) {
+	tokens, refresh := a.newTokens(login, newRandomID())
+
+	session := Session{
+		ID:        refresh.Family,
+		Email:     login.Email,
+		UserAgent: client.userAgent(),
+		IP:        client.ip(),
+	}
+	if err := insertSession(a.db, session, tokens.Access.ID, refresh); err != nil {
+		return Tokens{}, fmt.Errorf("failed to insert session: %w: %w", err, ErrInternal)
+	}
+
+	return tokens, nil
+}
+
+func (a *App) audience() jwt.ClaimStrings {
+	if a.tokenAudience == "" {
+		return nil
+	}
+
+	return jwt.ClaimStrings{a.tokenAudience}
+}
+
+func (a *App) newTokens(login Login, family string) (Tokens, RefreshToken) {
+	now := time.Now()
+	refreshToken := newRandomToken()
+	refreshExpiresAt := now.Add(a.refreshTokenTTL)
+
+	tokens := Tokens{
+		Access: Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        newRandomID(),
+				Issuer:    a.tokenIssuer,
+				Subject:   login.Email,
+				Audience:  a.audience(),
+				ExpiresAt: jwt.NewNumericDate(now.Add(a.accessTokenTTL)),
+				IssuedAt:  jwt.NewNumericDate(now),
+				NotBefore: jwt.NewNumericDate(now),
+			},
+			Role:      login.Role,
+			SessionID: family,
+			Tenant:    a.tokenTenant,
+		},
+		Refresh:          refreshToken,
+		RefreshExpiresAt: refreshExpiresAt,
+	}
+
+	if a.tokenUserID {
+		tokens.Access.UserID = login.ID
+	}
+
+	return tokens, RefreshToken{
+		Family:    family,
+		Email:     login.Email,
+		Hash:      hashToken(refreshToken),
+		ExpiresAt: refreshExpiresAt,
 	}
+}
 
-	if !verifyPassword(user.Password, login.Hash) {
-		return jwt.RegisteredClaims{}, fmt.Errorf("login failed: %w", ErrUnauthorized)
+func newRandomID() string {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		panic(err)
 	}
 
-	return jwt.RegisteredClaims{
-		Issuer:    "gotu",
-		Subject:   user.Email,
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		NotBefore: jwt.NewNumericDate(time.Now()),
-	}, nil
+	return hex.EncodeToString(id)
 }
 
-func hashPassword(password string) string {
-	salt := make([]byte, 16)
-	_, err := rand.Read(salt)
+func newRandomToken() string {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
 	if err != nil {
 		panic(err)
 	}
 
-	hash := argon2.IDKey([]byte(password), salt, 1, 64*1024, 1, 32)
+	return base64.RawURLEncoding.EncodeToString(token)
+}
 
-	return base64.StdEncoding.EncodeToString(hash) + "." + base64.StdEncoding.EncodeToString(salt)
+// signedPayload is the content of a stateless token signed with the auth keys,
+// used where a link has to prove that we issued it, like email verification.
+type signedPayload struct {
+	Purpose   string `json:"p"`
+	Subject   string `json:"s"`
+	Data      string `json:"d,omitempty"`
+	Nonce     string `json:"n,omitempty"`
+	ExpiresAt int64  `json:"e"`
 }
 
-func verifyPassword(password, hash string) bool {
-	parts := strings.Split(hash, ".")
+func (a *App) signToken(payload signedPayload) string {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		panic(err)
+	}
+	signature := a.keys.sign(encoded)
+
+	return base64.RawURLEncoding.EncodeToString(encoded) + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (a *App) verifySignedToken(purpose, token string) (signedPayload, error) {
+	parts := strings.Split(token, ".")
 	if len(parts) != 2 {
-		return false
+		return signedPayload{}, errors.New("malformed token")
+	}
+	encoded, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return signedPayload{}, errors.New("malformed token")
 	}
-	decodedHash, err := base64.StdEncoding.DecodeString(parts[0])
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		return false
+		return signedPayload{}, errors.New("malformed token")
 	}
-	decodedSalt, err := base64.StdEncoding.DecodeString(parts[1])
+
+	if err := a.keys.verify(encoded, signature); err != nil {
+		return signedPayload{}, err
+	}
+
+	var payload signedPayload
+	if err := json.Unmarshal(encoded, &payload); err != nil {
+		return signedPayload{}, errors.New("malformed token")
+	}
+	if payload.Purpose != purpose {
+		return signedPayload{}, errors.New("wrong token purpose")
+	}
+	if time.Now().Unix() > payload.ExpiresAt {
+		return signedPayload{}, errors.New("token expired")
+	}
+
+	return payload, nil
+}
+
+func linkWithToken(baseURL, token string) (string, error) {
+	link, err := url.Parse(baseURL)
 	if err != nil {
-		return false
+		return "", err
 	}
-	comparisonHash := argon2.IDKey([]byte(password), decodedSalt, 1, 64*1024, 1, 32)
-	return subtle.ConstantTimeCompare(decodedHash, comparisonHash) == 1
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return link.String(), nil
 }
 
-type Book struct {
-	ID     int
-	Title  string
-	Author string
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
 }
 
-func (a *App) GetBooks() ([]Book, error) {
-	return getBooks(a.db)
+type PasswordReset struct {
+	Email     string
+	Hash      string
+	ExpiresAt time.Time
+}
+
+// RequestPasswordReset mails a single-use reset link to email. It does not
+// report unknown addresses so the endpoint cannot be used to probe for users.
+func (a *App) RequestPasswordReset(email string) error {
+	login, err := getLoginByEmail(a.db, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get login: %w: %w", err, ErrInternal)
+	}
+
+	token := newRandomToken()
+	err = insertPasswordReset(a.db, PasswordReset{
+		Email:     login.Email,
+		Hash:      hashToken(token),
+		ExpiresAt: time.Now().Add(a.passwordResetTTL),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to insert password reset: %w: %w", err, ErrInternal)
+	}
+
+	link, err := linkWithToken(a.passwordResetURL, token)
+	if err != nil {
+		return fmt.Errorf("invalid password reset url: %w: %w", err, ErrInternal)
+	}
+
+	err = a.mailer.Send(
+		login.Email,
+		"Reset your password",
+		"Someone asked to reset the password of your bookstore account.\n\n"+
+			"Open the link below within "+a.passwordResetTTL.String()+" to choose a new password:\n\n"+
+			link+"\n\n"+
+			"If it was not you, you can ignore this email.",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to send password reset: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
+
+// ConfirmPasswordReset sets a new password using a token from
+// RequestPasswordReset and signs the user out everywhere.
+func (a *App) ConfirmPasswordReset(token, password string) error {
+	reset, err := getPasswordReset(a.db, hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("invalid or expired reset token: %w", ErrInvalid)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get password reset: %w: %w", err, ErrInternal)
+	}
+
+	if err := a.passwordPolicy.Validate("password", password, reset.Email); err != nil {
+		return err
+	}
+
+	err = consumePasswordReset(a.db, reset.Hash, a.passwordHasher.Hash(password), time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("invalid or expired reset token: %w", ErrInvalid)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reset password: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
+
+// Book is a title in the catalog. ISBN is the 13 digit ISBN without
+// hyphens, Language a BCP 47 tag such as en or id. Fields that are unknown
+// for a book are left empty.
+type Book struct {
+	ID           int
+	Title        string
+	Author       string
+	Contributors []Contributor
+	Categories   []Category
+	Tags         []string
+	Cover        *BookCover
+	Price        Price
+	ISBN         string
+	Description  string
+	Publisher    string
+	PublishedAt  *time.Time
+	Language     string
+	PageCount    *int
+	Available    bool
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+
+	// cover is the key prefix of the cover thumbnails.
+	cover string
 }
 
 type OrderStatus string
 
-const OrderStatusPending = OrderStatus("pending")
+const (
+	OrderStatusPending   = OrderStatus("pending")
+	OrderStatusPaid      = OrderStatus("paid")
+	OrderStatusShipped   = OrderStatus("shipped")
+	OrderStatusDelivered = OrderStatus("delivered")
+	OrderStatusCancelled = OrderStatus("cancelled")
+)
+
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case OrderStatusPending, OrderStatusPaid, OrderStatusShipped, OrderStatusDelivered, OrderStatusCancelled:
+		return true
+	}
+
+	return false
+}
 
 type Order struct {
 	ID     int
@@ -167,6 +765,16 @@ func (a *App) CreateOrder(orderRequest OrderRequest) (Order, error) {
 		return Order{}, fmt.Errorf("order must have at least one item: %w", ErrInvalid)
 	}
 
+	if a.requireVerified {
+		login, err := getLoginByEmail(a.db, orderRequest.User)
+		if err != nil {
+			return Order{}, fmt.Errorf("failed to get login: %w: %w", err, ErrInternal)
+		}
+		if login.VerifiedAt == nil {
+			return Order{}, fmt.Errorf("email must be verified before ordering: %w", ErrForbidden)
+		}
+	}
+
 	order, err := insertOrders(a.db, orderRequest)
 	if err != nil {
 		return Order{}, fmt.Errorf("failed to insert order: %w: %w", err, ErrConflict)
@@ -174,3 +782,43 @@ func (a *App) CreateOrder(orderRequest OrderRequest) (Order, error) {
 
 	return order, nil
 }
+
+func (a *App) GetOrders(status OrderStatus) ([]OrderDetail, error) {
+	if status != "" && !status.Valid() {
+		return nil, fmt.Errorf("unknown order status %q: %w", status, ErrInvalid)
+	}
+
+	return getOrders(a.db, status)
+}
+
+func (a *App) UpdateOrderStatus(orderID int, status OrderStatus) (Order, error) {
+	if !status.Valid() {
+		return Order{}, fmt.Errorf("unknown order status %q: %w", status, ErrInvalid)
+	}
+
+	order, err := updateOrderStatus(a.db, orderID, status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Order{}, fmt.Errorf("order %d: %w", orderID, ErrNotFound)
+	}
+	if err != nil {
+		return Order{}, fmt.Errorf("failed to update order: %w: %w", err, ErrInternal)
+	}
+
+	return order, nil
+}
+
+func (a *App) SetUserRole(email string, role Role) error {
+	if !role.Valid() {
+		return fmt.Errorf("unknown role %q: %w", role, ErrInvalid)
+	}
+
+	err := updateLoginRole(a.db, email, role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("user %s: %w", email, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update role: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
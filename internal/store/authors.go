@@ -0,0 +1,179 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type ContributorRole string
+
+const (
+	ContributorAuthor     = ContributorRole("author")
+	ContributorEditor     = ContributorRole("editor")
+	ContributorTranslator = ContributorRole("translator")
+)
+
+func (r ContributorRole) Valid() bool {
+	switch r {
+	case ContributorAuthor, ContributorEditor, ContributorTranslator:
+		return true
+	}
+
+	return false
+}
+
+// Contributor credits an author on a book in a role. Books list their
+// contributors in the order given when the book was saved.
+type Contributor struct {
+	AuthorID int
+	Name     string
+	Role     ContributorRole
+}
+
+// Author is a person credited on books. BookCount counts the books they
+// are credited on in any role.
+type Author struct {
+	ID        int
+	Name      string
+	BookCount int
+	CreatedAt time.Time
+}
+
+// sameContributors tells whether a and b credit the same names in the same
+// roles and order.
+func sameContributors(a, b []Contributor) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Role != b[i].Role {
+			return false
+		}
+	}
+
+	return true
+}
+
+// withContributors fills in the contributors of books.
+func (a *App) withContributors(books []Book) error {
+	if len(books) == 0 {
+		return nil
+	}
+
+	ids := make([]int, 0, len(books))
+	for _, book := range books {
+		ids = append(ids, book.ID)
+	}
+
+	contributors, err := getBookContributors(a.db, ids)
+	if err != nil {
+		return fmt.Errorf("failed to get contributors: %w: %w", err, ErrInternal)
+	}
+
+	for i := range books {
+		books[i].Contributors = contributors[books[i].ID]
+	}
+
+	return nil
+}
+
+const (
+	defaultAuthorPageSize = 50
+	maxAuthorPageSize     = 200
+)
+
+// AuthorQuery selects a page of authors by name. Name matches
+// case-insensitively anywhere in the name.
+type AuthorQuery struct {
+	Limit  int
+	Cursor string
+	Name   string
+}
+
+// AuthorPage is a page of authors. NextCursor is empty on the last page.
+type AuthorPage struct {
+	Authors    []Author
+	NextCursor string
+}
+
+// authorCursor is the position after the last author of a page.
+type authorCursor struct {
+	Name string `json:"n"`
+	ID   int    `json:"i"`
+}
+
+func (c authorCursor) encode() string {
+	encoded, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeAuthorCursor(cursor string) (c authorCursor, err error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return authorCursor{}, err
+	}
+	err = json.Unmarshal(decoded, &c)
+
+	return c, err
+}
+
+// GetAuthors lists the authors credited on at least one book, by name.
+func (a *App) GetAuthors(query AuthorQuery) (AuthorPage, error) {
+	validation := ValidationError{}
+
+	if query.Limit == 0 {
+		query.Limit = defaultAuthorPageSize
+	}
+	if query.Limit < 1 || query.Limit > maxAuthorPageSize {
+		validation.Add("limit", fmt.Sprintf("must be between 1 and %d", maxAuthorPageSize))
+	}
+
+	var cursor *authorCursor
+	if query.Cursor != "" {
+		decoded, err := decodeAuthorCursor(query.Cursor)
+		if err != nil {
+			validation.Add("cursor", "is invalid")
+		}
+		cursor = &decoded
+	}
+
+	if err := validation.Err(); err != nil {
+		return AuthorPage{}, err
+	}
+
+	// One extra author tells whether there is a next page.
+	authors, err := getAuthors(a.db, strings.TrimSpace(query.Name), cursor, query.Limit+1)
+	if err != nil {
+		return AuthorPage{}, fmt.Errorf("failed to get authors: %w: %w", err, ErrInternal)
+	}
+
+	page := AuthorPage{Authors: authors}
+	if len(authors) > query.Limit {
+		page.Authors = authors[:query.Limit]
+		last := page.Authors[query.Limit-1]
+		page.NextCursor = authorCursor{Name: last.Name, ID: last.ID}.encode()
+	}
+
+	return page, nil
+}
+
+func (a *App) GetAuthor(id int) (Author, error) {
+	author, err := getAuthorByID(a.db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Author{}, fmt.Errorf("author %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return Author{}, fmt.Errorf("failed to get author: %w: %w", err, ErrInternal)
+	}
+
+	return author, nil
+}
@@ -0,0 +1,763 @@
+package store
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// BookRequest is the editable part of a book, as created or replaced by an
+// admin.
+type BookRequest struct {
+	Title string
+	// Author is the byline. When left out, it lists the contributors in the
+	// author role.
+	Author string
+	// Contributors are matched to authors by name. When left out, Author
+	// becomes the only author.
+	Contributors []Contributor
+	// CategoryIDs files the book under categories, Tags labels it freely.
+	CategoryIDs []int
+	Tags        []string
+	Price       Price
+	ISBN        string
+	Description string
+	Publisher   string
+	PublishedAt *time.Time
+	Language    string
+	PageCount   *int
+	// Available defaults to true when left out.
+	Available *bool
+}
+
+// BookPatch changes only the fields that are set. PublishedAt and PageCount
+// cannot be cleared by a patch, a replace with BookRequest can.
+type BookPatch struct {
+	Title        *string
+	Author       *string
+	Contributors *[]Contributor
+	CategoryIDs  *[]int
+	Tags         *[]string
+	Price        *Price
+	ISBN         *string
+	Description  *string
+	Publisher    *string
+	PublishedAt  *time.Time
+	Language     *string
+	PageCount    *int
+	Available    *bool
+}
+
+func (p BookPatch) apply(book Book) BookRequest {
+	request := BookRequest{
+		Title:        book.Title,
+		Author:       book.Author,
+		Contributors: book.Contributors,
+		Tags:         book.Tags,
+		Price:        book.Price,
+		ISBN:         book.ISBN,
+		Description:  book.Description,
+		Publisher:    book.Publisher,
+		PublishedAt:  book.PublishedAt,
+		Language:     book.Language,
+		PageCount:    book.PageCount,
+		Available:    &book.Available,
+	}
+	for _, category := range book.Categories {
+		request.CategoryIDs = append(request.CategoryIDs, category.ID)
+	}
+
+	if p.Title != nil {
+		request.Title = *p.Title
+	}
+	// A new byline without contributors names the only author, new
+	// contributors without a byline make up a new one.
+	if p.Author != nil {
+		request.Author = *p.Author
+		request.Contributors = nil
+	}
+	if p.Contributors != nil {
+		request.Contributors = *p.Contributors
+		if p.Author == nil {
+			request.Author = ""
+		}
+	}
+	if p.CategoryIDs != nil {
+		request.CategoryIDs = *p.CategoryIDs
+	}
+	if p.Tags != nil {
+		request.Tags = *p.Tags
+	}
+	if p.Price != nil {
+		request.Price = *p.Price
+	}
+	if p.ISBN != nil {
+		request.ISBN = *p.ISBN
+	}
+	if p.Description != nil {
+		request.Description = *p.Description
+	}
+	if p.Publisher != nil {
+		request.Publisher = *p.Publisher
+	}
+	if p.PublishedAt != nil {
+		request.PublishedAt = p.PublishedAt
+	}
+	if p.Language != nil {
+		request.Language = *p.Language
+	}
+	if p.PageCount != nil {
+		request.PageCount = p.PageCount
+	}
+	if p.Available != nil {
+		request.Available = p.Available
+	}
+
+	return request
+}
+
+// Price is an amount in cents. It is written as a number with two decimals
+// and read from one with at most two, like the DECIMAL(10, 2) column it is
+// kept in, so that prices never pass through a float.
+type Price int64
+
+// maxPrice is the largest price DECIMAL(10, 2) can hold.
+const maxPrice Price = 99999999_99
+
+var errInvalidPrice = errors.New("must be a number with at most two decimals")
+
+// ParsePrice parses an amount such as 12, 12.5 or -12.50. Exponents and
+// further decimals other than trailing zeros are rejected rather than
+// rounded away.
+func ParsePrice(value string) (Price, error) {
+	digits, negative := strings.CutPrefix(value, "-")
+	whole, fraction, hasPoint := strings.Cut(digits, ".")
+	if whole == "" || (hasPoint && fraction == "") || !onlyDigits(whole) || !onlyDigits(fraction) {
+		return 0, errInvalidPrice
+	}
+
+	fraction = strings.TrimRight(fraction, "0")
+	if len(fraction) > 2 {
+		return 0, errInvalidPrice
+	}
+
+	cents, err := strconv.ParseInt(whole+fraction+strings.Repeat("0", 2-len(fraction)), 10, 64)
+	if err != nil {
+		return 0, errInvalidPrice
+	}
+	if negative {
+		cents = -cents
+	}
+
+	return Price(cents), nil
+}
+
+func onlyDigits(value string) bool {
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p Price) String() string {
+	if p < 0 {
+		return "-" + (-p).String()
+	}
+
+	return fmt.Sprintf("%d.%02d", p/100, p%100)
+}
+
+func (p Price) MarshalJSON() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Price) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	price, err := ParsePrice(string(data))
+	if err != nil {
+		return fmt.Errorf("price %s: %w", data, err)
+	}
+	*p = price
+
+	return nil
+}
+
+func (p *Price) Scan(src any) error {
+	var value string
+	switch src := src.(type) {
+	case []byte:
+		value = string(src)
+	case string:
+		value = src
+	default:
+		return fmt.Errorf("cannot scan %T into a price", src)
+	}
+
+	price, err := ParsePrice(value)
+	if err != nil {
+		return fmt.Errorf("price %s: %w", value, err)
+	}
+	*p = price
+
+	return nil
+}
+
+func (p Price) Value() (driver.Value, error) {
+	return p.String(), nil
+}
+
+// normalize trims request and brings the ISBN to its 13 digit form, then
+// checks it.
+func (r *BookRequest) normalize() error {
+	r.Title = strings.TrimSpace(r.Title)
+	r.Author = strings.TrimSpace(r.Author)
+	r.Publisher = strings.TrimSpace(r.Publisher)
+	r.Language = strings.TrimSpace(r.Language)
+	if r.Available == nil {
+		available := true
+		r.Available = &available
+	}
+
+	validation := ValidationError{}
+	checkLength := func(field, value string, required bool, max int) {
+		if required && value == "" {
+			validation.Add(field, "is required")
+		}
+		if utf8.RuneCountInString(value) > max {
+			validation.Add(field, fmt.Sprintf("must be at most %d characters", max))
+		}
+	}
+	checkLength("title", r.Title, true, 255)
+	r.normalizeContributors(&validation)
+	checkLength("author", r.Author, true, 255)
+	checkLength("publisher", r.Publisher, false, 255)
+	checkLength("language", r.Language, false, 35)
+
+	if r.Price < 0 || r.Price > maxPrice {
+		validation.Add("price", "must be between 0 and "+maxPrice.String())
+	}
+	if r.PageCount != nil && *r.PageCount <= 0 {
+		validation.Add("pageCount", "must be positive")
+	}
+
+	categoryIDs := []int{}
+	for _, id := range r.CategoryIDs {
+		if !slices.Contains(categoryIDs, id) {
+			categoryIDs = append(categoryIDs, id)
+		}
+	}
+	r.CategoryIDs = categoryIDs
+	if len(r.CategoryIDs) > maxBookCategories {
+		validation.Add("categoryIds", fmt.Sprintf("must be at most %d", maxBookCategories))
+	}
+	r.Tags = normalizeTags(r.Tags, &validation)
+
+	if r.ISBN != "" {
+		isbn, err := normalizeISBN(r.ISBN)
+		if err != nil {
+			validation.Add("isbn", err.Error())
+		}
+		r.ISBN = isbn
+	}
+
+	return validation.Err()
+}
+
+// normalizeContributors trims the contributors and derives them from the
+// byline or the byline from them, whichever is missing.
+func (r *BookRequest) normalizeContributors(validation *ValidationError) {
+	if len(r.Contributors) == 0 && r.Author != "" {
+		r.Contributors = []Contributor{{Name: r.Author, Role: ContributorAuthor}}
+	}
+
+	var authors, names []string
+	seen := map[Contributor]bool{}
+	for i := range r.Contributors {
+		contributor := &r.Contributors[i]
+		contributor.AuthorID = 0
+		contributor.Name = strings.TrimSpace(contributor.Name)
+		if contributor.Role == "" {
+			contributor.Role = ContributorAuthor
+		}
+
+		if contributor.Name == "" {
+			validation.Add("contributors", "name is required")
+			continue
+		}
+		if utf8.RuneCountInString(contributor.Name) > 255 {
+			validation.Add("contributors", "name must be at most 255 characters")
+		}
+		if !contributor.Role.Valid() {
+			validation.Add("contributors", "role must be author, editor or translator")
+		}
+		if seen[*contributor] {
+			validation.Add("contributors", fmt.Sprintf("lists %s as %s twice", contributor.Name, contributor.Role))
+		}
+		seen[*contributor] = true
+
+		names = append(names, contributor.Name)
+		if contributor.Role == ContributorAuthor {
+			authors = append(authors, contributor.Name)
+		}
+	}
+
+	if r.Author == "" {
+		if len(authors) == 0 {
+			authors = names
+		}
+		r.Author = strings.Join(authors, ", ")
+	}
+}
+
+// normalizeISBN returns isbn as 13 digits without hyphens or spaces. An
+// ISBN-10 is converted to its ISBN-13 form.
+func normalizeISBN(isbn string) (string, error) {
+	isbn = strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(isbn))
+
+	switch len(isbn) {
+	case 10:
+		sum := 0
+		for i, r := range isbn {
+			digit := int(r - '0')
+			if r == 'X' && i == 9 {
+				digit = 10
+			} else if r < '0' || r > '9' {
+				return "", errors.New("must only contain digits")
+			}
+			sum += (10 - i) * digit
+		}
+		if sum%11 != 0 {
+			return "", errors.New("has a wrong check digit")
+		}
+
+		isbn = "978" + isbn[:9]
+		return isbn + isbn13CheckDigit(isbn), nil
+	case 13:
+		for _, r := range isbn {
+			if r < '0' || r > '9' {
+				return "", errors.New("must only contain digits")
+			}
+		}
+		if isbn13CheckDigit(isbn[:12]) != isbn[12:] {
+			return "", errors.New("has a wrong check digit")
+		}
+
+		return isbn, nil
+	}
+
+	return "", errors.New("must have 10 or 13 digits")
+}
+
+func isbn13CheckDigit(first12 string) string {
+	sum := 0
+	for i, r := range first12 {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += weight * int(r-'0')
+	}
+
+	return fmt.Sprint((10 - sum%10) % 10)
+}
+
+const (
+	defaultBookPageSize = 20
+	maxBookPageSize     = 100
+)
+
+// bookSorts maps the sort keys of BookQuery to their column.
+var bookSorts = map[string]string{
+	"title":      "title",
+	"author":     "author",
+	"price":      "price",
+	"created_at": "created_at",
+}
+
+// BookQuery selects a page of the catalog. Sort is one of title, author,
+// price or created_at, prefixed with - for descending order. Cursor is the
+// NextCursor of the previous page and must be used with the same sort.
+// Category is a slug or id and also matches the books of its descendants.
+type BookQuery struct {
+	Limit     int
+	Cursor    string
+	Sort      string
+	Author    string
+	AuthorID  int
+	Category  string
+	Tag       string
+	MinPrice  *Price
+	MaxPrice  *Price
+	Available *bool
+}
+
+// BookPage is a page of books. NextCursor is empty on the last page.
+type BookPage struct {
+	Books      []Book
+	NextCursor string
+}
+
+// bookCursor is the position after the last book of a page: the value of
+// the sort column and the id, which breaks ties.
+type bookCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"i"`
+}
+
+func (c bookCursor) encode() string {
+	encoded, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeBookCursor(cursor string) (c bookCursor, err error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return bookCursor{}, err
+	}
+	err = json.Unmarshal(decoded, &c)
+
+	return c, err
+}
+
+// sortValue formats the sort column of book the way Postgres parses it back.
+func sortValue(book Book, column string) string {
+	switch column {
+	case "author":
+		return book.Author
+	case "price":
+		return book.Price.String()
+	case "created_at":
+		return book.CreatedAt.Format("2006-01-02T15:04:05.999999")
+	}
+
+	return book.Title
+}
+
+// validSortValue reports whether value, taken from a cursor the client may
+// have tampered with, parses back as the sort column.
+func validSortValue(column, value string) bool {
+	switch column {
+	case "price":
+		_, err := ParsePrice(value)
+		return err == nil
+	case "created_at":
+		_, err := time.Parse("2006-01-02T15:04:05.999999", value)
+		return err == nil
+	}
+
+	return utf8.ValidString(value) && !strings.ContainsRune(value, 0)
+}
+
+func (a *App) GetBooks(query BookQuery) (BookPage, error) {
+	validation := ValidationError{}
+
+	if query.Limit == 0 {
+		query.Limit = defaultBookPageSize
+	}
+	if query.Limit < 1 || query.Limit > maxBookPageSize {
+		validation.Add("limit", fmt.Sprintf("must be between 1 and %d", maxBookPageSize))
+	}
+
+	if query.Sort == "" {
+		query.Sort = "title"
+	}
+	column, descending := strings.TrimPrefix(query.Sort, "-"), strings.HasPrefix(query.Sort, "-")
+	if _, ok := bookSorts[column]; !ok {
+		validation.Add("sort", "must be one of title, author, price or created_at, optionally prefixed with -")
+	}
+
+	if query.MinPrice != nil && query.MaxPrice != nil && *query.MinPrice > *query.MaxPrice {
+		validation.Add("maxPrice", "must not be below minPrice")
+	}
+
+	var cursor *bookCursor
+	if query.Cursor != "" {
+		decoded, err := decodeBookCursor(query.Cursor)
+		if err != nil || decoded.Sort != query.Sort || !validSortValue(column, decoded.Value) {
+			validation.Add("cursor", "is invalid for this sort")
+		}
+		cursor = &decoded
+	}
+
+	if err := validation.Err(); err != nil {
+		return BookPage{}, err
+	}
+
+	filter := BookFilter{
+		Author:    query.Author,
+		AuthorID:  query.AuthorID,
+		Category:  query.Category,
+		Tag:       normalizeTag(query.Tag),
+		MinPrice:  query.MinPrice,
+		MaxPrice:  query.MaxPrice,
+		Available: query.Available,
+	}
+	order := BookOrder{Column: bookSorts[column], Descending: descending}
+	if cursor != nil {
+		order.AfterValue = cursor.Value
+		order.AfterID = cursor.ID
+	}
+
+	// One extra book tells whether there is a next page.
+	books, err := getBooks(a.db, filter, order, query.Limit+1)
+	if err != nil {
+		return BookPage{}, fmt.Errorf("failed to get books: %w: %w", err, ErrInternal)
+	}
+
+	page := BookPage{Books: books}
+	if len(books) > query.Limit {
+		page.Books = books[:query.Limit]
+		last := page.Books[query.Limit-1]
+		page.NextCursor = bookCursor{Sort: query.Sort, Value: sortValue(last, column), ID: last.ID}.encode()
+	}
+
+	if err := a.withRelations(page.Books); err != nil {
+		return BookPage{}, err
+	}
+
+	return page, nil
+}
+
+const (
+	maxSearchLength   = 200
+	maxSearchFacets   = 20
+	maxSearchPageSize = 100
+)
+
+// BookSearch is a full-text search of the catalog. Text uses web search
+// syntax: quoted phrases, or, and - to exclude a word.
+type BookSearch struct {
+	Text   string
+	Limit  int
+	Offset int
+	Filter BookFilter
+}
+
+// BookSearchResult is a matching book with its relevance and the matching
+// words of its HTML escaped title and description wrapped in <b> tags.
+type BookSearchResult struct {
+	Book                 Book
+	Rank                 float64
+	TitleHighlight       string
+	DescriptionHighlight string
+}
+
+// TS_HEADLINE marks matches with these private use characters rather than
+// tags, so that the text can be HTML escaped before the marks become tags.
+const (
+	highlightStart = "\uE000"
+	highlightStop  = "\uE001"
+)
+
+// escapeHighlight escapes a headline of TS_HEADLINE as HTML and wraps the
+// matching words in <b> tags.
+func escapeHighlight(headline string) string {
+	return strings.NewReplacer(highlightStart, "<b>", highlightStop, "</b>").Replace(html.EscapeString(headline))
+}
+
+// FacetCount counts the matches with Value, which works as a filter of the
+// same name.
+type FacetCount struct {
+	Value string
+	Count int
+}
+
+// BookSearchPage is a page of search results, with facets counted over all
+// matches.
+type BookSearchPage struct {
+	Results    []BookSearchResult
+	Total      int
+	Authors    []FacetCount
+	Categories []FacetCount
+}
+
+func (a *App) SearchBooks(search BookSearch) (BookSearchPage, error) {
+	search.Text = strings.TrimSpace(search.Text)
+	search.Filter.Tag = normalizeTag(search.Filter.Tag)
+
+	validation := ValidationError{}
+	if search.Text == "" {
+		validation.Add("q", "is required")
+	}
+	if utf8.RuneCountInString(search.Text) > maxSearchLength {
+		validation.Add("q", fmt.Sprintf("must be at most %d characters", maxSearchLength))
+	}
+	if search.Limit == 0 {
+		search.Limit = defaultBookPageSize
+	}
+	if search.Limit < 1 || search.Limit > maxSearchPageSize {
+		validation.Add("limit", fmt.Sprintf("must be between 1 and %d", maxSearchPageSize))
+	}
+	if search.Offset < 0 {
+		validation.Add("offset", "must not be negative")
+	}
+	if err := validation.Err(); err != nil {
+		return BookSearchPage{}, err
+	}
+
+	results, total, err := searchBooks(a.db, search.Text, search.Filter, search.Limit, search.Offset)
+	if err != nil {
+		return BookSearchPage{}, fmt.Errorf("failed to search books: %w: %w", err, ErrInternal)
+	}
+
+	authors, err := getSearchAuthorFacets(a.db, search.Text, search.Filter, maxSearchFacets)
+	if err != nil {
+		return BookSearchPage{}, fmt.Errorf("failed to count authors: %w: %w", err, ErrInternal)
+	}
+
+	categories, err := getSearchCategoryFacets(a.db, search.Text, search.Filter, maxSearchFacets)
+	if err != nil {
+		return BookSearchPage{}, fmt.Errorf("failed to count categories: %w: %w", err, ErrInternal)
+	}
+
+	books := make([]Book, len(results))
+	for i, result := range results {
+		books[i] = result.Book
+	}
+	if err := a.withRelations(books); err != nil {
+		return BookSearchPage{}, err
+	}
+	for i := range results {
+		results[i].Book = books[i]
+	}
+
+	return BookSearchPage{Results: results, Total: total, Authors: authors, Categories: categories}, nil
+}
+
+// GetPurchasedBookIDs returns the ids of books that user has in orders
+// that were not cancelled.
+func (a *App) GetPurchasedBookIDs(user string, books []Book) ([]int, error) {
+	ids := make([]int, 0, len(books))
+	for _, book := range books {
+		ids = append(ids, book.ID)
+	}
+
+	purchased, err := getPurchasedBookIDs(a.db, user, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get purchased books: %w: %w", err, ErrInternal)
+	}
+
+	return purchased, nil
+}
+
+// withRelations fills in the contributors, categories and covers of books.
+func (a *App) withRelations(books []Book) error {
+	if err := a.withContributors(books); err != nil {
+		return err
+	}
+	for i := range books {
+		a.withCover(&books[i])
+	}
+
+	return a.withCategories(books)
+}
+
+func (a *App) GetBook(id int) (Book, error) {
+	book, err := getBookByID(a.db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Book{}, fmt.Errorf("book %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return Book{}, fmt.Errorf("failed to get book: %w: %w", err, ErrInternal)
+	}
+
+	books := []Book{book}
+	if err := a.withRelations(books); err != nil {
+		return Book{}, err
+	}
+
+	return books[0], nil
+}
+
+func (a *App) CreateBook(request BookRequest) (Book, error) {
+	if err := request.normalize(); err != nil {
+		return Book{}, err
+	}
+
+	book, err := insertBook(a.db, request)
+	if isUniqueViolation(err) {
+		return Book{}, fmt.Errorf("isbn %s already in the catalog: %w", request.ISBN, ErrConflict)
+	}
+	if isForeignKeyViolation(err) {
+		return Book{}, unknownCategoryError()
+	}
+	if err != nil {
+		return Book{}, fmt.Errorf("failed to insert book: %w: %w", err, ErrInternal)
+	}
+
+	return book, nil
+}
+
+// ReplaceBook overwrites every editable field of book id.
+func (a *App) ReplaceBook(id int, request BookRequest) (Book, error) {
+	if err := request.normalize(); err != nil {
+		return Book{}, err
+	}
+
+	book, err := updateBook(a.db, id, request)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Book{}, fmt.Errorf("book %d: %w", id, ErrNotFound)
+	}
+	if isUniqueViolation(err) {
+		return Book{}, fmt.Errorf("isbn %s already in the catalog: %w", request.ISBN, ErrConflict)
+	}
+	if isForeignKeyViolation(err) {
+		return Book{}, unknownCategoryError()
+	}
+	if err != nil {
+		return Book{}, fmt.Errorf("failed to update book: %w: %w", err, ErrInternal)
+	}
+	a.withCover(&book)
+
+	return book, nil
+}
+
+func (a *App) PatchBook(id int, patch BookPatch) (Book, error) {
+	book, err := a.GetBook(id)
+	if err != nil {
+		return Book{}, err
+	}
+
+	return a.ReplaceBook(id, patch.apply(book))
+}
+
+func unknownCategoryError() error {
+	validation := ValidationError{}
+	validation.Add("categoryIds", "contains an unknown category")
+	return validation.Err()
+}
+
+// DeleteBook removes book id from the catalog, with its cover. Orders keep
+// their items, they only refer to the book by id.
+func (a *App) DeleteBook(id int) error {
+	cover, err := deleteBook(a.db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("book %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete book: %w: %w", err, ErrInternal)
+	}
+	a.deleteCover(cover)
+
+	return nil
+}
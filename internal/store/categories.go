@@ -0,0 +1,280 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxBookCategories = 20
+	maxBookTags       = 20
+	maxTagLength      = 50
+)
+
+// Category is a shelf of the catalog. Children are only filled in by
+// GetCategoryTree.
+type Category struct {
+	ID        int
+	ParentID  *int
+	Name      string
+	Slug      string
+	Children  []Category `json:",omitempty"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// CategoryRequest creates or replaces a category. Slug is derived from Name
+// when left out. A category without ParentID is at the top of the tree.
+type CategoryRequest struct {
+	ParentID *int
+	Name     string
+	Slug     string
+}
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// slugify lowercases name and joins its words with hyphens. Characters other
+// than ASCII letters and digits separate words.
+func slugify(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return (r < 'a' || r > 'z') && (r < '0' || r > '9')
+	})
+
+	return strings.Join(words, "-")
+}
+
+func (r *CategoryRequest) normalize() error {
+	r.Name = strings.TrimSpace(r.Name)
+	r.Slug = strings.TrimSpace(r.Slug)
+	if r.Slug == "" {
+		r.Slug = slugify(r.Name)
+	}
+
+	validation := ValidationError{}
+	if r.Name == "" {
+		validation.Add("name", "is required")
+	}
+	if utf8.RuneCountInString(r.Name) > 100 {
+		validation.Add("name", "must be at most 100 characters")
+	}
+	if !slugPattern.MatchString(r.Slug) || len(r.Slug) > 100 {
+		validation.Add("slug", "must be at most 100 lowercase letters, digits and single hyphens")
+	}
+
+	return validation.Err()
+}
+
+// normalizeTag lowercases tag and collapses its whitespace, so that "Sci  Fi"
+// and "sci fi" are the same tag.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+// normalizeTags normalizes tags and drops duplicates, keeping the order they
+// came in.
+func normalizeTags(tags []string, validation *ValidationError) []string {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			validation.Add("tags", fmt.Sprintf("must be at most %d characters each", maxTagLength))
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxBookTags {
+		validation.Add("tags", fmt.Sprintf("must be at most %d", maxBookTags))
+	}
+
+	return normalized
+}
+
+// withCategories fills in the categories of books.
+func (a *App) withCategories(books []Book) error {
+	if len(books) == 0 {
+		return nil
+	}
+
+	ids := make([]int, 0, len(books))
+	for _, book := range books {
+		ids = append(ids, book.ID)
+	}
+
+	categories, err := getBookCategories(a.db, ids)
+	if err != nil {
+		return fmt.Errorf("failed to get categories: %w: %w", err, ErrInternal)
+	}
+
+	for i := range books {
+		books[i].Categories = categories[books[i].ID]
+	}
+
+	return nil
+}
+
+// GetCategoryTree returns the top categories with their descendants, each
+// level sorted by name.
+func (a *App) GetCategoryTree() ([]Category, error) {
+	categories, err := getCategories(a.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get categories: %w: %w", err, ErrInternal)
+	}
+
+	children := map[int][]Category{}
+	for _, category := range categories {
+		parent := 0
+		if category.ParentID != nil {
+			parent = *category.ParentID
+		}
+		children[parent] = append(children[parent], category)
+	}
+
+	var build func(parent int) []Category
+	build = func(parent int) []Category {
+		level := children[parent]
+		for i := range level {
+			level[i].Children = build(level[i].ID)
+		}
+		return level
+	}
+
+	return build(0), nil
+}
+
+func (a *App) CreateCategory(request CategoryRequest) (Category, error) {
+	if err := request.normalize(); err != nil {
+		return Category{}, err
+	}
+
+	category, err := insertCategory(a.db, request)
+	if err != nil {
+		return Category{}, categoryError(err, request)
+	}
+
+	return category, nil
+}
+
+// ReplaceCategory renames or moves category id. It cannot be moved below
+// itself or one of its descendants.
+func (a *App) ReplaceCategory(id int, request CategoryRequest) (Category, error) {
+	if err := request.normalize(); err != nil {
+		return Category{}, err
+	}
+
+	if request.ParentID != nil {
+		cycle, err := isCategoryDescendant(a.db, *request.ParentID, id)
+		if err != nil {
+			return Category{}, fmt.Errorf("failed to check category tree: %w: %w", err, ErrInternal)
+		}
+		if cycle {
+			validation := ValidationError{}
+			validation.Add("parentId", "must not be the category or one of its descendants")
+			return Category{}, validation.Err()
+		}
+	}
+
+	category, err := updateCategory(a.db, id, request)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Category{}, fmt.Errorf("category %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return Category{}, categoryError(err, request)
+	}
+
+	return category, nil
+}
+
+// DeleteCategory removes category id from the tree and from its books. A
+// category with subcategories has to be emptied first.
+func (a *App) DeleteCategory(id int) error {
+	err := deleteCategory(a.db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("category %d: %w", id, ErrNotFound)
+	}
+	if isForeignKeyViolation(err) {
+		return fmt.Errorf("category %d has subcategories: %w", id, ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete category: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
+
+func categoryError(err error, request CategoryRequest) error {
+	if isUniqueViolation(err) {
+		return fmt.Errorf("slug %s already in use: %w", request.Slug, ErrConflict)
+	}
+	if isForeignKeyViolation(err) {
+		validation := ValidationError{}
+		validation.Add("parentId", "is not a category")
+		return validation.Err()
+	}
+
+	return fmt.Errorf("failed to save category: %w: %w", err, ErrInternal)
+}
+
+// Tag is a label used on BookCount books.
+type Tag struct {
+	Name      string
+	BookCount int
+}
+
+func (a *App) GetTags() ([]Tag, error) {
+	tags, err := getTags(a.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags: %w: %w", err, ErrInternal)
+	}
+
+	return tags, nil
+}
+
+// RenameTag replaces tag with name on every book, merging the two on books
+// that have both.
+func (a *App) RenameTag(tag, name string) error {
+	name = normalizeTag(name)
+
+	validation := ValidationError{}
+	if name == "" {
+		validation.Add("name", "is required")
+	}
+	if utf8.RuneCountInString(name) > maxTagLength {
+		validation.Add("name", fmt.Sprintf("must be at most %d characters", maxTagLength))
+	}
+	if err := validation.Err(); err != nil {
+		return err
+	}
+
+	err := renameTag(a.db, normalizeTag(tag), name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("tag %s: %w", tag, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rename tag: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
+
+// DeleteTag removes tag from every book.
+func (a *App) DeleteTag(tag string) error {
+	err := deleteTag(a.db, normalizeTag(tag))
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("tag %s: %w", tag, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete tag: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
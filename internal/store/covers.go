@@ -0,0 +1,235 @@
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+	"log"
+	"strconv"
+	"time"
+)
+
+// coverSize is a thumbnail size. Covers are scaled to fit within Width by
+// Height and never enlarged.
+type coverSize struct {
+	Name   string
+	Width  int
+	Height int
+}
+
+// coverSizes are ordered from the largest down, each resized from the one
+// before it.
+var coverSizes = []coverSize{
+	{Name: "large", Width: 600, Height: 900},
+	{Name: "medium", Width: 300, Height: 450},
+	{Name: "small", Width: 120, Height: 180},
+}
+
+const (
+	minCoverSide = 100
+	// maxCoverPixels keeps a small file with huge dimensions from taking
+	// gigabytes once decoded.
+	maxCoverPixels = 25000000
+	coverQuality   = 85
+)
+
+// BookCover holds the URLs of the JPEG thumbnails of a cover. Books without
+// a cover have a nil Cover.
+type BookCover struct {
+	Small  string
+	Medium string
+	Large  string
+}
+
+func coverKey(prefix string, size coverSize) string {
+	return prefix + "/" + size.Name + ".jpg"
+}
+
+// withCover fills in the cover URLs of book.
+func (a *App) withCover(book *Book) {
+	if book.cover == "" {
+		return
+	}
+
+	urls := map[string]string{}
+	for _, size := range coverSizes {
+		urls[size.Name] = a.blobs.URL(coverKey(book.cover, size))
+	}
+	book.Cover = &BookCover{Small: urls["small"], Medium: urls["medium"], Large: urls["large"]}
+}
+
+// decodeCover checks that data is a JPEG or PNG image of a sensible size
+// before decoding it.
+func decodeCover(data []byte) (image.Image, error) {
+	validation := ValidationError{}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "jpeg" && format != "png") {
+		validation.Add("cover", "must be a JPEG or PNG image")
+		return nil, validation.Err()
+	}
+	if config.Width < minCoverSide || config.Height < minCoverSide {
+		validation.Add("cover", fmt.Sprintf("must be at least %d pixels wide and high", minCoverSide))
+	}
+	if config.Width*config.Height > maxCoverPixels {
+		validation.Add("cover", fmt.Sprintf("must be at most %d pixels", maxCoverPixels))
+	}
+	if err := validation.Err(); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		validation.Add("cover", "is not a valid image")
+		return nil, validation.Err()
+	}
+
+	return img, nil
+}
+
+// encodeCovers resizes img to every cover size and encodes the thumbnails
+// as JPEG, by size name. Transparent parts become white.
+func encodeCovers(img image.Image) (map[string][]byte, error) {
+	bounds := img.Bounds()
+	current := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(current, current.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(current, current.Bounds(), img, bounds.Min, draw.Over)
+
+	encoded := map[string][]byte{}
+	for _, size := range coverSizes {
+		width, height := fitWithin(current.Bounds().Dx(), current.Bounds().Dy(), size.Width, size.Height)
+		current = shrink(current, width, height)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, current, &jpeg.Options{Quality: coverQuality}); err != nil {
+			return nil, err
+		}
+		encoded[size.Name] = buf.Bytes()
+	}
+
+	return encoded, nil
+}
+
+// fitWithin scales width by height down to fit within maxWidth by
+// maxHeight, keeping the aspect ratio.
+func fitWithin(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= maxWidth && height <= maxHeight {
+		return width, height
+	}
+	if width*maxHeight > height*maxWidth {
+		return maxWidth, max(1, height*maxWidth/width)
+	}
+
+	return max(1, width*maxHeight/height), maxHeight
+}
+
+// shrink scales src down to width by height, averaging the source pixels
+// that fall within each pixel of the result. src must start at the origin.
+func shrink(src *image.RGBA, width, height int) *image.RGBA {
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+	if srcWidth == width && srcHeight == height {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := max((y+1)*srcHeight/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := max((x+1)*srcWidth/width, x0+1)
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i, value := range row {
+					sum[i%4] += int(value)
+				}
+			}
+
+			count := (y1 - y0) * (x1 - x0)
+			offset := dst.PixOffset(x, y)
+			for i := range sum {
+				dst.Pix[offset+i] = uint8(sum[i] / count)
+			}
+		}
+	}
+
+	return dst
+}
+
+// SetBookCover validates the image data, stores its thumbnails and makes
+// them the cover of book id. The thumbnails of the previous cover are
+// removed.
+func (a *App) SetBookCover(id int, data []byte) (Book, error) {
+	if _, err := a.GetBook(id); err != nil {
+		return Book{}, err
+	}
+
+	img, err := decodeCover(data)
+	if err != nil {
+		return Book{}, err
+	}
+
+	thumbnails, err := encodeCovers(img)
+	if err != nil {
+		return Book{}, fmt.Errorf("failed to resize cover: %w: %w", err, ErrInternal)
+	}
+
+	// Every upload gets its own keys, so the URLs of a cover never change
+	// and can be cached for good.
+	prefix := fmt.Sprintf("covers/%d/%s", id, strconv.FormatInt(time.Now().UnixNano(), 36))
+	for _, size := range coverSizes {
+		if err := a.blobs.Put(coverKey(prefix, size), "image/jpeg", thumbnails[size.Name]); err != nil {
+			a.deleteCover(prefix)
+			return Book{}, fmt.Errorf("failed to store cover: %w: %w", err, ErrInternal)
+		}
+	}
+
+	previous, err := updateBookCover(a.db, id, prefix)
+	if err != nil {
+		a.deleteCover(prefix)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return Book{}, fmt.Errorf("book %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return Book{}, fmt.Errorf("failed to update book: %w: %w", err, ErrInternal)
+	}
+	a.deleteCover(previous)
+
+	return a.GetBook(id)
+}
+
+// DeleteBookCover removes the cover of book id.
+func (a *App) DeleteBookCover(id int) error {
+	previous, err := updateBookCover(a.db, id, "")
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("cover of book %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update book: %w: %w", err, ErrInternal)
+	}
+	a.deleteCover(previous)
+
+	return nil
+}
+
+// deleteCover removes the thumbnails under prefix. Failures are only logged,
+// as no book refers to them anymore.
+func (a *App) deleteCover(prefix string) {
+	if prefix == "" {
+		return
+	}
+
+	for _, size := range coverSizes {
+		if err := a.blobs.Delete(coverKey(prefix, size)); err != nil {
+			log.Printf("failed to delete cover %s: %v", coverKey(prefix, size), err)
+		}
+	}
+}
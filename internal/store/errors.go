@@ -1,11 +1,59 @@
 package store
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 var (
-	ErrConflict     = fmt.Errorf("conflict")
-	ErrNotFound     = fmt.Errorf("not found")
-	ErrInvalid      = fmt.Errorf("invalid")
-	ErrUnauthorized = fmt.Errorf("unauthorized")
-	ErrInternal     = fmt.Errorf("internal error")
+	ErrConflict        = fmt.Errorf("conflict")
+	ErrNotFound        = fmt.Errorf("not found")
+	ErrInvalid         = fmt.Errorf("invalid")
+	ErrUnauthorized    = fmt.Errorf("unauthorized")
+	ErrForbidden       = fmt.Errorf("forbidden")
+	ErrTooManyRequests = fmt.Errorf("too many requests")
+	ErrInternal        = fmt.Errorf("internal error")
 )
+
+// ValidationError lists the problems of each invalid request field. It wraps
+// ErrInvalid so callers that only need the category can use errors.Is.
+type ValidationError struct {
+	Fields map[string][]string
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for field := range e.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		parts = append(parts, field+" "+strings.Join(e.Fields[field], ", "))
+	}
+
+	return strings.Join(parts, "; ") + ": " + ErrInvalid.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalid
+}
+
+// Add records a problem with field.
+func (e *ValidationError) Add(field, problem string) {
+	if e.Fields == nil {
+		e.Fields = map[string][]string{}
+	}
+	e.Fields[field] = append(e.Fields[field], problem)
+}
+
+// Err returns e when any problem was recorded and nil otherwise.
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+
+	return e
+}
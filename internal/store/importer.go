@@ -0,0 +1,393 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ImportFormat string
+
+const (
+	ImportFormatCSV  = ImportFormat("csv")
+	ImportFormatONIX = ImportFormat("onix")
+)
+
+const (
+	defaultImportBatchSize = 500
+	// maxImportErrors caps the errors kept in a report. Failed still counts
+	// every bad row.
+	maxImportErrors = 1000
+)
+
+// ImportRowError is a row that was left out of an import. Row is the line of
+// a CSV file or the position of the product in an ONIX file.
+type ImportRowError struct {
+	Row    int
+	ISBN   string
+	Error  string
+	Fields map[string][]string `json:",omitempty"`
+}
+
+type ImportReport struct {
+	Rows      int
+	Created   int
+	Updated   int
+	Unchanged int
+	Failed    int
+	Errors    []ImportRowError
+}
+
+func (r *ImportReport) fail(row importRow, err error) {
+	r.Failed++
+	if len(r.Errors) == maxImportErrors {
+		return
+	}
+
+	rowError := ImportRowError{Row: row.Row, ISBN: row.ISBN, Error: err.Error()}
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		rowError.Fields = validation.Fields
+	}
+	r.Errors = append(r.Errors, rowError)
+}
+
+// importRow is a book read from an import file, with where it came from.
+type importRow struct {
+	Row  int
+	ISBN string
+	Book BookRequest
+}
+
+// importOutcome is what an upsert did to the catalog.
+type importOutcome int
+
+const (
+	importCreated importOutcome = iota
+	importUpdated
+	importUnchanged
+)
+
+// importFields is the set of optional fields an import file provides, named
+// like CSV columns. A nil set provides them all.
+type importFields map[string]bool
+
+func (f importFields) has(field string) bool {
+	return f == nil || f[field]
+}
+
+// bookSource reads the books of an import file one at a time. next returns
+// io.EOF after the last book and an *importRowError for a row that cannot be
+// read; any other error ends the import. fields tells which optional fields
+// the file provides; updated books keep their values of the others.
+type bookSource interface {
+	next() (importRow, error)
+	fields() importFields
+}
+
+type importRowError struct {
+	row importRow
+	err error
+}
+
+func (e *importRowError) Error() string {
+	return e.err.Error()
+}
+
+func (e *importRowError) Unwrap() error {
+	return e.err
+}
+
+// BookImporter loads catalog files into the books table. Books are matched
+// by ISBN, so importing the same file twice changes nothing.
+type BookImporter struct {
+	db *sql.DB
+	// BatchSize is the number of books written per transaction.
+	BatchSize int
+}
+
+func NewBookImporter(db *sql.DB) *BookImporter {
+	return &BookImporter{db: db, BatchSize: defaultImportBatchSize}
+}
+
+// Import streams r and upserts its books in batches. Invalid rows are
+// reported and skipped. An error means the file could not be read any
+// further; the books of the batches before it are kept and counted in the
+// report.
+func (i *BookImporter) Import(r io.Reader, format ImportFormat) (ImportReport, error) {
+	var source bookSource
+	var err error
+	switch format {
+	case ImportFormatCSV:
+		source, err = newCSVBookSource(r)
+	case ImportFormatONIX:
+		source = newONIXBookSource(r)
+	default:
+		validation := ValidationError{}
+		validation.Add("format", "must be csv or onix")
+		return ImportReport{}, validation.Err()
+	}
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	batchSize := i.BatchSize
+	if batchSize < 1 {
+		batchSize = defaultImportBatchSize
+	}
+
+	report := ImportReport{}
+	batch := make([]importRow, 0, batchSize)
+	for {
+		row, err := source.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		var rowError *importRowError
+		if errors.As(err, &rowError) {
+			report.Rows++
+			report.fail(rowError.row, rowError.err)
+			continue
+		}
+		if err != nil {
+			if err := i.write(batch, source.fields(), &report); err != nil {
+				return report, err
+			}
+			return report, fmt.Errorf("failed to read row %d: %w: %w", report.Rows+1, err, ErrInvalid)
+		}
+
+		report.Rows++
+		if err := row.Book.normalize(); err != nil {
+			report.fail(row, err)
+			continue
+		}
+		if row.Book.ISBN == "" {
+			validation := ValidationError{}
+			validation.Add("isbn", "is required")
+			report.fail(row, validation.Err())
+			continue
+		}
+		row.ISBN = row.Book.ISBN
+
+		batch = append(batch, row)
+		if len(batch) == batchSize {
+			if err := i.write(batch, source.fields(), &report); err != nil {
+				return report, err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	if err := i.write(batch, source.fields(), &report); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// write upserts batch in one transaction. When the database rejects a book,
+// the batch is retried one book at a time so that only that book fails.
+func (i *BookImporter) write(batch []importRow, fields importFields, report *ImportReport) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	outcomes, err := upsertBooks(i.db, batch, fields)
+	if err == nil {
+		report.count(outcomes)
+		return nil
+	}
+	if len(batch) == 1 {
+		report.fail(batch[0], fmt.Errorf("failed to save book: %w", err))
+		return nil
+	}
+
+	log.Printf("failed to import batch of %d books, retrying one by one: %v", len(batch), err)
+	for _, row := range batch {
+		if err := i.write([]importRow{row}, fields, report); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *ImportReport) count(outcomes []importOutcome) {
+	for _, outcome := range outcomes {
+		switch outcome {
+		case importCreated:
+			r.Created++
+		case importUpdated:
+			r.Updated++
+		case importUnchanged:
+			r.Unchanged++
+		}
+	}
+}
+
+func (a *App) ImportBooks(r io.Reader, format ImportFormat) (ImportReport, error) {
+	return NewBookImporter(a.db).Import(r, format)
+}
+
+// csvColumns maps the header names of a CSV import, lowercased and without
+// underscores, to a setter of the book. The author, editor and translator
+// cells list names separated by semicolons.
+var csvColumns = map[string]func(book *BookRequest, value string) error{
+	"title":       func(book *BookRequest, value string) error { book.Title = value; return nil },
+	"author":      csvContributors(ContributorAuthor),
+	"editor":      csvContributors(ContributorEditor),
+	"translator":  csvContributors(ContributorTranslator),
+	"isbn":        func(book *BookRequest, value string) error { book.ISBN = value; return nil },
+	"description": func(book *BookRequest, value string) error { book.Description = value; return nil },
+	"publisher":   func(book *BookRequest, value string) error { book.Publisher = value; return nil },
+	"language":    func(book *BookRequest, value string) error { book.Language = value; return nil },
+	"price": func(book *BookRequest, value string) (err error) {
+		book.Price, err = ParsePrice(value)
+		return err
+	},
+	"publishedat": func(book *BookRequest, value string) error {
+		date, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return errors.New("must be a date like 2006-01-02")
+		}
+		book.PublishedAt = &date
+		return nil
+	},
+	"pagecount": func(book *BookRequest, value string) error {
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		book.PageCount = &count
+		return nil
+	},
+	"available": func(book *BookRequest, value string) error {
+		available, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		book.Available = &available
+		return nil
+	},
+}
+
+func csvContributors(role ContributorRole) func(book *BookRequest, value string) error {
+	return func(book *BookRequest, value string) error {
+		for _, name := range strings.Split(value, ";") {
+			if name = strings.TrimSpace(name); name != "" {
+				book.Contributors = append(book.Contributors, Contributor{Name: name, Role: role})
+			}
+		}
+		return nil
+	}
+}
+
+// csvBookSource reads a CSV file whose first line names the columns, e.g.
+// isbn,title,author,price,published_at. Empty cells leave the field unset,
+// while columns left out of the header leave it as it is.
+type csvBookSource struct {
+	reader  *csv.Reader
+	header  []string
+	columns []string
+}
+
+func newCSVBookSource(r io.Reader) (*csvBookSource, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		validation := ValidationError{}
+		validation.Add("header", "is missing")
+		return nil, validation.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w: %w", err, ErrInvalid)
+	}
+
+	validation := ValidationError{}
+	columns := make([]string, len(header))
+	seen := map[string]bool{}
+	for i, name := range header {
+		column := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), "_", "")
+		if i == 0 {
+			column = strings.TrimPrefix(column, "\ufeff")
+		}
+		if _, ok := csvColumns[column]; !ok {
+			validation.Add("header", fmt.Sprintf("has unknown column %q", name))
+		}
+		if seen[column] {
+			validation.Add("header", fmt.Sprintf("has column %q more than once", name))
+		}
+		seen[column] = true
+		columns[i] = column
+	}
+	for _, required := range []string{"isbn", "title", "author", "price"} {
+		if !seen[required] {
+			validation.Add("header", "is missing column "+required)
+		}
+	}
+	if err := validation.Err(); err != nil {
+		return nil, err
+	}
+
+	return &csvBookSource{reader: reader, header: slices.Clone(header), columns: columns}, nil
+}
+
+func (s *csvBookSource) fields() importFields {
+	fields := importFields{}
+	for _, column := range s.columns {
+		fields[column] = true
+	}
+
+	return fields
+}
+
+func (s *csvBookSource) next() (importRow, error) {
+	record, err := s.reader.Read()
+	var parseError *csv.ParseError
+	if errors.As(err, &parseError) {
+		return importRow{}, &importRowError{row: importRow{Row: parseError.StartLine}, err: parseError.Err}
+	}
+	if err != nil {
+		return importRow{}, err
+	}
+
+	line, _ := s.reader.FieldPos(0)
+	row := importRow{Row: line}
+	validation := ValidationError{}
+	if len(record) != len(s.columns) {
+		validation.Add("row", fmt.Sprintf("has %d cells, the header has %d", len(record), len(s.columns)))
+	}
+	for i, value := range record {
+		if i >= len(s.columns) {
+			break
+		}
+
+		value = strings.TrimSpace(value)
+		if s.columns[i] == "isbn" {
+			row.ISBN = value
+		}
+		if value == "" {
+			continue
+		}
+		if err := csvColumns[s.columns[i]](&row.Book, value); err != nil {
+			validation.Add(s.header[i], err.Error())
+		}
+	}
+	if err := validation.Err(); err != nil {
+		return importRow{}, &importRowError{row: row, err: err}
+	}
+
+	return row, nil
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type signingKey struct {
+	id        string
+	private   ed25519.PrivateKey
+	expiresAt time.Time
+}
+
+func (k signingKey) public() ed25519.PublicKey {
+	return k.private.Public().(ed25519.PublicKey)
+}
+
+func (k signingKey) expired() bool {
+	return !k.expiresAt.IsZero() && time.Now().After(k.expiresAt)
+}
+
+// KeyRing holds the active key that signs new tokens and the retired keys
+// that still verify tokens signed before a rotation, until they expire.
+type KeyRing struct {
+	active signingKey
+	keys   map[string]signingKey
+}
+
+func NewKeyRing(secrets Secrets) KeyRing {
+	active := newSigningKey(secrets.GetAuthKey(), time.Time{})
+	ring := KeyRing{
+		active: active,
+		keys:   map[string]signingKey{active.id: active},
+	}
+
+	for seed, expiresAt := range secrets.GetRetiredAuthKeys() {
+		key := newSigningKey(seed, expiresAt)
+		if key.id != active.id {
+			ring.keys[key.id] = key
+		}
+	}
+
+	return ring
+}
+
+func newSigningKey(seedHex string, expiresAt time.Time) signingKey {
+	seed, err := hex.DecodeString(seedHex)
+	if err != nil {
+		panic(err)
+	}
+
+	private := ed25519.NewKeyFromSeed(seed)
+	key := signingKey{private: private, expiresAt: expiresAt}
+	key.id = thumbprint(key.public())
+
+	return key
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint of an Ed25519 public key.
+func thumbprint(public ed25519.PublicKey) string {
+	canonical := fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, base64.RawURLEncoding.EncodeToString(public))
+	sum := sha256.Sum256([]byte(canonical))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Sign signs claims with the active key and stamps its id in the kid header.
+func (k KeyRing) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = k.active.id
+
+	return token.SignedString(k.active.private)
+}
+
+// KeyFunc resolves the verification key of a token by its kid. Tokens
+// without a kid were issued before keys were rotated and only verify with
+// the active key.
+func (k KeyRing) KeyFunc(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != jwt.SigningMethodEdDSA.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return k.active.public(), nil
+	}
+
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", kid)
+	}
+	if key.expired() {
+		return nil, fmt.Errorf("key %s expired", kid)
+	}
+
+	return key.public(), nil
+}
+
+func (k KeyRing) sign(message []byte) []byte {
+	return ed25519.Sign(k.active.private, message)
+}
+
+// verify checks signature against every key that has not expired.
+func (k KeyRing) verify(message, signature []byte) error {
+	for _, key := range k.keys {
+		if key.expired() {
+			continue
+		}
+		if ed25519.Verify(key.public(), message, signature) {
+			return nil
+		}
+	}
+
+	return errors.New("bad signature")
+}
+
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys that currently verify tokens, active key first.
+func (k KeyRing) JWKS() JWKSet {
+	keys := make([]signingKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		if !key.expired() {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].id == k.active.id || keys[j].id == k.active.id {
+			return keys[i].id == k.active.id
+		}
+
+		return keys[i].id < keys[j].id
+	})
+
+	set := JWKSet{Keys: make([]JWK, 0, len(keys))}
+	for _, key := range keys {
+		set.Keys = append(set.Keys, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(key.public()),
+			KeyID:     key.id,
+			Use:       "sig",
+			Algorithm: jwt.SigningMethodEdDSA.Alg(),
+		})
+	}
+
+	return set
+}
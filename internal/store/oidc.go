@@ -0,0 +1,407 @@
+package store
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OIDCProviderConfig is an external identity provider users can log in with.
+// Each provider listed in BOOKSTORE_SERVER_OIDCPROVIDERS is read from
+// BOOKSTORE_OIDC_<NAME>_*.
+type OIDCProviderConfig struct {
+	Name         string   `ignored:"true"`
+	Issuer       string   `required:"true"`
+	ClientID     string   `required:"true"`
+	ClientSecret string   `required:"true"`
+	RedirectURL  string   `required:"true"`
+	Scopes       []string `default:"openid,email,profile"`
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider discovers the endpoints and keys of a provider on first use,
+// so the server starts even while a provider is unreachable.
+type oidcProvider struct {
+	cfg    OIDCProviderConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	metadata *oidcMetadata
+	jwks     *keyfunc.JWKS
+}
+
+func newOIDCProvider(cfg OIDCProviderConfig) *oidcProvider {
+	return &oidcProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *oidcProvider) discover() (*oidcMetadata, *keyfunc.JWKS, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, p.jwks, nil
+	}
+
+	rsp, err := p.client.Get(strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("discovery returned %s", rsp.Status)
+	}
+
+	var metadata oidcMetadata
+	if err := json.NewDecoder(rsp.Body).Decode(&metadata); err != nil {
+		return nil, nil, err
+	}
+	if strings.TrimSuffix(metadata.Issuer, "/") != strings.TrimSuffix(p.cfg.Issuer, "/") {
+		return nil, nil, fmt.Errorf("discovery returned issuer %s", metadata.Issuer)
+	}
+
+	jwks, err := keyfunc.Get(metadata.JWKSURI, keyfunc.Options{
+		Client:            p.client,
+		RefreshUnknownKID: true,
+		RefreshRateLimit:  5 * time.Minute,
+		RefreshTimeout:    10 * time.Second,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.metadata = &metadata
+	p.jwks = jwks
+
+	return p.metadata, p.jwks, nil
+}
+
+const (
+	oidcStateTTL = 10 * time.Minute
+
+	// The frontend redeems the code of a callback right after the redirect.
+	oidcLoginTTL     = time.Minute
+	purposeOIDCLogin = "oidc-login"
+)
+
+// OIDCState is a flow waiting for the provider to redirect back. LinkEmail
+// and LinkSession are the login and session linking an identity with
+// StartOIDCLink, empty for a plain login.
+type OIDCState struct {
+	State        string
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+	LinkEmail    string
+	LinkSession  string
+	ExpiresAt    time.Time
+}
+
+// OIDCFlow is a started flow. URL is the provider to send the user to.
+// Binding is kept by the browser that started the flow until ExpiresAt, and
+// has to come back with the callback, so a callback only completes in the
+// browser the flow was started from.
+type OIDCFlow struct {
+	URL       string
+	Binding   string
+	ExpiresAt time.Time
+}
+
+type ExternalIdentity struct {
+	Provider string
+	Subject  string
+	Email    string
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// StartOIDCLogin starts a flow with the provider. The state, nonce and PKCE
+// verifier are kept until the provider redirects back.
+func (a *App) StartOIDCLogin(providerName string) (OIDCFlow, error) {
+	return a.startOIDC(providerName, "", "")
+}
+
+// StartOIDCLink is StartOIDCLogin for the session of the logged in user,
+// linking the identity the user signs in with to their login whatever its
+// email. The flow only completes while the session is active.
+func (a *App) StartOIDCLink(providerName string, claims Claims) (OIDCFlow, error) {
+	return a.startOIDC(providerName, claims.Subject, claims.SessionID)
+}
+
+func (a *App) startOIDC(providerName, linkEmail, linkSession string) (OIDCFlow, error) {
+	provider, ok := a.oidcProviders[providerName]
+	if !ok {
+		return OIDCFlow{}, fmt.Errorf("identity provider %s: %w", providerName, ErrNotFound)
+	}
+
+	metadata, _, err := provider.discover()
+	if err != nil {
+		return OIDCFlow{}, fmt.Errorf("failed to discover %s: %w: %w", providerName, err, ErrInternal)
+	}
+
+	state := OIDCState{
+		State:        newRandomID(),
+		Provider:     providerName,
+		CodeVerifier: newRandomToken(),
+		Nonce:        newRandomID(),
+		LinkEmail:    linkEmail,
+		LinkSession:  linkSession,
+		ExpiresAt:    time.Now().Add(oidcStateTTL),
+	}
+	if err := insertOIDCState(a.db, state); err != nil {
+		return OIDCFlow{}, fmt.Errorf("failed to insert oidc state: %w: %w", err, ErrInternal)
+	}
+
+	challenge := sha256.Sum256([]byte(state.CodeVerifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.cfg.ClientID)
+	query.Set("redirect_uri", provider.cfg.RedirectURL)
+	query.Set("scope", strings.Join(provider.cfg.Scopes, " "))
+	query.Set("state", state.State)
+	query.Set("nonce", state.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	authorizationURL, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		return OIDCFlow{}, fmt.Errorf("invalid authorization endpoint: %w: %w", err, ErrInternal)
+	}
+	for key, values := range authorizationURL.Query() {
+		query[key] = values
+	}
+	authorizationURL.RawQuery = query.Encode()
+
+	return OIDCFlow{URL: authorizationURL.String(), Binding: hashToken(state.State), ExpiresAt: state.ExpiresAt}, nil
+}
+
+// CompleteOIDCLogin exchanges the authorization code, verifies the ID token
+// and finds the login linked to the external identity. The first login links
+// by the verified email of the provider, creating a login without a password
+// when there is none. Logins with a password are only linked explicitly, by
+// a flow started with StartOIDCLink. binding is the one of the OIDCFlow, as
+// kept by the browser.
+//
+// It returns the URL of the frontend to redirect the browser to, with a code
+// RedeemOIDCLogin exchanges for the login result. Tokens are never part of
+// the callback, which browsers keep in their history.
+func (a *App) CompleteOIDCLogin(providerName, code, stateValue, binding string) (string, error) {
+	provider, ok := a.oidcProviders[providerName]
+	if !ok {
+		return "", fmt.Errorf("identity provider %s: %w", providerName, ErrNotFound)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(stateValue)), []byte(binding)) != 1 {
+		return "", fmt.Errorf("state was not started by this browser: %w", ErrUnauthorized)
+	}
+
+	state, err := consumeOIDCState(a.db, stateValue)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && state.Provider != providerName) {
+		return "", fmt.Errorf("unknown or expired state: %w", ErrUnauthorized)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get oidc state: %w: %w", err, ErrInternal)
+	}
+
+	if state.LinkEmail != "" {
+		active, err := isSessionActive(a.db, state.LinkSession, state.LinkEmail)
+		if err != nil {
+			return "", fmt.Errorf("failed to get session: %w: %w", err, ErrInternal)
+		}
+		if !active {
+			return "", fmt.Errorf("session that started linking ended: %w", ErrUnauthorized)
+		}
+	}
+
+	metadata, jwks, err := provider.discover()
+	if err != nil {
+		return "", fmt.Errorf("failed to discover %s: %w: %w", providerName, err, ErrInternal)
+	}
+
+	rawIDToken, err := provider.exchange(metadata, code, state.CodeVerifier)
+	if err != nil {
+		return "", fmt.Errorf("code exchange failed: %w: %w", err, ErrUnauthorized)
+	}
+
+	claims := idTokenClaims{}
+	_, err = jwt.ParseWithClaims(
+		rawIDToken,
+		&claims,
+		jwks.Keyfunc,
+		jwt.WithIssuer(metadata.Issuer),
+		jwt.WithAudience(provider.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256", "EdDSA"}),
+	)
+	if err != nil {
+		return "", fmt.Errorf("invalid id token: %w: %w", err, ErrUnauthorized)
+	}
+	if claims.Nonce != state.Nonce {
+		return "", fmt.Errorf("id token nonce mismatch: %w", ErrUnauthorized)
+	}
+
+	email, err := a.linkedEmail(state, claims)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := newRandomID()
+	if err := setOIDCLoginNonce(a.db, email, nonce); err != nil {
+		return "", fmt.Errorf("failed to store oidc login: %w: %w", err, ErrInternal)
+	}
+
+	token := a.signToken(signedPayload{
+		Purpose:   purposeOIDCLogin,
+		Subject:   email,
+		Nonce:     nonce,
+		ExpiresAt: time.Now().Add(oidcLoginTTL).Unix(),
+	})
+
+	link, err := linkWithToken(a.oidcLoginURL, token)
+	if err != nil {
+		return "", fmt.Errorf("invalid oidc login url: %w: %w", err, ErrInternal)
+	}
+
+	return link, nil
+}
+
+// RedeemOIDCLogin logs in with the code of CompleteOIDCLogin, which works
+// once.
+func (a *App) RedeemOIDCLogin(token string, client Client) (LoginResult, error) {
+	payload, err := a.verifySignedToken(purposeOIDCLogin, token)
+	if err != nil {
+		return LoginResult{}, fmt.Errorf("invalid oidc login: %w: %w", err, ErrUnauthorized)
+	}
+
+	err = consumeOIDCLoginNonce(a.db, payload.Subject, payload.Nonce)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginResult{}, fmt.Errorf("oidc login was already redeemed: %w", ErrUnauthorized)
+	}
+	if err != nil {
+		return LoginResult{}, fmt.Errorf("failed to consume oidc login: %w: %w", err, ErrInternal)
+	}
+
+	login, err := getLoginByEmail(a.db, payload.Subject)
+	if err != nil {
+		return LoginResult{}, fmt.Errorf("failed to get login: %w: %w", err, ErrInternal)
+	}
+
+	if login.TOTPEnabledAt != nil {
+		return a.newMFAChallenge(login), nil
+	}
+
+	tokens, err := a.issueTokens(login, client)
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	return LoginResult{Tokens: tokens}, nil
+}
+
+// linkedEmail returns the email of the login the identity of claims is
+// linked to, linking it first when it is new.
+func (a *App) linkedEmail(state OIDCState, claims idTokenClaims) (string, error) {
+	identity := ExternalIdentity{Provider: state.Provider, Subject: claims.Subject}
+
+	email, err := getExternalIdentityEmail(a.db, identity.Provider, identity.Subject)
+	if err == nil {
+		if state.LinkEmail != "" && email != state.LinkEmail {
+			return "", fmt.Errorf("identity is linked to another account: %w", ErrConflict)
+		}
+
+		return email, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("failed to get identity: %w: %w", err, ErrInternal)
+	}
+
+	if state.LinkEmail != "" {
+		identity.Email = state.LinkEmail
+		if err := insertExternalIdentity(a.db, identity); err != nil {
+			return "", fmt.Errorf("failed to link identity: %w: %w", err, ErrInternal)
+		}
+
+		return identity.Email, nil
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return "", fmt.Errorf("identity provider did not confirm an email: %w", ErrForbidden)
+	}
+
+	identity.Email = claims.Email
+	linked, err := linkExternalIdentity(a.db, identity)
+	if err != nil {
+		return "", fmt.Errorf("failed to link identity: %w: %w", err, ErrInternal)
+	}
+	if !linked {
+		return "", fmt.Errorf("an account with email %s exists, log in to it to link the identity: %w", identity.Email, ErrConflict)
+	}
+
+	return identity.Email, nil
+}
+
+func (p *oidcProvider) exchange(metadata *oidcMetadata, code, codeVerifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequest(http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	rsp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s: %s %s", rsp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token endpoint returned no id_token")
+	}
+
+	return body.IDToken, nil
+}
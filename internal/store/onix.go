@@ -0,0 +1,276 @@
+package store
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// onixProduct is the part of an ONIX 3.0 <Product> the catalog keeps. Only
+// reference tag names are understood, not the short tags.
+type onixProduct struct {
+	NotificationType   string
+	ProductIdentifiers []struct {
+		ProductIDType string
+		IDValue       string
+	} `xml:"ProductIdentifier"`
+	DescriptiveDetail struct {
+		TitleDetails []struct {
+			TitleType     string
+			TitleElements []struct {
+				TitleElementLevel  string
+				TitleText          string
+				TitlePrefix        string
+				TitleWithoutPrefix string
+				Subtitle           string
+			} `xml:"TitleElement"`
+		} `xml:"TitleDetail"`
+		Contributors []struct {
+			ContributorRole    []string
+			PersonName         string
+			NamesBeforeKey     string
+			KeyNames           string
+			CorporateName      string
+			PersonNameInverted string
+		} `xml:"Contributor"`
+		Languages []struct {
+			LanguageRole string
+			LanguageCode string
+		} `xml:"Language"`
+		Extents []struct {
+			ExtentType  string
+			ExtentValue string
+			ExtentUnit  string
+		} `xml:"Extent"`
+	}
+	CollateralDetail struct {
+		TextContents []struct {
+			TextType string
+			Text     string
+		} `xml:"TextContent"`
+	}
+	PublishingDetail struct {
+		Publishers []struct {
+			PublishingRole string
+			PublisherName  string
+		} `xml:"Publisher"`
+		PublishingDates []struct {
+			PublishingDateRole string
+			Date               string
+		} `xml:"PublishingDate"`
+	}
+	ProductSupply struct {
+		SupplyDetails []struct {
+			ProductAvailability string
+			Prices              []struct {
+				PriceAmount string
+			} `xml:"Price"`
+		} `xml:"SupplyDetail"`
+	}
+}
+
+// onixContributorRoles maps ONIX contributor roles to those of the catalog:
+// A01 is "by (author)", B01 "edited by" and B06 "translated by".
+var onixContributorRoles = map[string]ContributorRole{
+	"A01": ContributorAuthor,
+	"B01": ContributorEditor,
+	"B06": ContributorTranslator,
+}
+
+// onixBookSource reads the <Product> elements of an ONIX 3.0 message one at
+// a time, so large messages are never held in memory.
+type onixBookSource struct {
+	decoder  *xml.Decoder
+	position int
+}
+
+func newONIXBookSource(r io.Reader) *onixBookSource {
+	return &onixBookSource{decoder: xml.NewDecoder(r)}
+}
+
+// fields is nil as a product is a full record, so whatever it leaves out is
+// cleared.
+func (s *onixBookSource) fields() importFields {
+	return nil
+}
+
+func (s *onixBookSource) next() (importRow, error) {
+	for {
+		token, err := s.decoder.Token()
+		if err != nil {
+			return importRow{}, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "Product" {
+			continue
+		}
+
+		s.position++
+		var product onixProduct
+		if err := s.decoder.DecodeElement(&product, &start); err != nil {
+			return importRow{}, err
+		}
+
+		row := importRow{Row: s.position}
+		book, err := product.book()
+		row.ISBN = book.ISBN
+		row.Book = book
+		if err != nil {
+			return importRow{}, &importRowError{row: row, err: err}
+		}
+
+		return row, nil
+	}
+}
+
+// book maps the product to a book. Code lists are those of ONIX 3.0: ISBN-13
+// is product id type 15, the distinctive title is title type 01 and so on.
+func (p onixProduct) book() (BookRequest, error) {
+	book := BookRequest{}
+	validation := ValidationError{}
+
+	for _, identifier := range p.ProductIdentifiers {
+		switch identifier.ProductIDType {
+		case "15", "03":
+			book.ISBN = strings.TrimSpace(identifier.IDValue)
+		case "02":
+			if book.ISBN == "" {
+				book.ISBN = strings.TrimSpace(identifier.IDValue)
+			}
+		}
+	}
+
+	detail := p.DescriptiveDetail
+	for _, title := range detail.TitleDetails {
+		if title.TitleType != "01" {
+			continue
+		}
+		for _, element := range title.TitleElements {
+			if element.TitleElementLevel != "01" {
+				continue
+			}
+			book.Title = element.TitleText
+			if book.Title == "" {
+				book.Title = strings.TrimSpace(element.TitlePrefix + " " + element.TitleWithoutPrefix)
+			}
+			if element.Subtitle != "" {
+				book.Title += ": " + element.Subtitle
+			}
+		}
+	}
+
+	for _, contributor := range detail.Contributors {
+		name := contributor.PersonName
+		if name == "" {
+			name = strings.TrimSpace(contributor.NamesBeforeKey + " " + contributor.KeyNames)
+		}
+		if name == "" {
+			name = contributor.CorporateName
+		}
+		if name == "" {
+			name = contributor.PersonNameInverted
+		}
+		if name == "" {
+			continue
+		}
+
+		for _, code := range contributor.ContributorRole {
+			if role, ok := onixContributorRoles[code]; ok {
+				book.Contributors = append(book.Contributors, Contributor{Name: strings.TrimSpace(name), Role: role})
+			}
+		}
+	}
+
+	for _, language := range detail.Languages {
+		if language.LanguageRole == "01" {
+			book.Language = language.LanguageCode
+			break
+		}
+	}
+
+	for _, extent := range detail.Extents {
+		// 00 is the main content page count, 03 counts pages.
+		if extent.ExtentType != "00" || extent.ExtentUnit != "03" {
+			continue
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(extent.ExtentValue))
+		if err != nil {
+			validation.Add("pageCount", "must be a number")
+			break
+		}
+		book.PageCount = &count
+		break
+	}
+
+	// 03 is the long description, 02 the short one.
+	for _, textType := range []string{"03", "02"} {
+		for _, text := range p.CollateralDetail.TextContents {
+			if text.TextType == textType && book.Description == "" {
+				book.Description = strings.TrimSpace(text.Text)
+			}
+		}
+	}
+
+	for _, publisher := range p.PublishingDetail.Publishers {
+		if publisher.PublishingRole == "01" {
+			book.Publisher = publisher.PublisherName
+			break
+		}
+	}
+
+	for _, date := range p.PublishingDetail.PublishingDates {
+		if date.PublishingDateRole != "01" {
+			continue
+		}
+		publishedAt, err := parseONIXDate(strings.TrimSpace(date.Date))
+		if err != nil {
+			validation.Add("publishedAt", err.Error())
+			break
+		}
+		book.PublishedAt = &publishedAt
+		break
+	}
+
+	for _, supply := range p.ProductSupply.SupplyDetails {
+		if len(supply.Prices) > 0 {
+			price, err := ParsePrice(strings.TrimSpace(supply.Prices[0].PriceAmount))
+			if err != nil {
+				validation.Add("price", err.Error())
+			}
+			book.Price = price
+		}
+		if supply.ProductAvailability != "" {
+			// Codes 20 to 23 mean the product can be ordered.
+			available := strings.HasPrefix(supply.ProductAvailability, "2")
+			book.Available = &available
+		}
+		break
+	}
+
+	// Notification 05 asks to delete the record; the book stays for the
+	// orders that refer to it but cannot be bought anymore.
+	if p.NotificationType == "05" {
+		available := false
+		book.Available = &available
+	}
+
+	return book, validation.Err()
+}
+
+// parseONIXDate reads the date formats of ONIX code list 55 that fit a
+// publication date: YYYYMMDD, YYYYMM and YYYY.
+func parseONIXDate(date string) (time.Time, error) {
+	for _, layout := range []string{"20060102", "200601", "2006"} {
+		if len(date) == len(layout) {
+			if parsed, err := time.Parse(layout, date); err == nil {
+				return parsed, nil
+			}
+		}
+	}
+
+	return time.Time{}, errors.New("must be a date like 20060102")
+}
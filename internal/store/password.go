@@ -0,0 +1,236 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+)
+
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+var commonPasswords = func() map[string]struct{} {
+	passwords := map[string]struct{}{}
+	for _, password := range strings.Fields(commonPasswordList) {
+		passwords[strings.ToLower(password)] = struct{}{}
+	}
+
+	return passwords
+}()
+
+// PasswordPolicy decides which passwords are strong enough to be stored.
+// MaxLength bounds the input of argon2 so a single request cannot make
+// hashing arbitrarily expensive.
+type PasswordPolicy struct {
+	MinLength       int
+	MaxLength       int
+	RequiredClasses int
+	RejectEmail     bool
+	RejectCommon    bool
+}
+
+func NewPasswordPolicy(cfg ServerConfig) PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:       cfg.PasswordMinLength,
+		MaxLength:       cfg.PasswordMaxLength,
+		RequiredClasses: cfg.PasswordRequiredClasses,
+		RejectEmail:     cfg.PasswordRejectEmail,
+		RejectCommon:    cfg.PasswordRejectCommon,
+	}
+}
+
+// Check returns every rule password breaks for the account identified by email.
+func (p PasswordPolicy) Check(password, email string) (problems []string) {
+	if password == "" {
+		return []string{"is required"}
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		problems = append(problems, fmt.Sprintf("must be at most %d characters", p.MaxLength))
+	}
+
+	if classes := characterClasses(password); classes < p.RequiredClasses {
+		problems = append(problems, fmt.Sprintf(
+			"must mix at least %d of lowercase letters, uppercase letters, digits and symbols",
+			p.RequiredClasses,
+		))
+	}
+
+	lower := strings.ToLower(password)
+	if p.RejectEmail && email != "" {
+		email = strings.ToLower(email)
+		localPart, _, _ := strings.Cut(email, "@")
+		if lower == email || lower == localPart {
+			problems = append(problems, "must not be your email address")
+		}
+	}
+
+	if p.RejectCommon {
+		if _, ok := commonPasswords[lower]; ok {
+			problems = append(problems, "is too common")
+		}
+	}
+
+	return problems
+}
+
+// Validate wraps the problems found by Check in a ValidationError on field.
+func (p PasswordPolicy) Validate(field, password, email string) error {
+	problems := p.Check(password, email)
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return &ValidationError{Fields: map[string][]string{field: problems}}
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+
+	return lower + upper + digit + symbol
+}
+
+// Argon2Params are the argon2id parameters a hash was computed with. Memory
+// is in KiB.
+type Argon2Params struct {
+	Time      uint32
+	Memory    uint32
+	Threads   uint8
+	KeyLength uint32
+}
+
+// legacyArgon2Params are the parameters of hashes stored as "hash.salt"
+// before hashes carried their own parameters.
+var legacyArgon2Params = Argon2Params{Time: 1, Memory: 64 * 1024, Threads: 1, KeyLength: 32}
+
+// PasswordHasher hashes passwords into PHC strings such as
+// $argon2id$v=19$m=65536,t=1,p=1$<salt>$<hash>, so the parameters can be
+// tuned without breaking existing hashes.
+type PasswordHasher struct {
+	params Argon2Params
+}
+
+func NewPasswordHasher(cfg ServerConfig) PasswordHasher {
+	return PasswordHasher{
+		params: Argon2Params{
+			Time:      cfg.Argon2Time,
+			Memory:    cfg.Argon2Memory,
+			Threads:   cfg.Argon2Threads,
+			KeyLength: 32,
+		},
+	}
+}
+
+func (h PasswordHasher) Hash(password string) string {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		panic(err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.params.Time, h.params.Memory, h.params.Threads, h.params.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.params.Memory,
+		h.params.Time,
+		h.params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+// Verify reports whether password matches hash, and whether hash should be
+// replaced because it was not made with the current parameters.
+func (h PasswordHasher) Verify(password, hash string) (ok, outdated bool) {
+	var params Argon2Params
+	var salt, key []byte
+	var err error
+
+	if strings.HasPrefix(hash, "$") {
+		params, salt, key, err = decodePHC(hash)
+	} else {
+		params, salt, key, err = decodeLegacyHash(hash)
+	}
+	if err != nil {
+		return false, false
+	}
+
+	comparison := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, comparison) != 1 {
+		return false, false
+	}
+
+	return true, !strings.HasPrefix(hash, "$") || params != h.params
+}
+
+func decodePHC(hash string) (params Argon2Params, salt, key []byte, err error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return Argon2Params{}, nil, nil, errors.New("unsupported hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, errors.New("unsupported argon2 version")
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return Argon2Params{}, nil, nil, errors.New("malformed argon2 parameters")
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, errors.New("malformed salt")
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2Params{}, nil, nil, errors.New("malformed hash")
+	}
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+func decodeLegacyHash(hash string) (params Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, ".")
+	if len(parts) != 2 {
+		return Argon2Params{}, nil, nil, errors.New("malformed hash")
+	}
+	key, err = base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Argon2Params{}, nil, nil, errors.New("malformed hash")
+	}
+	salt, err = base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Argon2Params{}, nil, nil, errors.New("malformed salt")
+	}
+
+	return legacyArgon2Params, salt, key, nil
+}
@@ -2,7 +2,13 @@ package store
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 func insertLogin(db *sql.DB, login Login) (err error) {
@@ -13,102 +19,2104 @@ func insertLogin(db *sql.DB, login Login) (err error) {
 
 func getLoginByEmail(db *sql.DB, email string) (login Login, err error) {
 	err = db.
-		QueryRow("SELECT email, hash FROM logins WHERE email = $1", email).
-		Scan(&login.Email, &login.Hash)
+		QueryRow(
+			`SELECT id, email, hash, role, verified_at, COALESCE(totp_secret, ''), totp_enabled_at
+            FROM logins WHERE email = $1`,
+			email,
+		).
+		Scan(
+			&login.ID,
+			&login.Email,
+			&login.Hash,
+			&login.Role,
+			&login.VerifiedAt,
+			&login.TOTPSecret,
+			&login.TOTPEnabledAt,
+		)
 
 	return login, err
 }
 
-func getBooks(db *sql.DB) (books []Book, err error) {
-	rows, err := db.Query("SELECT id, title, author FROM books")
+// updateLoginHash replaces the password hash of email only if it is still
+// oldHash, so a rehash cannot overwrite a password changed in the meantime.
+func updateLoginHash(db *sql.DB, email, oldHash, newHash string) (err error) {
+	_, err = db.Exec(
+		"UPDATE logins SET hash = $1, updated_at = NOW() WHERE email = $2 AND hash = $3",
+		newHash,
+		email,
+		oldHash,
+	)
+
+	return err
+}
+
+func markLoginVerified(db *sql.DB, email string) (err error) {
+	result, err := db.Exec(
+		"UPDATE logins SET verified_at = COALESCE(verified_at, NOW()), updated_at = NOW() WHERE email = $1",
+		email,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// BookFilter narrows getBooks down. Author matches case-insensitively
+// anywhere in the byline, AuthorID only books crediting that author.
+// Category is the slug or id of a category, whose descendants match too.
+type BookFilter struct {
+	Author    string
+	AuthorID  int
+	Category  string
+	Tag       string
+	MinPrice  *Price
+	MaxPrice  *Price
+	Available *bool
+}
+
+// BookOrder sorts getBooks by Column, then id. With AfterID set, only books
+// after (AfterValue, AfterID) in that order are returned.
+type BookOrder struct {
+	Column     string
+	Descending bool
+	AfterValue string
+	AfterID    int
+}
+
+// bookColumnTypes casts cursor values back to the type of their column.
+var bookColumnTypes = map[string]string{
+	"title":      "VARCHAR",
+	"author":     "VARCHAR",
+	"price":      "DECIMAL",
+	"created_at": "TIMESTAMP",
+}
+
+// queryArgs collects the arguments of a query built at runtime.
+type queryArgs []interface{}
+
+// add appends value and returns its placeholder.
+func (a *queryArgs) add(value interface{}) string {
+	*a = append(*a, value)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+func (f BookFilter) conditions(args *queryArgs) (conditions []string) {
+	if f.Author != "" {
+		conditions = append(conditions, "author ILIKE "+args.add("%"+escapeLike(f.Author)+"%"))
+	}
+	if f.AuthorID != 0 {
+		conditions = append(conditions, "id IN (SELECT book_id FROM book_authors WHERE author_id = "+args.add(f.AuthorID)+")")
+	}
+	if f.Category != "" {
+		category := args.add(f.Category)
+		conditions = append(conditions, `id IN (
+            SELECT book_id FROM book_categories WHERE category_id IN (
+                WITH RECURSIVE tree AS (
+                    SELECT id FROM categories WHERE slug = `+category+` OR id::TEXT = `+category+`
+                    UNION SELECT c.id FROM categories c JOIN tree ON c.parent_id = tree.id
+                )
+                SELECT id FROM tree
+            )
+        )`)
+	}
+	if f.Tag != "" {
+		conditions = append(conditions, "tags @> ARRAY["+args.add(f.Tag)+"]::TEXT[]")
+	}
+	if f.MinPrice != nil {
+		conditions = append(conditions, "price >= "+args.add(*f.MinPrice))
+	}
+	if f.MaxPrice != nil {
+		conditions = append(conditions, "price <= "+args.add(*f.MaxPrice))
+	}
+	if f.Available != nil {
+		conditions = append(conditions, "available = "+args.add(*f.Available))
+	}
+
+	return conditions
+}
+
+func getBooks(db *sql.DB, filter BookFilter, order BookOrder, limit int) (books []Book, err error) {
+	var args queryArgs
+	conditions := filter.conditions(&args)
+
+	direction, comparison := "ASC", ">"
+	if order.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if order.AfterID != 0 {
+		conditions = append(conditions, fmt.Sprintf(
+			"(%s, id) %s (%s::%s, %s)",
+			order.Column,
+			comparison,
+			args.add(order.AfterValue),
+			bookColumnTypes[order.Column],
+			args.add(order.AfterID),
+		))
+	}
+
+	query := "SELECT " + bookColumns + " FROM books"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT %s", order.Column, direction, direction, args.add(limit))
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var book Book
-		if err := rows.Scan(&book.ID, &book.Title, &book.Author); err != nil {
+		book, err := scanBook(rows)
+		if err != nil {
 			return nil, err
 		}
 		books = append(books, book)
 	}
-	return books, nil
+	return books, rows.Err()
 }
 
-func insertOrders(db *sql.DB, orderRequest OrderRequest) (order Order, err error) {
+// searchBooks returns the books matching the web search syntax text, best
+// match first, and the number of matches in total.
+func searchBooks(db *sql.DB, text string, filter BookFilter, limit, offset int) (results []BookSearchResult, total int, err error) {
+	args := queryArgs{text}
+	conditions := append([]string{"search @@ query"}, filter.conditions(&args)...)
+	selection := fmt.Sprintf(`StartSel="%s", StopSel="%s"`, highlightStart, highlightStop)
+
+	rows, err := db.Query(
+		`SELECT `+bookColumns+`, TS_RANK(search, query),
+            TS_HEADLINE('english', title, query, `+args.add("HighlightAll=true, "+selection)+`),
+            TS_HEADLINE('english', description, query, `+args.add("MaxFragments=2, MaxWords=30, MinWords=10, "+selection)+`),
+            COUNT(*) OVER ()
+        FROM books, WEBSEARCH_TO_TSQUERY('english', $1) query
+        WHERE `+strings.Join(conditions, " AND ")+`
+        ORDER BY TS_RANK(search, query) DESC, id
+        LIMIT `+args.add(limit)+` OFFSET `+args.add(offset),
+		args...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result BookSearchResult
+		result.Book, err = scanBook(rows, &result.Rank, &result.TitleHighlight, &result.DescriptionHighlight, &total)
+		if err != nil {
+			return nil, 0, err
+		}
+		result.TitleHighlight = escapeHighlight(result.TitleHighlight)
+		result.DescriptionHighlight = escapeHighlight(result.DescriptionHighlight)
+		results = append(results, result)
+	}
+
+	return results, total, rows.Err()
+}
+
+// getSearchAuthorFacets counts the books matching text per author, most
+// books first. A co-authored book counts for each of its authors.
+func getSearchAuthorFacets(db *sql.DB, text string, filter BookFilter, limit int) (facets []FacetCount, err error) {
+	args := queryArgs{text}
+	conditions := append([]string{"search @@ query"}, filter.conditions(&args)...)
+
+	rows, err := db.Query(
+		`SELECT a.name, COUNT(*)
+        FROM authors a
+        JOIN book_authors ba ON ba.author_id = a.id
+        WHERE ba.role = 'author' AND ba.book_id IN (
+            SELECT id FROM books, WEBSEARCH_TO_TSQUERY('english', $1) query
+            WHERE `+strings.Join(conditions, " AND ")+`
+        )
+        GROUP BY a.id, a.name
+        ORDER BY COUNT(*) DESC, a.name
+        LIMIT `+args.add(limit),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var facet FacetCount
+		if err := rows.Scan(&facet.Value, &facet.Count); err != nil {
+			return nil, err
+		}
+		facets = append(facets, facet)
+	}
+
+	return facets, rows.Err()
+}
+
+// getSearchCategoryFacets counts the books matching text per category, most
+// books first. Like the category filter, a category counts the books of its
+// descendants.
+func getSearchCategoryFacets(db *sql.DB, text string, filter BookFilter, limit int) (facets []FacetCount, err error) {
+	args := queryArgs{text}
+	conditions := append([]string{"search @@ query"}, filter.conditions(&args)...)
+
+	rows, err := db.Query(
+		`WITH RECURSIVE subtree AS (
+            SELECT id AS root, id FROM categories
+            UNION SELECT s.root, c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+        )
+        SELECT c.slug, COUNT(DISTINCT bc.book_id)
+        FROM categories c
+        JOIN subtree s ON s.root = c.id
+        JOIN book_categories bc ON bc.category_id = s.id
+        WHERE bc.book_id IN (
+            SELECT id FROM books, WEBSEARCH_TO_TSQUERY('english', $1) query
+            WHERE `+strings.Join(conditions, " AND ")+`
+        )
+        GROUP BY c.id, c.slug
+        ORDER BY COUNT(DISTINCT bc.book_id) DESC, c.slug
+        LIMIT `+args.add(limit),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var facet FacetCount
+		if err := rows.Scan(&facet.Value, &facet.Count); err != nil {
+			return nil, err
+		}
+		facets = append(facets, facet)
+	}
+
+	return facets, rows.Err()
+}
+
+func getPurchasedBookIDs(db *sql.DB, user string, bookIDs []int) (ids []int, err error) {
+	rows, err := db.Query(
+		`SELECT DISTINCT oi.book_id
+        FROM orders o
+        JOIN order_items oi ON o.id = oi.order_id
+        WHERE o.user = $1 AND o.status IS DISTINCT FROM $2 AND oi.book_id = ANY($3)
+        ORDER BY oi.book_id`,
+		user,
+		OrderStatusCancelled,
+		pq.Array(bookIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids = []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// bookColumns are the columns scanBook scans, in that order.
+const bookColumns = `id, title, author, price, COALESCE(isbn, ''), description, publisher, published_at,
+    language, page_count, available, tags, created_at, updated_at, COALESCE(cover, '')`
+
+// querier is implemented by *sql.DB and *sql.Tx, for queries that run both
+// on their own and as part of a transaction.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanBook scans bookColumns, followed by the extra columns selected after
+// them.
+func scanBook(row rowScanner, extra ...interface{}) (book Book, err error) {
+	dest := []interface{}{
+		&book.ID,
+		&book.Title,
+		&book.Author,
+		&book.Price,
+		&book.ISBN,
+		&book.Description,
+		&book.Publisher,
+		&book.PublishedAt,
+		&book.Language,
+		&book.PageCount,
+		&book.Available,
+		(*pq.StringArray)(&book.Tags),
+		&book.CreatedAt,
+		&book.UpdatedAt,
+		&book.cover,
+	}
+	err = row.Scan(append(dest, extra...)...)
+
+	return book, err
+}
+
+func getBookByID(db *sql.DB, id int) (book Book, err error) {
+	return scanBook(db.QueryRow("SELECT "+bookColumns+" FROM books WHERE id = $1", id))
+}
+
+func insertBook(db *sql.DB, request BookRequest) (book Book, err error) {
 	tx, err := db.Begin()
 	if err != nil {
-		return Order{}, err
+		return Book{}, err
 	}
 	defer tx.Rollback()
 
-	err = tx.
-		QueryRow(
-			`INSERT INTO orders ("user", date, status) VALUES ($1, $2, $3) RETURNING id, "user", date, status`,
-			orderRequest.User,
-			time.Now(),
-			"pending",
-		).
-		Scan(&order.ID, &order.User, &order.Date, &order.Status)
+	book, err = scanBook(tx.QueryRow(
+		`INSERT INTO books (
+            title, author, price, isbn, description, publisher, published_at, language, page_count, available,
+            tags
+        )
+        VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9, $10, $11)
+        RETURNING `+bookColumns,
+		request.Title,
+		request.Author,
+		request.Price,
+		request.ISBN,
+		request.Description,
+		request.Publisher,
+		request.PublishedAt,
+		request.Language,
+		request.PageCount,
+		*request.Available,
+		pq.Array(request.Tags),
+	))
 	if err != nil {
-		return Order{}, err
+		return Book{}, err
 	}
 
-	stmt, err := tx.Prepare(`INSERT INTO order_items ("user", order_id, book_id, quantity) VALUES ($1, $2, $3, $4)`)
+	book.Contributors, err = replaceBookContributors(tx, book.ID, request.Contributors)
 	if err != nil {
-		return Order{}, err
+		return Book{}, err
 	}
-	defer stmt.Close()
 
-	for _, item := range orderRequest.Items {
-		_, err := stmt.Exec(orderRequest.User, order.ID, item.BookID, item.Quantity)
+	book.Categories, err = replaceBookCategories(tx, book.ID, request.CategoryIDs)
+	if err != nil {
+		return Book{}, err
+	}
+
+	return book, tx.Commit()
+}
+
+func updateBook(db *sql.DB, id int, request BookRequest) (book Book, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Book{}, err
+	}
+	defer tx.Rollback()
+
+	book, err = scanBook(tx.QueryRow(
+		`UPDATE books SET title = $1, author = $2, price = $3, isbn = NULLIF($4, ''), description = $5,
+            publisher = $6, published_at = $7, language = $8, page_count = $9, available = $10,
+            tags = $11, updated_at = NOW()
+        WHERE id = $12
+        RETURNING `+bookColumns,
+		request.Title,
+		request.Author,
+		request.Price,
+		request.ISBN,
+		request.Description,
+		request.Publisher,
+		request.PublishedAt,
+		request.Language,
+		request.PageCount,
+		*request.Available,
+		pq.Array(request.Tags),
+		id,
+	))
+	if err != nil {
+		return Book{}, err
+	}
+
+	book.Contributors, err = replaceBookContributors(tx, book.ID, request.Contributors)
+	if err != nil {
+		return Book{}, err
+	}
+
+	book.Categories, err = replaceBookCategories(tx, book.ID, request.CategoryIDs)
+	if err != nil {
+		return Book{}, err
+	}
+
+	return book, tx.Commit()
+}
+
+// replaceBookContributors credits contributors on book bookID in their
+// order, creating the authors that do not exist yet. It returns
+// contributors with their author ids.
+func replaceBookContributors(q querier, bookID int, contributors []Contributor) ([]Contributor, error) {
+	_, err := q.Exec("DELETE FROM book_authors WHERE book_id = $1", bookID)
+	if err != nil {
+		return nil, err
+	}
+
+	saved := make([]Contributor, 0, len(contributors))
+	for position, contributor := range contributors {
+		// The no-op update makes RETURNING yield the id of an existing author.
+		err := q.QueryRow(
+			`INSERT INTO authors (name) VALUES ($1)
+            ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+            RETURNING id`,
+			contributor.Name,
+		).Scan(&contributor.AuthorID)
 		if err != nil {
-			return Order{}, err
+			return nil, err
+		}
+
+		_, err = q.Exec(
+			"INSERT INTO book_authors (book_id, author_id, role, position) VALUES ($1, $2, $3, $4)",
+			bookID,
+			contributor.AuthorID,
+			contributor.Role,
+			position,
+		)
+		if err != nil {
+			return nil, err
 		}
+
+		saved = append(saved, contributor)
 	}
-	err = tx.Commit()
 
-	return order, err
+	return saved, nil
 }
 
-func getOrdersByUser(db *sql.DB, user string) (orders []OrderDetail, err error) {
-	query := `
-    SELECT o.id, o.user, o.date, o.status, oi.id, oi.book_id, oi.quantity
-    FROM orders o
-    JOIN order_items oi ON o.id = oi.order_id
-    WHERE o.user = $1
-    ORDER BY o.date DESC
-    `
-	lastOrder := OrderDetail{}
-
-	rows, err := db.Query(query, user)
+// getBookContributors returns the contributors of each of bookIDs in their
+// order. Books without contributors are left out of the map.
+func getBookContributors(q querier, bookIDs []int) (contributors map[int][]Contributor, err error) {
+	rows, err := q.Query(
+		`SELECT ba.book_id, a.id, a.name, ba.role
+        FROM book_authors ba
+        JOIN authors a ON a.id = ba.author_id
+        WHERE ba.book_id = ANY($1)
+        ORDER BY ba.book_id, ba.position`,
+		pq.Array(bookIDs),
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	contributors = map[int][]Contributor{}
 	for rows.Next() {
-		var order OrderDetail
-		var item OrderItem
+		var bookID int
+		var contributor Contributor
+		if err := rows.Scan(&bookID, &contributor.AuthorID, &contributor.Name, &contributor.Role); err != nil {
+			return nil, err
+		}
+		contributors[bookID] = append(contributors[bookID], contributor)
+	}
 
-		if err := rows.Scan(
-			&order.ID,
-			&order.User,
-			&order.Date,
-			&order.Status,
-			&item.ID,
-			&item.BookID,
-			&item.Quantity,
-		); err != nil {
+	return contributors, rows.Err()
+}
+
+// replaceBookCategories files book bookID under categoryIDs and returns those
+// categories.
+func replaceBookCategories(q querier, bookID int, categoryIDs []int) ([]Category, error) {
+	_, err := q.Exec("DELETE FROM book_categories WHERE book_id = $1", bookID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = q.Exec(
+		"INSERT INTO book_categories (book_id, category_id) SELECT $1, UNNEST($2::INT[])",
+		bookID,
+		pq.Array(categoryIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	categories, err := getBookCategories(q, []int{bookID})
+	return categories[bookID], err
+}
+
+// getBookCategories returns the categories of each of bookIDs by name.
+// Books without categories are left out of the map.
+func getBookCategories(q querier, bookIDs []int) (categories map[int][]Category, err error) {
+	rows, err := q.Query(
+		`SELECT bc.book_id, `+categoryColumns+`
+        FROM book_categories bc
+        JOIN categories c ON c.id = bc.category_id
+        WHERE bc.book_id = ANY($1)
+        ORDER BY bc.book_id, c.name, c.id`,
+		pq.Array(bookIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories = map[int][]Category{}
+	for rows.Next() {
+		var bookID int
+		category, err := scanCategory(rows, &bookID)
+		if err != nil {
 			return nil, err
 		}
-		if lastOrder.ID != order.ID {
-			orders = append(orders, order)
-			lastOrder = order
+		categories[bookID] = append(categories[bookID], category)
+	}
+
+	return categories, rows.Err()
+}
+
+// categoryColumns are the columns scanCategory scans, in that order.
+const categoryColumns = "c.id, c.parent_id, c.name, c.slug, c.created_at, c.updated_at"
+
+// scanCategory scans the columns selected before categoryColumns, followed
+// by them.
+func scanCategory(row rowScanner, before ...interface{}) (category Category, err error) {
+	dest := append(before,
+		&category.ID,
+		&category.ParentID,
+		&category.Name,
+		&category.Slug,
+		&category.CreatedAt,
+		&category.UpdatedAt,
+	)
+	err = row.Scan(dest...)
+
+	return category, err
+}
+
+// getCategories returns every category by name.
+func getCategories(db *sql.DB) (categories []Category, err error) {
+	rows, err := db.Query("SELECT " + categoryColumns + " FROM categories c ORDER BY c.name, c.id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		category, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
 		}
+		categories = append(categories, category)
+	}
 
-		orders[len(orders)-1].Items = append(orders[len(orders)-1].Items, item)
+	return categories, rows.Err()
+}
+
+func insertCategory(db *sql.DB, request CategoryRequest) (category Category, err error) {
+	return scanCategory(db.QueryRow(
+		`INSERT INTO categories AS c (parent_id, name, slug) VALUES ($1, $2, $3)
+        RETURNING `+categoryColumns,
+		request.ParentID,
+		request.Name,
+		request.Slug,
+	))
+}
+
+// updateCategory saves category id and touches its books, which show its
+// name and slug.
+func updateCategory(db *sql.DB, id int, request CategoryRequest) (category Category, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Category{}, err
+	}
+	defer tx.Rollback()
+
+	category, err = scanCategory(tx.QueryRow(
+		`UPDATE categories AS c SET parent_id = $1, name = $2, slug = $3, updated_at = NOW()
+        WHERE c.id = $4
+        RETURNING `+categoryColumns,
+		request.ParentID,
+		request.Name,
+		request.Slug,
+		id,
+	))
+	if err != nil {
+		return Category{}, err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE books SET updated_at = NOW() WHERE id IN (SELECT book_id FROM book_categories WHERE category_id = $1)",
+		id,
+	)
+	if err != nil {
+		return Category{}, err
+	}
+
+	return category, tx.Commit()
+}
+
+// isCategoryDescendant tells whether category candidate is category id or
+// one of its descendants.
+func isCategoryDescendant(db *sql.DB, candidate, id int) (descendant bool, err error) {
+	err = db.
+		QueryRow(
+			`WITH RECURSIVE tree AS (
+                SELECT id FROM categories WHERE id = $2
+                UNION SELECT c.id FROM categories c JOIN tree ON c.parent_id = tree.id
+            )
+            SELECT EXISTS (SELECT 1 FROM tree WHERE id = $1)`,
+			candidate,
+			id,
+		).
+		Scan(&descendant)
+
+	return descendant, err
+}
+
+// deleteCategory removes category id and touches the books filed under it.
+// It fails with a foreign key violation while the category has children.
+func deleteCategory(db *sql.DB, id int) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE books SET updated_at = NOW() WHERE id IN (SELECT book_id FROM book_categories WHERE category_id = $1)",
+		id,
+	)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("DELETE FROM categories WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
+
+// getTags counts the books of every tag in use, by tag.
+func getTags(db *sql.DB) (tags []Tag, err error) {
+	rows, err := db.Query("SELECT tag, COUNT(*) FROM books, UNNEST(tags) tag GROUP BY tag ORDER BY tag")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags = []Tag{}
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.Name, &tag.BookCount); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// renameTag replaces tag with name on the books that have it, keeping the
+// first of the two where a book already has name. It returns sql.ErrNoRows
+// when no book has tag.
+func renameTag(db *sql.DB, tag, name string) (err error) {
+	result, err := db.Exec(
+		`UPDATE books SET updated_at = NOW(), tags = ARRAY(
+            SELECT t FROM UNNEST(ARRAY_REPLACE(tags, $1, $2)) WITH ORDINALITY u(t, n)
+            GROUP BY t
+            ORDER BY MIN(n)
+        )
+        WHERE tags @> ARRAY[$1]::TEXT[]`,
+		tag,
+		name,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// deleteTag removes tag from the books that have it. It returns
+// sql.ErrNoRows when no book has tag.
+func deleteTag(db *sql.DB, tag string) (err error) {
+	result, err := db.Exec(
+		"UPDATE books SET tags = ARRAY_REMOVE(tags, $1), updated_at = NOW() WHERE tags @> ARRAY[$1]::TEXT[]",
+		tag,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func getAuthors(db *sql.DB, name string, after *authorCursor, limit int) (authors []Author, err error) {
+	args := queryArgs{}
+	conditions := []string{"TRUE"}
+	if name != "" {
+		conditions = append(conditions, "a.name ILIKE "+args.add("%"+escapeLike(name)+"%"))
+	}
+	if after != nil {
+		conditions = append(conditions, "(a.name, a.id) > ("+args.add(after.Name)+", "+args.add(after.ID)+")")
+	}
+
+	rows, err := db.Query(
+		`SELECT a.id, a.name, COUNT(DISTINCT ba.book_id), a.created_at
+        FROM authors a
+        JOIN book_authors ba ON ba.author_id = a.id
+        WHERE `+strings.Join(conditions, " AND ")+`
+        GROUP BY a.id
+        ORDER BY a.name, a.id
+        LIMIT `+args.add(limit),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var author Author
+		if err := rows.Scan(&author.ID, &author.Name, &author.BookCount, &author.CreatedAt); err != nil {
+			return nil, err
+		}
+		authors = append(authors, author)
+	}
+
+	return authors, rows.Err()
+}
+
+func getAuthorByID(db *sql.DB, id int) (author Author, err error) {
+	err = db.
+		QueryRow(
+			`SELECT a.id, a.name, COUNT(DISTINCT ba.book_id), a.created_at
+            FROM authors a
+            LEFT JOIN book_authors ba ON ba.author_id = a.id
+            WHERE a.id = $1
+            GROUP BY a.id`,
+			id,
+		).
+		Scan(&author.ID, &author.Name, &author.BookCount, &author.CreatedAt)
+
+	return author, err
+}
+
+// importColumns are the optional columns of books an import may leave out,
+// by field name.
+var importColumns = []struct{ field, column string }{
+	{"description", "description"},
+	{"publisher", "publisher"},
+	{"publishedat", "published_at"},
+	{"language", "language"},
+	{"pagecount", "page_count"},
+	{"available", "available"},
+}
+
+// upsertBooks inserts or updates rows by ISBN in one transaction, with their
+// contributors. Updates only touch the optional columns and contributor
+// roles in fields. Books whose fields and contributors are all unchanged are
+// not written, so their updated_at and ETag stay.
+func upsertBooks(db *sql.DB, rows []importRow, fields importFields) (outcomes []importOutcome, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	columns := []string{"title", "author", "price"}
+	for _, optional := range importColumns {
+		if fields.has(optional.field) {
+			columns = append(columns, optional.column)
+		}
+	}
+	updates := make([]string, len(columns))
+	current := make([]string, len(columns))
+	excluded := make([]string, len(columns))
+	for i, column := range columns {
+		updates[i] = column + " = EXCLUDED." + column
+		current[i] = "books." + column
+		excluded[i] = "EXCLUDED." + column
+	}
+
+	stmt, err := tx.Prepare(
+		`INSERT INTO books (
+            title, author, price, isbn, description, publisher, published_at, language, page_count, available
+        )
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+        ON CONFLICT (isbn) DO UPDATE SET ` + strings.Join(updates, ", ") + `, updated_at = NOW()
+        WHERE (` + strings.Join(current, ", ") + `) IS DISTINCT FROM (` + strings.Join(excluded, ", ") + `)
+        RETURNING id, xmax = 0`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		book := row.Book
+
+		var id int
+		var inserted bool
+		outcome := importUpdated
+		err := stmt.QueryRow(
+			book.Title,
+			book.Author,
+			book.Price,
+			book.ISBN,
+			book.Description,
+			book.Publisher,
+			book.PublishedAt,
+			book.Language,
+			book.PageCount,
+			*book.Available,
+		).Scan(&id, &inserted)
+		if errors.Is(err, sql.ErrNoRows) {
+			outcome = importUnchanged
+			err = tx.QueryRow("SELECT id FROM books WHERE isbn = $1", book.ISBN).Scan(&id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if inserted {
+			outcome = importCreated
+		}
+
+		contributors := book.Contributors
+		if outcome != importCreated {
+			current, err := getBookContributors(tx, []int{id})
+			if err != nil {
+				return nil, err
+			}
+			for _, contributor := range current[id] {
+				if contributor.Role != ContributorAuthor && !fields.has(string(contributor.Role)) {
+					contributors = append(contributors, contributor)
+				}
+			}
+			if sameContributors(current[id], contributors) {
+				outcomes = append(outcomes, outcome)
+				continue
+			}
+		}
+
+		if _, err := replaceBookContributors(tx, id, contributors); err != nil {
+			return nil, err
+		}
+		if outcome == importUnchanged {
+			if _, err := tx.Exec("UPDATE books SET updated_at = NOW() WHERE id = $1", id); err != nil {
+				return nil, err
+			}
+			outcome = importUpdated
+		}
+		outcomes = append(outcomes, outcome)
+	}
+
+	return outcomes, tx.Commit()
+}
+
+// deleteBook removes book id and returns the key prefix of its cover.
+func deleteBook(db *sql.DB, id int) (cover string, err error) {
+	err = db.QueryRow("DELETE FROM books WHERE id = $1 RETURNING COALESCE(cover, '')", id).Scan(&cover)
+
+	return cover, err
+}
+
+// updateBookCover points book id at the cover thumbnails under prefix and
+// returns the prefix of its previous cover. An empty prefix removes the
+// cover, and fails with sql.ErrNoRows when there is none.
+func updateBookCover(db *sql.DB, id int, prefix string) (previous string, err error) {
+	err = db.
+		QueryRow(
+			`UPDATE books b SET cover = NULLIF($2, ''), updated_at = NOW()
+            FROM (SELECT id, cover FROM books WHERE id = $1 FOR UPDATE) old
+            WHERE b.id = old.id AND ($2 <> '' OR old.cover IS NOT NULL)
+            RETURNING COALESCE(old.cover, '')`,
+			id,
+			prefix,
+		).
+		Scan(&previous)
+
+	return previous, err
+}
+
+func insertOrders(db *sql.DB, orderRequest OrderRequest) (order Order, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Order{}, err
+	}
+	defer tx.Rollback()
+
+	err = tx.
+		QueryRow(
+			`INSERT INTO orders ("user", date, status) VALUES ($1, $2, $3) RETURNING id, "user", date, status`,
+			orderRequest.User,
+			time.Now(),
+			"pending",
+		).
+		Scan(&order.ID, &order.User, &order.Date, &order.Status)
+	if err != nil {
+		return Order{}, err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO order_items ("user", order_id, book_id, quantity) VALUES ($1, $2, $3, $4)`)
+	if err != nil {
+		return Order{}, err
+	}
+	defer stmt.Close()
+
+	for _, item := range orderRequest.Items {
+		_, err := stmt.Exec(orderRequest.User, order.ID, item.BookID, item.Quantity)
+		if err != nil {
+			return Order{}, err
+		}
+	}
+	err = tx.Commit()
+
+	return order, err
+}
+
+func getOrdersByUser(db *sql.DB, user string) (orders []OrderDetail, err error) {
+	query := `
+    SELECT o.id, o.user, o.date, o.status, oi.id, oi.book_id, oi.quantity
+    FROM orders o
+    JOIN order_items oi ON o.id = oi.order_id
+    WHERE o.user = $1
+    ORDER BY o.date DESC, o.id
+    `
+
+	rows, err := db.Query(query, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanOrderDetails(rows)
+}
+
+func getOrders(db *sql.DB, status OrderStatus) (orders []OrderDetail, err error) {
+	query := `
+    SELECT o.id, o.user, o.date, o.status, oi.id, oi.book_id, oi.quantity
+    FROM orders o
+    JOIN order_items oi ON o.id = oi.order_id
+    WHERE $1 = '' OR o.status = $1
+    ORDER BY o.date DESC, o.id
+    `
+
+	rows, err := db.Query(query, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanOrderDetails(rows)
+}
+
+// scanOrderDetails groups order rows joined with their items, which must be
+// ordered so that the items of one order are adjacent.
+func scanOrderDetails(rows *sql.Rows) (orders []OrderDetail, err error) {
+	lastOrder := OrderDetail{}
+
+	for rows.Next() {
+		var order OrderDetail
+		var item OrderItem
+
+		if err := rows.Scan(
+			&order.ID,
+			&order.User,
+			&order.Date,
+			&order.Status,
+			&item.ID,
+			&item.BookID,
+			&item.Quantity,
+		); err != nil {
+			return nil, err
+		}
+		if lastOrder.ID != order.ID {
+			orders = append(orders, order)
+			lastOrder = order
+		}
+
+		orders[len(orders)-1].Items = append(orders[len(orders)-1].Items, item)
+	}
+
+	return orders, rows.Err()
+}
+
+func updateOrderStatus(db *sql.DB, orderID int, status OrderStatus) (order Order, err error) {
+	err = db.
+		QueryRow(
+			`UPDATE orders SET status = $1 WHERE id = $2 RETURNING id, "user", date, status`,
+			status,
+			orderID,
+		).
+		Scan(&order.ID, &order.User, &order.Date, &order.Status)
+
+	return order, err
+}
+
+func updateLoginRole(db *sql.DB, email string, role Role) (err error) {
+	result, err := db.Exec("UPDATE logins SET role = $1, updated_at = NOW() WHERE email = $2", role, email)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func getRefreshToken(db *sql.DB, hash string) (token RefreshToken, err error) {
+	err = db.
+		QueryRow(
+			"SELECT family, email, token_hash, expires_at, revoked_at FROM refresh_tokens WHERE token_hash = $1",
+			hash,
+		).
+		Scan(&token.Family, &token.Email, &token.Hash, &token.ExpiresAt, &token.RevokedAt)
+
+	return token, err
+}
+
+// rotateRefreshToken revokes the token with the given hash and stores next in
+// its place. It returns sql.ErrNoRows when the token was already revoked, so
+// two concurrent refreshes cannot both succeed.
+func rotateRefreshToken(db *sql.DB, hash string, next RefreshToken) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE token_hash = $1 AND revoked_at IS NULL",
+		hash,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO refresh_tokens (family, email, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		next.Family,
+		next.Email,
+		next.Hash,
+		next.ExpiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// revokeRefreshTokenFamily revokes the refresh tokens of family and
+// terminates the session they belong to.
+func revokeRefreshTokenFamily(db *sql.DB, family string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE family = $1 AND revoked_at IS NULL",
+		family,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE sessions SET terminated_at = NOW() WHERE id = $1 AND terminated_at IS NULL", family)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// revokeAccessToken records jti until the token expires, and forgets the
+// tokens that expired meanwhile, which are rejected anyway.
+func revokeAccessToken(db *sql.DB, jti string, expiresAt time.Time) (err error) {
+	_, err = db.Exec("DELETE FROM revoked_tokens WHERE expires_at < NOW()")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING",
+		jti,
+		expiresAt,
+	)
+
+	return err
+}
+
+// isAccessTokenRevoked reports whether jti was revoked, its session
+// terminated or deleted along with its login, or whether the token was issued
+// before the credentials of email changed. The iat claim has whole seconds,
+// so tokens_valid_after is truncated to match and tokens issued along with a
+// change stay valid. Those issued earlier within the same second belong to
+// sessions the change terminated.
+func isAccessTokenRevoked(db *sql.DB, jti, sessionID, email string, issuedAt time.Time) (revoked bool, err error) {
+	err = db.
+		QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)
+            OR ($2 != '' AND NOT EXISTS (SELECT 1 FROM sessions WHERE id = $2 AND terminated_at IS NULL))
+            OR NOT EXISTS (
+                SELECT 1 FROM logins
+                WHERE email = $3 AND (tokens_valid_after IS NULL OR DATE_TRUNC('second', tokens_valid_after) <= $4)
+            )`,
+			jti,
+			sessionID,
+			email,
+			issuedAt,
+		).
+		Scan(&revoked)
+
+	return revoked, err
+}
+
+// insertPasswordReset stores reset and drops the resets that expired, which
+// can no longer be used.
+func insertPasswordReset(db *sql.DB, reset PasswordReset) (err error) {
+	_, err = db.Exec("DELETE FROM password_resets WHERE expires_at < NOW()")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO password_resets (token_hash, email, expires_at) VALUES ($1, $2, $3)",
+		reset.Hash,
+		reset.Email,
+		reset.ExpiresAt,
+	)
+
+	return err
+}
+
+func getPasswordReset(db *sql.DB, hash string) (reset PasswordReset, err error) {
+	err = db.
+		QueryRow(
+			"SELECT token_hash, email, expires_at FROM password_resets WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()",
+			hash,
+		).
+		Scan(&reset.Hash, &reset.Email, &reset.ExpiresAt)
+
+	return reset, err
+}
+
+// consumePasswordReset marks the reset token as used, stores the new password
+// hash and revokes every refresh token of the user in one transaction. It
+// returns sql.ErrNoRows when the token is unknown, used or expired.
+func consumePasswordReset(db *sql.DB, tokenHash, passwordHash string, changedAt time.Time) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var email string
+	err = tx.
+		QueryRow(
+			`UPDATE password_resets SET used_at = NOW()
+            WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+            RETURNING email`,
+			tokenHash,
+		).
+		Scan(&email)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE logins SET hash = $1, updated_at = NOW(), tokens_valid_after = $2 WHERE email = $3",
+		passwordHash,
+		changedAt,
+		email,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE email = $1 AND revoked_at IS NULL", email)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE sessions SET terminated_at = NOW() WHERE email = $1 AND terminated_at IS NULL", email)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// claimLoginThrottle counts an attempt for key as a failure and locks key
+// for the delay of the resulting number of failures, or returns the lock
+// without counting anything while key is locked. Failures older than window
+// are forgotten, and so are the rows of keys without recent failures or a
+// lock, like those of unknown emails. The row is locked throughout, so
+// parallel claims of a key queue up behind each other.
+func claimLoginThrottle(db *sql.DB, key ThrottleKey, window time.Duration, delay func(failures int) time.Duration) (lockedUntil time.Time, err error) {
+	now := time.Now()
+
+	_, err = db.Exec(
+		"DELETE FROM login_throttles WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $2)",
+		now.Add(-window),
+		now,
+	)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var failures int
+	var lastFailureAt time.Time
+	var until sql.NullTime
+	err = tx.
+		QueryRow(
+			`INSERT INTO login_throttles (scope, key) VALUES ($1, $2)
+            ON CONFLICT (scope, key) DO UPDATE SET scope = EXCLUDED.scope
+            RETURNING failures, last_failure_at, locked_until`,
+			key.Scope,
+			key.Key,
+		).
+		Scan(&failures, &lastFailureAt, &until)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if until.Valid && until.Time.After(now) {
+		return until.Time, tx.Commit()
+	}
+
+	if lastFailureAt.Before(now.Add(-window)) {
+		failures = 0
+	}
+	failures++
+
+	until = sql.NullTime{}
+	if d := delay(failures); d > 0 {
+		until = sql.NullTime{Time: now.Add(d), Valid: true}
+	}
+
+	_, err = tx.Exec(
+		"UPDATE login_throttles SET failures = $1, last_failure_at = $2, locked_until = $3 WHERE scope = $4 AND key = $5",
+		failures,
+		now,
+		until,
+		key.Scope,
+		key.Key,
+	)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Time{}, tx.Commit()
+}
+
+// releaseLoginThrottle takes back a failure counted by claimLoginThrottle,
+// lifting the lock when the remaining failures are within freeAttempts.
+func releaseLoginThrottle(db *sql.DB, key ThrottleKey, freeAttempts int) (err error) {
+	_, err = db.Exec(
+		`UPDATE login_throttles SET
+            failures = GREATEST(failures - 1, 0),
+            locked_until = CASE WHEN failures - 1 <= $1 THEN NULL ELSE locked_until END
+        WHERE scope = $2 AND key = $3`,
+		freeAttempts,
+		key.Scope,
+		key.Key,
+	)
+
+	return err
+}
+
+func resetLoginFailures(db *sql.DB, key ThrottleKey) (err error) {
+	_, err = db.Exec("DELETE FROM login_throttles WHERE scope = $1 AND key = $2", key.Scope, key.Key)
+
+	return err
+}
+
+func setLoginTOTPSecret(db *sql.DB, email, secret string) (err error) {
+	_, err = db.Exec(
+		"UPDATE logins SET totp_secret = $1, totp_last_step = 0, updated_at = NOW() WHERE email = $2 AND totp_enabled_at IS NULL",
+		secret,
+		email,
+	)
+
+	return err
+}
+
+// enableLoginTOTP turns on the enrolled secret and replaces the recovery
+// codes of email.
+func enableLoginTOTP(db *sql.DB, email string, recoveryCodeHashes []string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE logins SET totp_enabled_at = NOW(), updated_at = NOW() WHERE email = $1", email)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE email = $1", email)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO recovery_codes (email, code_hash) VALUES ($1, $2)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, hash := range recoveryCodeHashes {
+		_, err := stmt.Exec(email, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func disableLoginTOTP(db *sql.DB, email string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE logins SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0, updated_at = NOW() WHERE email = $1",
+		email,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE email = $1", email)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// advanceLoginTOTPStep records step as the last used TOTP step of email. It
+// returns sql.ErrNoRows when step, or a later one, was already used.
+func advanceLoginTOTPStep(db *sql.DB, email string, step int64) (err error) {
+	result, err := db.Exec(
+		"UPDATE logins SET totp_last_step = $1 WHERE email = $2 AND totp_last_step < $1",
+		step,
+		email,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func useRecoveryCode(db *sql.DB, email, hash string) (err error) {
+	var id int
+	err = db.
+		QueryRow(
+			"UPDATE recovery_codes SET used_at = NOW() WHERE email = $1 AND code_hash = $2 AND used_at IS NULL RETURNING id",
+			email,
+			hash,
+		).
+		Scan(&id)
+
+	return err
+}
+
+func insertAPIKey(db *sql.DB, apiKey APIKey) (APIKey, error) {
+	err := db.
+		QueryRow(
+			`INSERT INTO api_keys (email, name, prefix, key_hash, scopes) VALUES ($1, $2, $3, $4, $5)
+            RETURNING id, created_at`,
+			apiKey.User,
+			apiKey.Name,
+			apiKey.Prefix,
+			apiKey.Hash,
+			pq.Array(scopeStrings(apiKey.Scopes)),
+		).
+		Scan(&apiKey.ID, &apiKey.CreatedAt)
+
+	return apiKey, err
+}
+
+func getAPIKeysByUser(db *sql.DB, user string) (apiKeys []APIKey, err error) {
+	rows, err := db.Query(
+		`SELECT id, email, name, prefix, scopes, created_at, last_used_at FROM api_keys
+        WHERE email = $1 AND revoked_at IS NULL
+        ORDER BY created_at`,
+		user,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var apiKey APIKey
+		var scopes pq.StringArray
+		if err := rows.Scan(
+			&apiKey.ID,
+			&apiKey.User,
+			&apiKey.Name,
+			&apiKey.Prefix,
+			&scopes,
+			&apiKey.CreatedAt,
+			&apiKey.LastUsedAt,
+		); err != nil {
+			return nil, err
+		}
+		apiKey.Scopes = scopesFromStrings(scopes)
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	return apiKeys, rows.Err()
+}
+
+func getAPIKeyByPrefix(db *sql.DB, prefix string) (apiKey APIKey, err error) {
+	var scopes pq.StringArray
+	err = db.
+		QueryRow(
+			`SELECT id, email, name, prefix, key_hash, scopes, created_at, last_used_at FROM api_keys
+            WHERE prefix = $1 AND revoked_at IS NULL`,
+			prefix,
+		).
+		Scan(
+			&apiKey.ID,
+			&apiKey.User,
+			&apiKey.Name,
+			&apiKey.Prefix,
+			&apiKey.Hash,
+			&scopes,
+			&apiKey.CreatedAt,
+			&apiKey.LastUsedAt,
+		)
+	apiKey.Scopes = scopesFromStrings(scopes)
+
+	return apiKey, err
+}
+
+func scopeStrings(scopes []Scope) []string {
+	strings := make([]string, len(scopes))
+	for i, scope := range scopes {
+		strings[i] = string(scope)
+	}
+
+	return strings
+}
+
+func scopesFromStrings(strings []string) []Scope {
+	scopes := make([]Scope, len(strings))
+	for i, scope := range strings {
+		scopes[i] = Scope(scope)
+	}
+
+	return scopes
+}
+
+// touchAPIKey records the use of an API key, at most once a minute to keep
+// busy scripts from writing on every request.
+func touchAPIKey(db *sql.DB, id int) (err error) {
+	_, err = db.Exec(
+		`UPDATE api_keys SET last_used_at = NOW()
+        WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`,
+		id,
+	)
+
+	return err
+}
+
+func revokeAPIKey(db *sql.DB, user string, id int) (err error) {
+	result, err := db.Exec(
+		"UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND email = $2 AND revoked_at IS NULL",
+		id,
+		user,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// insertOIDCState stores state and drops the states of flows that expired
+// without a callback.
+func insertOIDCState(db *sql.DB, state OIDCState) (err error) {
+	_, err = db.Exec("DELETE FROM oidc_states WHERE expires_at < NOW()")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO oidc_states (state, provider, code_verifier, nonce, link_email, link_session, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		state.State,
+		state.Provider,
+		state.CodeVerifier,
+		state.Nonce,
+		state.LinkEmail,
+		state.LinkSession,
+		state.ExpiresAt,
+	)
+
+	return err
+}
+
+// consumeOIDCState deletes and returns an unexpired state, so every state
+// completes at most one login.
+func consumeOIDCState(db *sql.DB, value string) (state OIDCState, err error) {
+	err = db.
+		QueryRow(
+			`DELETE FROM oidc_states WHERE state = $1 AND expires_at > NOW()
+            RETURNING state, provider, code_verifier, nonce, link_email, link_session, expires_at`,
+			value,
+		).
+		Scan(&state.State, &state.Provider, &state.CodeVerifier, &state.Nonce, &state.LinkEmail, &state.LinkSession, &state.ExpiresAt)
+
+	return state, err
+}
+
+func getExternalIdentityEmail(db *sql.DB, provider, subject string) (email string, err error) {
+	err = db.
+		QueryRow("SELECT email FROM external_identities WHERE provider = $1 AND subject = $2", provider, subject).
+		Scan(&email)
+
+	return email, err
+}
+
+// linkExternalIdentity links identity to the login of its email, creating a
+// verified login without a usable password when there is none yet. Logins
+// with a password or an unverified email are left alone and linked is false:
+// whoever registered them has not proven to own the email, so they have to
+// log in and link the identity explicitly.
+func linkExternalIdentity(db *sql.DB, identity ExternalIdentity) (linked bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO logins (email, hash, verified_at) VALUES ($1, '!', NOW()) ON CONFLICT (email) DO NOTHING",
+		identity.Email,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	var hash string
+	var verifiedAt *time.Time
+	err = tx.
+		QueryRow("SELECT hash, verified_at FROM logins WHERE email = $1 FOR UPDATE", identity.Email).
+		Scan(&hash, &verifiedAt)
+	if err != nil {
+		return false, err
+	}
+	if hash != "!" || verifiedAt == nil {
+		return false, nil
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO external_identities (provider, subject, email) VALUES ($1, $2, $3)",
+		identity.Provider,
+		identity.Subject,
+		identity.Email,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// insertExternalIdentity links identity to the existing login of its email.
+func insertExternalIdentity(db *sql.DB, identity ExternalIdentity) (err error) {
+	_, err = db.Exec(
+		"INSERT INTO external_identities (provider, subject, email) VALUES ($1, $2, $3)",
+		identity.Provider,
+		identity.Subject,
+		identity.Email,
+	)
+
+	return err
+}
+
+// changeLoginPassword replaces the hash of email and invalidates every token
+// issued to it so far.
+func changeLoginPassword(db *sql.DB, email, passwordHash string, changedAt time.Time) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE logins SET hash = $1, updated_at = NOW(), tokens_valid_after = $2 WHERE email = $3",
+		passwordHash,
+		changedAt,
+		email,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE email = $1 AND revoked_at IS NULL", email)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE sessions SET terminated_at = NOW() WHERE email = $1 AND terminated_at IS NULL", email)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setEmailChangeNonce stores the nonce of the latest email change requested
+// for email, voiding the links sent before.
+func setEmailChangeNonce(db *sql.DB, email, nonce string) (err error) {
+	_, err = db.Exec("UPDATE logins SET email_change_nonce = $1, updated_at = NOW() WHERE email = $2", nonce, email)
+
+	return err
+}
+
+// setReauthNonce stores the nonce of the latest reauthentication token mailed
+// to email, voiding the tokens mailed before.
+func setReauthNonce(db *sql.DB, email, nonce string) (err error) {
+	_, err = db.Exec("UPDATE logins SET reauth_nonce = $1 WHERE email = $2", nonce, email)
+
+	return err
+}
+
+// setOIDCLoginNonce stores the nonce of the latest OIDC login code of email,
+// voiding the codes issued before.
+func setOIDCLoginNonce(db *sql.DB, email, nonce string) (err error) {
+	_, err = db.Exec("UPDATE logins SET oidc_login_nonce = $1 WHERE email = $2", nonce, email)
+
+	return err
+}
+
+// consumeOIDCLoginNonce clears the OIDC login nonce of email if it is nonce,
+// so a code is redeemed once. It returns sql.ErrNoRows otherwise.
+func consumeOIDCLoginNonce(db *sql.DB, email, nonce string) (err error) {
+	result, err := db.Exec("UPDATE logins SET oidc_login_nonce = NULL WHERE email = $1 AND oidc_login_nonce = $2", email, nonce)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// consumeReauthNonce clears the reauthentication nonce of email if it is
+// nonce, so a token works once. It returns sql.ErrNoRows otherwise.
+func consumeReauthNonce(db *sql.DB, email, nonce string) (err error) {
+	result, err := db.Exec("UPDATE logins SET reauth_nonce = NULL WHERE email = $1 AND reauth_nonce = $2", email, nonce)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// changeLoginEmail moves the login of oldEmail and everything that belongs
+// to it to newEmail, and invalidates every token issued to oldEmail. nonce
+// has to be the one stored by setEmailChangeNonce, which is cleared, so a
+// confirmation link works only once. It returns sql.ErrNoRows otherwise.
+func changeLoginEmail(db *sql.DB, oldEmail, newEmail, nonce string, changedAt time.Time) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`UPDATE logins SET email = $1, verified_at = NOW(), updated_at = NOW(),
+            tokens_valid_after = $2, email_change_nonce = NULL
+        WHERE email = $3 AND email_change_nonce = $4`,
+		newEmail,
+		changedAt,
+		oldEmail,
+		nonce,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE email = $1 AND revoked_at IS NULL", oldEmail)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE sessions SET terminated_at = NOW() WHERE email = $1 AND terminated_at IS NULL", oldEmail)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM password_resets WHERE email = $1", oldEmail)
+	if err != nil {
+		return err
+	}
+
+	moves := []string{
+		"UPDATE recovery_codes SET email = $1 WHERE email = $2",
+		"UPDATE api_keys SET email = $1 WHERE email = $2",
+		"UPDATE external_identities SET email = $1 WHERE email = $2",
+		`UPDATE orders SET "user" = $1 WHERE "user" = $2`,
+		`UPDATE order_items SET "user" = $1 WHERE "user" = $2`,
+	}
+	for _, move := range moves {
+		if _, err := tx.Exec(move, newEmail, oldEmail); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+func getAccount(db *sql.DB, email string) (account Account, err error) {
+	err = db.
+		QueryRow(
+			"SELECT email, role, created_at, updated_at, verified_at, totp_enabled_at FROM logins WHERE email = $1",
+			email,
+		).
+		Scan(
+			&account.Email,
+			&account.Role,
+			&account.CreatedAt,
+			&account.UpdatedAt,
+			&account.VerifiedAt,
+			&account.TOTPEnabledAt,
+		)
+
+	return account, err
+}
+
+func getExternalIdentitiesByEmail(db *sql.DB, email string) (identities []ExternalIdentity, err error) {
+	rows, err := db.Query(
+		"SELECT provider, subject, email FROM external_identities WHERE email = $1 ORDER BY created_at",
+		email,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var identity ExternalIdentity
+		if err := rows.Scan(&identity.Provider, &identity.Subject, &identity.Email); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
+
+// deleteLogin deletes the login of email and everything tied to it, except
+// orders, whose user is replaced by anonymizedUser.
+func deleteLogin(db *sql.DB, email, anonymizedUser string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, anonymize := range []string{
+		`UPDATE orders SET "user" = $1 WHERE "user" = $2`,
+		`UPDATE order_items SET "user" = $1 WHERE "user" = $2`,
+	} {
+		if _, err := tx.Exec(anonymize, anonymizedUser, email); err != nil {
+			return err
+		}
+	}
+
+	for _, remove := range []string{
+		"DELETE FROM refresh_tokens WHERE email = $1",
+		"DELETE FROM sessions WHERE email = $1",
+		"DELETE FROM password_resets WHERE email = $1",
+		"DELETE FROM recovery_codes WHERE email = $1",
+		"DELETE FROM api_keys WHERE email = $1",
+		"DELETE FROM external_identities WHERE email = $1",
+		"DELETE FROM login_throttles WHERE scope = 'email' AND key = LOWER($1)",
+	} {
+		if _, err := tx.Exec(remove, email); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec("DELETE FROM logins WHERE email = $1", email)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
+
+// insertSession starts session with the access token jti and the first
+// refresh token of its family.
+func insertSession(db *sql.DB, session Session, jti string, refresh RefreshToken) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO sessions (id, email, user_agent, ip, last_jti) VALUES ($1, $2, $3, $4, $5)",
+		session.ID,
+		session.Email,
+		session.UserAgent,
+		session.IP,
+		jti,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO refresh_tokens (family, email, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		refresh.Family,
+		refresh.Email,
+		refresh.Hash,
+		refresh.ExpiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// touchSession records the access token jti issued by a refresh of session id.
+func touchSession(db *sql.DB, id, jti string, client Client) (err error) {
+	_, err = db.Exec(
+		"UPDATE sessions SET last_jti = $1, ip = $2, user_agent = $3, last_seen_at = NOW() WHERE id = $4",
+		jti,
+		client.ip(),
+		client.userAgent(),
+		id,
+	)
+
+	return err
+}
+
+// seeSession records a request of session id, at most once a minute so that
+// reads do not turn into a write each.
+func seeSession(db *sql.DB, id string, client Client) (err error) {
+	_, err = db.Exec(
+		`UPDATE sessions SET ip = $1, user_agent = $2, last_seen_at = NOW()
+        WHERE id = $3 AND last_seen_at < NOW() - INTERVAL '1 minute'`,
+		client.ip(),
+		client.userAgent(),
+		id,
+	)
+
+	return err
+}
+
+// getActiveSessions returns the sessions of email that are neither
+// terminated nor left without a usable refresh token, most recent first.
+func getActiveSessions(db *sql.DB, email string) (sessions []Session, err error) {
+	rows, err := db.Query(
+		`SELECT id, email, user_agent, ip, created_at, last_seen_at FROM sessions
+        WHERE email = $1 AND terminated_at IS NULL AND EXISTS (
+            SELECT 1 FROM refresh_tokens
+            WHERE family = sessions.id AND revoked_at IS NULL AND expires_at > NOW()
+        )
+        ORDER BY last_seen_at DESC`,
+		email,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(
+			&session.ID,
+			&session.Email,
+			&session.UserAgent,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+		); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// isSessionActive reports whether session id of email is not terminated.
+func isSessionActive(db *sql.DB, id, email string) (active bool, err error) {
+	err = db.
+		QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM sessions WHERE id = $1 AND email = $2 AND terminated_at IS NULL)",
+			id,
+			email,
+		).
+		Scan(&active)
+
+	return active, err
+}
+
+// terminateSession terminates session id of email and revokes its refresh
+// tokens.
+func terminateSession(db *sql.DB, email, id string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE sessions SET terminated_at = NOW() WHERE id = $1 AND email = $2 AND terminated_at IS NULL",
+		id,
+		email,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE family = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		return err
 	}
 
-	return orders, nil
+	return tx.Commit()
 }
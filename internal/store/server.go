@@ -1,16 +1,20 @@
 package store
 
 import (
-	"crypto/ed25519"
+	"bytes"
 	"database/sql"
 	"encoding/base64"
-	"encoding/hex"
 	"errors"
+	"io"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/kelseyhightower/envconfig"
 
@@ -18,61 +22,221 @@ import (
 )
 
 type ServerConfig struct {
-	Port     int
-	BasePath string
+	Port            int
+	BasePath        string
+	AccessTokenTTL  time.Duration `default:"15m"`
+	RefreshTokenTTL time.Duration `default:"720h"`
+
+	// TokenIssuer and TokenAudience are stamped into access tokens and
+	// required of every token presented, so that tokens of one environment
+	// are rejected by another. TokenLeeway tolerates clock skew between
+	// servers when checking exp, nbf and iat.
+	TokenIssuer   string        `default:"gotu"`
+	TokenAudience string        `default:"bookstore"`
+	TokenLeeway   time.Duration `default:"30s"`
+	// TokenTenant adds a tenant claim that must match, TokenUserID adds the
+	// numeric id of the login as uid.
+	TokenTenant string
+	TokenUserID bool `default:"true"`
+
+	PasswordResetURL string        `default:"http://localhost:3000/reset-password"`
+	PasswordResetTTL time.Duration `default:"1h"`
+
+	VerificationURL      string        `default:"http://localhost:3000/verify-email"`
+	VerificationTTL      time.Duration `default:"48h"`
+	RequireVerifiedEmail bool          `default:"true"`
+
+	// EmailChangeURL receives the token confirming a new address, which is
+	// valid for VerificationTTL.
+	EmailChangeURL string `default:"http://localhost:3000/confirm-email"`
+
+	// ReauthURL receives the token standing in for the current password of
+	// logins without one, such as those created by an identity provider.
+	ReauthURL string        `default:"http://localhost:3000/reauthenticate"`
+	ReauthTTL time.Duration `default:"15m"`
+
+	// OIDCLoginURL receives the code an OIDC callback redirects with, which
+	// the frontend redeems once at /v1/oidc/token for the login result.
+	OIDCLoginURL string `default:"http://localhost:3000/oidc-login"`
+
+	PasswordMinLength       int  `default:"10"`
+	PasswordMaxLength       int  `default:"128"`
+	PasswordRequiredClasses int  `default:"2"`
+	PasswordRejectEmail     bool `default:"true"`
+	PasswordRejectCommon    bool `default:"true"`
+
+	// Argon2Memory is in KiB. Changing any of these rehashes passwords as
+	// users log in.
+	Argon2Time    uint32 `default:"1"`
+	Argon2Memory  uint32 `default:"65536"`
+	Argon2Threads uint8  `default:"1"`
+
+	LoginEmailFreeAttempts int           `default:"5"`
+	LoginIPFreeAttempts    int           `default:"50"`
+	LoginBackoffBase       time.Duration `default:"1s"`
+	LoginBackoffMax        time.Duration `default:"15m"`
+	LoginFailureWindow     time.Duration `default:"24h"`
+
+	TOTPIssuer      string        `default:"Bookstore"`
+	MFAChallengeTTL time.Duration `default:"5m"`
+
+	OIDCProviders []string
+	OIDC          []OIDCProviderConfig `ignored:"true"`
+
+	// Catalog reads are public. Anonymous visitors are limited per IP,
+	// signed-in users and API keys per subject, both per CatalogRateWindow.
+	CatalogRateLimit          int           `default:"300"`
+	CatalogAnonymousRateLimit int           `default:"60"`
+	CatalogRateWindow         time.Duration `default:"1m"`
+
+	// ProxyHeader names the header carrying the client IP when running
+	// behind a load balancer, e.g. X-Forwarded-For.
+	ProxyHeader string
+
+	// BodyLimit caps request bodies in bytes. Catalog imports are streamed
+	// and only capped by ImportBodyLimit.
+	BodyLimit       int   `default:"4194304"`
+	ImportBodyLimit int64 `default:"1073741824"`
 }
 
 func ParseServerConfig() ServerConfig {
 	cfg := ServerConfig{}
 	envconfig.MustProcess("BOOKSTORE_SERVER", &cfg)
 
+	for _, name := range cfg.OIDCProviders {
+		provider := OIDCProviderConfig{Name: name}
+		envconfig.MustProcess("BOOKSTORE_OIDC_"+strings.ToUpper(name), &provider)
+		cfg.OIDC = append(cfg.OIDC, provider)
+	}
+
 	return cfg
 }
 
 type Server struct {
-	router  *fiber.App
-	port    int
-	app     App
-	authKey ed25519.PrivateKey
+	router          *fiber.App
+	port            int
+	app             App
+	importBodyLimit int64
+	oidcPath        string
 }
 
-func NewServer(cfg ServerConfig, secrets Secrets, db *sql.DB) Server {
-	router := fiber.New()
+func NewServer(cfg ServerConfig, secrets Secrets, db *sql.DB, mailer Mailer, blobs BlobStore) Server {
+	router := fiber.New(fiber.Config{
+		ProxyHeader: cfg.ProxyHeader,
+		// Without validation c.IP() is whatever the proxy header says, which
+		// would let clients pick their throttle and rate limit keys.
+		EnableIPValidation: true,
+		BodyLimit:          cfg.BodyLimit,
+		// Bodies above BodyLimit are streamed rather than rejected, so that
+		// imports need not fit in memory. limitBody rejects them elsewhere.
+		StreamRequestBody: true,
+		// Multipart bodies would otherwise be read whole, whatever their
+		// size, before limitBody gets to see them.
+		DisablePreParseMultipartForm: true,
+	})
 	server := Server{
-		router: router,
-		port:   cfg.Port,
-		app:    NewApp(secrets, db),
+		router:          router,
+		port:            cfg.Port,
+		app:             NewApp(cfg, secrets, db, mailer, blobs),
+		importBodyLimit: cfg.ImportBodyLimit,
+		oidcPath:        "/v1" + cfg.BasePath + "/oidc",
 	}
 
+	authenticate := jwtware.New(
+		jwtware.Config{
+			// Requests already authenticated with an API key skip the bearer token.
+			Filter: func(c *fiber.Ctx) bool {
+				return c.Locals("user") != nil
+			},
+			KeyFunc:        server.app.KeyFunc,
+			Claims:         &Claims{},
+			SuccessHandler: server.checkToken,
+			ErrorHandler:   server.retryWithLeeway,
+		},
+	)
+
+	// Imports stream their body, so they are routed before limitBody reads
+	// bodies into memory.
+	router.Post(
+		"/v1"+cfg.BasePath+"/admin/books/import",
+		server.authenticateAPIKey,
+		authenticate,
+		server.requireScope(ScopeAdmin),
+		server.requireRole(RoleAdmin),
+		server.importBooks,
+	)
+	router.Use(limitBody(cfg.BodyLimit))
+
+	router.Get("/.well-known/jwks.json", server.getJWKS)
+
 	v1 := router.Group("/v1" + cfg.BasePath)
 	v1.Get("/health", server.getHealth)
 	v1.Post("/users", server.postUsers)
+	v1.Post("/users/verify", server.verifyEmail)
 	v1.Post("/login", server.login)
+	v1.Post("/login/mfa", server.loginMFA)
+	v1.Post("/token/refresh", server.refreshToken)
+	v1.Get("/oidc/:provider/authorize", server.authorizeOIDC)
+	v1.Get("/oidc/:provider/callback", server.callbackOIDC)
+	v1.Post("/oidc/token", server.redeemOIDCLogin)
+	v1.Post("/email/confirm", server.confirmEmailChange)
+	v1.Post("/password/reset", server.requestPasswordReset)
+	v1.Post("/password/reset/confirm", server.confirmPasswordReset)
 
-	seed, err := hex.DecodeString(secrets.GetAuthKey())
-	if err != nil {
-		panic(err)
+	// The catalog can be browsed before signing up. Credentials are optional
+	// but checked when sent, and personalize the response.
+	catalog := []fiber.Handler{
+		server.authenticateAPIKey,
+		server.authenticateOptionally(authenticate),
+		server.limitCatalog(cfg),
+		server.requireScope(ScopeBooksRead),
 	}
+	v1.Get("/books", append(catalog, server.getBooks)...)
+	v1.Get("/books/search", append(catalog, server.searchBooks)...)
+	v1.Get("/books/:id", append(catalog, server.getBook)...)
+	v1.Get("/authors", append(catalog, server.getAuthors)...)
+	v1.Get("/authors/:id/books", append(catalog, server.getAuthorBooks)...)
+	v1.Get("/categories", append(catalog, server.getCategories)...)
+	v1.Get("/tags", append(catalog, server.getTags)...)
 
-	server.authKey = ed25519.NewKeyFromSeed(seed)
+	v1.Use(server.authenticateAPIKey)
+	v1.Use(authenticate)
 
-	v1.Use(
-		jwtware.New(
-			jwtware.Config{
-				SigningKey: jwtware.SigningKey{
-					JWTAlg: "EdDSA",
-					Key:    server.authKey.Public(),
-				},
-				ErrorHandler: func(c *fiber.Ctx, err error) error {
-					return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
-				},
-			},
-		),
-	)
+	v1.Post("/logout", server.denyAPIKeys, server.logout)
+	v1.Post("/users/verify/resend", server.denyAPIKeys, server.resendVerification)
+	v1.Put("/password", server.denyAPIKeys, server.changePassword)
+	v1.Post("/email", server.denyAPIKeys, server.requestEmailChange)
+	v1.Get("/account/export", server.denyAPIKeys, server.exportAccount)
+	v1.Get("/sessions", server.denyAPIKeys, server.getSessions)
+	v1.Delete("/sessions/:id", server.denyAPIKeys, server.deleteSession)
+	v1.Delete("/account", server.denyAPIKeys, server.deleteAccount)
+	v1.Post("/account/reauthenticate", server.denyAPIKeys, server.requestReauthentication)
+	v1.Post("/oidc/:provider/link", server.denyAPIKeys, server.linkOIDC)
+	v1.Post("/mfa/totp", server.denyAPIKeys, server.enrollTOTP)
+	v1.Post("/mfa/totp/confirm", server.denyAPIKeys, server.confirmTOTP)
+	v1.Delete("/mfa/totp", server.denyAPIKeys, server.disableTOTP)
+	v1.Post("/apikeys", server.denyAPIKeys, server.createAPIKey)
+	v1.Get("/apikeys", server.denyAPIKeys, server.getAPIKeys)
+	v1.Delete("/apikeys/:id", server.denyAPIKeys, server.deleteAPIKey)
+	v1.Post("/books", server.requireScope(ScopeAdmin), server.requireRole(RoleAdmin), server.createBook)
+	v1.Put("/books/:id", server.requireScope(ScopeAdmin), server.requireRole(RoleAdmin), server.putBook)
+	v1.Patch("/books/:id", server.requireScope(ScopeAdmin), server.requireRole(RoleAdmin), server.patchBook)
+	v1.Delete("/books/:id", server.requireScope(ScopeAdmin), server.requireRole(RoleAdmin), server.deleteBook)
+	v1.Put("/books/:id/cover", server.requireScope(ScopeAdmin), server.requireRole(RoleAdmin), server.putBookCover)
+	v1.Delete("/books/:id/cover", server.requireScope(ScopeAdmin), server.requireRole(RoleAdmin), server.deleteBookCover)
+	v1.Post("/categories", server.requireScope(ScopeAdmin), server.requireRole(RoleAdmin), server.createCategory)
+	v1.Put("/categories/:id", server.requireScope(ScopeAdmin), server.requireRole(RoleAdmin), server.putCategory)
+	v1.Delete("/categories/:id", server.requireScope(ScopeAdmin), server.requireRole(RoleAdmin), server.deleteCategory)
+	v1.Put("/tags/:tag", server.requireScope(ScopeAdmin), server.requireRole(RoleAdmin), server.putTag)
+	v1.Delete("/tags/:tag", server.requireScope(ScopeAdmin), server.requireRole(RoleAdmin), server.deleteTag)
+	v1.Get("/orders", server.requireScope(ScopeOrdersRead), server.getOrders)
+	v1.Post("/orders", server.requireScope(ScopeOrdersWrite), server.createOrder)
+
+	admin := v1.Group("/admin", server.requireScope(ScopeAdmin), server.requireRole(RoleStaff, RoleAdmin))
+	admin.Get("/orders", server.getAllOrders)
+	admin.Patch("/orders/:id", server.patchOrder)
+	admin.Put("/users/:email/role", server.requireRole(RoleAdmin), server.putUserRole)
 
-	v1.Get("/books", server.getBooks)
-	v1.Get("/orders", server.getOrders)
-	v1.Post("/orders", server.createOrder)
 	return server
 }
 
@@ -88,12 +252,24 @@ func (s *Server) Test(req *http.Request, msTimeout ...int) (*http.Response, erro
 	return s.router.Test(req, msTimeout...)
 }
 
+// Static serves the files under dir at prefix, such as the blobs of a
+// local BlobStore.
+func (s *Server) Static(prefix, dir string) {
+	s.router.Static(prefix, dir)
+}
+
 func (s *Server) getHealth(c *fiber.Ctx) error {
 	c.SendStatus(fiber.StatusOK)
 
 	return nil
 }
 
+func (s *Server) getJWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+
+	return c.JSON(s.app.JWKS())
+}
+
 func (s *Server) postUsers(c *fiber.Ctx) error {
 	user := &User{}
 	err := c.BodyParser(user)
@@ -103,6 +279,10 @@ func (s *Server) postUsers(c *fiber.Ctx) error {
 
 	err = s.app.RegisterUser(*user)
 	if err != nil {
+		var validation *ValidationError
+		if errors.As(err, &validation) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error(), "fields": validation.Fields})
+		}
 		if errors.Is(err, ErrConflict) {
 			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
 		}
@@ -116,6 +296,44 @@ func (s *Server) postUsers(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"user": user.Email})
 }
 
+func (s *Server) verifyEmail(c *fiber.Ctx) error {
+	var body struct{ Token string }
+	err := c.BodyParser(&body)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = s.app.VerifyEmail(body.Token)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, ErrInternal) {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *Server) resendVerification(c *fiber.Ctx) error {
+	err := s.app.ResendVerification(claimsFrom(c).Subject)
+	if err != nil {
+		if errors.Is(err, ErrUnauthorized) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, ErrConflict) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
 func (s *Server) login(c *fiber.Ctx) error {
 	var user User
 	var err error
@@ -124,78 +342,1327 @@ func (s *Server) login(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	token, err := s.app.LoginUser(user)
+	result, err := s.app.LoginUser(user, clientFrom(c))
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+		return sendLoginError(c, err)
+	}
+
+	return s.sendLoginResult(c, result)
+}
+
+// oidcBindingCookie keeps the binding of an OIDC flow in the browser that
+// started it until the provider redirects back.
+const oidcBindingCookie = "oidc_binding"
+
+func (s *Server) authorizeOIDC(c *fiber.Ctx) error {
+	flow, err := s.app.StartOIDCLogin(c.Params("provider"))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	signedString, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, token).SignedString(s.authKey)
+	s.setOIDCBinding(c, flow.Binding, flow.ExpiresAt)
+
+	return c.Redirect(flow.URL, fiber.StatusFound)
+}
+
+// linkOIDC answers with the URL of the provider rather than a redirect, as
+// the request carries a bearer token a browser navigation could not.
+func (s *Server) linkOIDC(c *fiber.Ctx) error {
+	flow, err := s.app.StartOIDCLink(c.Params("provider"), *claimsFrom(c))
 	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	return c.JSON(fiber.Map{"token": signedString})
+	s.setOIDCBinding(c, flow.Binding, flow.ExpiresAt)
+
+	return c.JSON(fiber.Map{"url": flow.URL})
 }
 
-func decodeBasicAuth(authHeader string) (string, string, error) {
-	if authHeader == "" {
-		return "", "", errors.New("missing authorization header")
+// setOIDCBinding keeps binding in the browser for the callback. Lax lets the
+// cookie along on the redirect of the provider, a top level navigation.
+func (s *Server) setOIDCBinding(c *fiber.Ctx, binding string, expiresAt time.Time) {
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcBindingCookie,
+		Value:    binding,
+		Path:     s.oidcPath,
+		Expires:  expiresAt,
+		Secure:   c.Secure(),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+func (s *Server) callbackOIDC(c *fiber.Ctx) error {
+	binding := c.Cookies(oidcBindingCookie)
+	s.setOIDCBinding(c, "", time.Unix(0, 0))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	if providerError := c.Query("error"); providerError != "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": providerError + ": " + c.Query("error_description")})
 	}
-	if len(authHeader) < 6 || authHeader[:6] != "Basic " {
-		return "", "", errors.New("invalid authorization header")
+
+	loginURL, err := s.app.CompleteOIDCLogin(c.Params("provider"), c.Query("code"), c.Query("state"), binding)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, ErrForbidden) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, ErrConflict) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return sendLoginError(c, err)
 	}
-	decoded, err := base64.StdEncoding.DecodeString(authHeader[6:])
+
+	return c.Redirect(loginURL, fiber.StatusFound)
+}
+
+func (s *Server) redeemOIDCLogin(c *fiber.Ctx) error {
+	var body struct{ Token string }
+	err := c.BodyParser(&body)
 	if err != nil {
-		return "", "", errors.New("failed to decode authorization header")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
-	creds := strings.SplitN(string(decoded), ":", 2)
-	if len(creds) != 2 {
-		return "", "", errors.New("invalid authorization header")
+
+	result, err := s.app.RedeemOIDCLogin(body.Token, clientFrom(c))
+	if err != nil {
+		return sendLoginError(c, err)
 	}
-	return creds[0], creds[1], nil
+
+	return s.sendLoginResult(c, result)
 }
 
-func (s *Server) getBooks(c *fiber.Ctx) error {
-	books, err := s.app.GetBooks()
+func (s *Server) sendLoginResult(c *fiber.Ctx, result LoginResult) error {
+	if result.MFARequired() {
+		return c.JSON(fiber.Map{
+			"mfaRequired":  true,
+			"mfaChallenge": result.MFAChallenge,
+			"expiresAt":    result.MFAExpiresAt,
+		})
+	}
+
+	return s.sendTokens(c, result.Tokens)
+}
+
+func (s *Server) loginMFA(c *fiber.Ctx) error {
+	var body struct {
+		MFAChallenge string
+		Code         string
+	}
+	err := c.BodyParser(&body)
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
-	return c.JSON(fiber.Map{"books": books})
+
+	tokens, err := s.app.VerifyMFA(body.MFAChallenge, body.Code, clientFrom(c))
+	if err != nil {
+		return sendLoginError(c, err)
+	}
+
+	return s.sendTokens(c, tokens)
 }
 
-func (s *Server) getOrders(c *fiber.Ctx) error {
-	user := c.Locals("user").(*jwt.Token)
-	userSubject, err := user.Claims.GetSubject()
+func sendLoginError(c *fiber.Ctx, err error) error {
+	var throttled *ThrottledError
+	if errors.As(err, &throttled) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": err.Error()})
+	}
+	if errors.Is(err, ErrInternal) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+}
+
+func (s *Server) enrollTOTP(c *fiber.Ctx) error {
+	enrollment, err := s.app.EnrollTOTP(claimsFrom(c).Subject)
 	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		}
+
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	orders, err := s.app.GetOrdersByUser(userSubject)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"secret": enrollment.Secret, "uri": enrollment.URI})
+}
+
+func (s *Server) confirmTOTP(c *fiber.Ctx) error {
+	var body struct{ Code string }
+	err := c.BodyParser(&body)
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
-	return c.JSON(fiber.Map{"orders": orders})
+
+	recoveryCodes, err := s.app.ConfirmTOTP(claimsFrom(c).Subject, body.Code)
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, ErrInternal) {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"recoveryCodes": recoveryCodes})
 }
 
-func (s *Server) createOrder(c *fiber.Ctx) error {
-	user := c.Locals("user").(*jwt.Token)
-	userSubject, err := user.Claims.GetSubject()
+func (s *Server) disableTOTP(c *fiber.Ctx) error {
+	var body struct{ Code string }
+	err := c.BodyParser(&body)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	orderRequest := OrderRequest{}
-	err = c.BodyParser(&orderRequest)
+	err = s.app.DisableTOTP(claimsFrom(c).Subject, body.Code)
 	if err != nil {
+		if errors.Is(err, ErrInternal) {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	orderRequest.User = userSubject
+	return c.SendStatus(fiber.StatusNoContent)
+}
 
-	order, err := s.app.CreateOrder(orderRequest)
+func (s *Server) refreshToken(c *fiber.Ctx) error {
+	var body struct{ RefreshToken string }
+	err := c.BodyParser(&body)
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
+	if body.RefreshToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "refresh token is required"})
+	}
 
-	return c.Status(fiber.StatusCreated).JSON(order)
+	tokens, err := s.app.RefreshTokens(body.RefreshToken, clientFrom(c))
+	if err != nil {
+		if errors.Is(err, ErrInternal) {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return s.sendTokens(c, tokens)
+}
+
+func (s *Server) logout(c *fiber.Ctx) error {
+	claims := claimsFrom(c)
+
+	var body struct{ RefreshToken string }
+	if len(c.Body()) > 0 {
+		err := c.BodyParser(&body)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	err := s.app.Logout(*claims, body.RefreshToken)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *Server) sendTokens(c *fiber.Ctx, tokens Tokens) error {
+	signedString, err := s.app.SignAccessToken(tokens.Access)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"token":            signedString,
+		"expiresAt":        tokens.Access.ExpiresAt.Time,
+		"refreshToken":     tokens.Refresh,
+		"refreshExpiresAt": tokens.RefreshExpiresAt,
+	})
+}
+
+// checkToken runs after jwtware accepted the signature of a token. It
+// rejects tokens of another issuer, audience or tenant, and tokens that were
+// revoked by logout, or by a credential change of their subject, before their
+// expiry.
+func (s *Server) checkToken(c *fiber.Ctx) error {
+	claims := claimsFrom(c)
+	if claims.ID == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "token has no id"})
+	}
+
+	if err := s.app.ValidateAccessToken(*claims); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	revoked, err := s.app.IsTokenRevoked(*claims)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if revoked {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "token has been revoked"})
+	}
+
+	s.app.SeeSession(*claims, clientFrom(c))
+
+	return c.Next()
+}
+
+// retryWithLeeway handles tokens jwtware rejected. jwtware checks exp, nbf
+// and iat without leeway, so tokens it rejected for timing alone get parsed
+// again with the configured leeway.
+func (s *Server) retryWithLeeway(c *fiber.Ctx, err error) error {
+	timing := errors.Is(err, jwt.ErrTokenExpired) ||
+		errors.Is(err, jwt.ErrTokenNotValidYet) ||
+		errors.Is(err, jwt.ErrTokenUsedBeforeIssued)
+	if !timing {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	raw, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !found {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	token, err := s.app.ParseAccessToken(raw)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	c.Locals("user", token)
+
+	return s.checkToken(c)
+}
+
+func clientFrom(c *fiber.Ctx) Client {
+	return Client{IP: c.IP(), UserAgent: c.Get(fiber.HeaderUserAgent)}
+}
+
+// limitBody reads request bodies into memory, rejecting those above limit.
+func limitBody(limit int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		stream := c.Request().BodyStream()
+		if stream == nil {
+			return c.Next()
+		}
+
+		body, err := io.ReadAll(io.LimitReader(stream, int64(limit)+1))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if len(body) > limit {
+			// The rest of the body is left unread, so the connection
+			// cannot serve another request.
+			c.Context().SetConnectionClose()
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": fiber.ErrRequestEntityTooLarge.Error()})
+		}
+		c.Request().SetBodyRaw(body)
+
+		return c.Next()
+	}
+}
+
+// authenticateOptionally lets anonymous requests through and authenticates
+// the others, rejecting invalid credentials rather than ignoring them.
+func (s *Server) authenticateOptionally(authenticate fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Locals("user") == nil && c.Get(fiber.HeaderAuthorization) == "" {
+			return c.Next()
+		}
+
+		return authenticate(c)
+	}
+}
+
+// limitCatalog rate limits anonymous requests per IP and authenticated ones
+// per subject, so a crowd of visitors behind one address cannot starve
+// signed-in users.
+func (s *Server) limitCatalog(cfg ServerConfig) fiber.Handler {
+	limitReached := func(c *fiber.Ctx) error {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many requests"})
+	}
+
+	anonymous := limiter.New(limiter.Config{
+		Max:        cfg.CatalogAnonymousRateLimit,
+		Expiration: cfg.CatalogRateWindow,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return c.IP()
+		},
+		LimitReached: limitReached,
+	})
+	authenticated := limiter.New(limiter.Config{
+		Max:        cfg.CatalogRateLimit,
+		Expiration: cfg.CatalogRateWindow,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return claimsFrom(c).Subject
+		},
+		LimitReached: limitReached,
+	})
+
+	return func(c *fiber.Ctx) error {
+		if optionalClaimsFrom(c) == nil {
+			return anonymous(c)
+		}
+
+		return authenticated(c)
+	}
+}
+
+// requireRole only lets requests through whose token carries one of roles.
+func (s *Server) requireRole(roles ...Role) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims := claimsFrom(c)
+		for _, role := range roles {
+			if claims.Role == role {
+				return c.Next()
+			}
+		}
+
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": ErrForbidden.Error()})
+	}
+}
+
+// requireScope rejects API keys that were not granted scope. Access tokens
+// carry no scopes and pass, as do anonymous requests to public routes.
+func (s *Server) requireScope(scope Scope) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if claims := optionalClaimsFrom(c); claims != nil && !claims.HasScope(scope) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "api key lacks scope " + string(scope)})
+		}
+
+		return c.Next()
+	}
+}
+
+// denyAPIKeys guards account management, which needs a login by the user.
+func (s *Server) denyAPIKeys(c *fiber.Ctx) error {
+	if claimsFrom(c).Scopes != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "not allowed with an api key"})
+	}
+
+	return c.Next()
+}
+
+// authenticateAPIKey accepts an API key in the X-API-Key header or as
+// "Authorization: ApiKey <key>" and leaves every other request to jwtware.
+func (s *Server) authenticateAPIKey(c *fiber.Ctx) error {
+	key := c.Get("X-API-Key")
+	if scheme, value, ok := strings.Cut(c.Get(fiber.HeaderAuthorization), " "); ok && strings.EqualFold(scheme, "ApiKey") {
+		key = value
+	}
+	if key == "" {
+		return c.Next()
+	}
+
+	claims, err := s.app.AuthenticateAPIKey(key)
+	if err != nil {
+		if errors.Is(err, ErrInternal) {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Locals("user", &jwt.Token{Claims: &claims, Valid: true})
+
+	return c.Next()
+}
+
+func claimsFrom(c *fiber.Ctx) *Claims {
+	return c.Locals("user").(*jwt.Token).Claims.(*Claims)
+}
+
+// optionalClaimsFrom is claimsFrom for public routes, nil when anonymous.
+func optionalClaimsFrom(c *fiber.Ctx) *Claims {
+	if c.Locals("user") == nil {
+		return nil
+	}
+
+	return claimsFrom(c)
+}
+
+func (s *Server) requestPasswordReset(c *fiber.Ctx) error {
+	var body struct{ Email string }
+	err := c.BodyParser(&body)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = s.app.RequestPasswordReset(body.Email)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+func (s *Server) changePassword(c *fiber.Ctx) error {
+	var body struct {
+		Reauthentication
+		NewPassword string
+	}
+	err := c.BodyParser(&body)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	tokens, err := s.app.ChangePassword(claimsFrom(c).Subject, body.Reauthentication, body.NewPassword, clientFrom(c))
+	if err != nil {
+		return sendCredentialError(c, err)
+	}
+
+	return s.sendTokens(c, tokens)
+}
+
+func (s *Server) requestEmailChange(c *fiber.Ctx) error {
+	var body struct {
+		Reauthentication
+		NewEmail string
+	}
+	err := c.BodyParser(&body)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = s.app.RequestEmailChange(claimsFrom(c).Subject, body.Reauthentication, body.NewEmail, clientFrom(c))
+	if err != nil {
+		return sendCredentialError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+func (s *Server) confirmEmailChange(c *fiber.Ctx) error {
+	var body struct{ Token string }
+	err := c.BodyParser(&body)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = s.app.ConfirmEmailChange(body.Token)
+	if err != nil {
+		return sendCredentialError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *Server) getSessions(c *fiber.Ctx) error {
+	claims := claimsFrom(c)
+
+	sessions, err := s.app.GetSessions(claims.Subject, claims.SessionID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"sessions": sessions})
+}
+
+func (s *Server) deleteSession(c *fiber.Ctx) error {
+	err := s.app.TerminateSession(claimsFrom(c).Subject, c.Params("id"))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *Server) exportAccount(c *fiber.Ctx) error {
+	export, err := s.app.ExportAccount(claimsFrom(c).Subject)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Attachment("bookstore-export-" + export.ExportedAt.UTC().Format("20060102") + ".json")
+
+	return c.JSON(export)
+}
+
+func (s *Server) deleteAccount(c *fiber.Ctx) error {
+	var body Reauthentication
+	err := c.BodyParser(&body)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = s.app.DeleteAccount(claimsFrom(c).Subject, body, clientFrom(c))
+	if err != nil {
+		return sendCredentialError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *Server) requestReauthentication(c *fiber.Ctx) error {
+	err := s.app.RequestReauthentication(claimsFrom(c).Subject)
+	if err != nil {
+		return sendCredentialError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+// sendCredentialError writes the response for a failed request that needed
+// reauthentication, such as a change of password or email.
+func sendCredentialError(c *fiber.Ctx, err error) error {
+	var throttled *ThrottledError
+	if errors.As(err, &throttled) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error(), "fields": validation.Fields})
+	}
+	if errors.Is(err, ErrConflict) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	if errors.Is(err, ErrInternal) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+}
+
+func (s *Server) confirmPasswordReset(c *fiber.Ctx) error {
+	var body struct {
+		Token    string
+		Password string
+	}
+	err := c.BodyParser(&body)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = s.app.ConfirmPasswordReset(body.Token, body.Password)
+	if err != nil {
+		var validation *ValidationError
+		if errors.As(err, &validation) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error(), "fields": validation.Fields})
+		}
+		if errors.Is(err, ErrInternal) {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func decodeBasicAuth(authHeader string) (string, string, error) {
+	if authHeader == "" {
+		return "", "", errors.New("missing authorization header")
+	}
+	if len(authHeader) < 6 || authHeader[:6] != "Basic " {
+		return "", "", errors.New("invalid authorization header")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(authHeader[6:])
+	if err != nil {
+		return "", "", errors.New("failed to decode authorization header")
+	}
+	creds := strings.SplitN(string(decoded), ":", 2)
+	if len(creds) != 2 {
+		return "", "", errors.New("invalid authorization header")
+	}
+	return creds[0], creds[1], nil
+}
+
+func (s *Server) getBooks(c *fiber.Ctx) error {
+	query, err := bookQueryFrom(c)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	page, err := s.app.GetBooks(query)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	response := fiber.Map{"books": page.Books}
+	if page.NextCursor != "" {
+		response["nextCursor"] = page.NextCursor
+	}
+	if err := s.personalize(c, response, page.Books); err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.JSON(response)
+}
+
+func (s *Server) getAuthors(c *fiber.Ctx) error {
+	validation := ValidationError{}
+	query := AuthorQuery{
+		Limit:  queryInt(c, "limit", &validation),
+		Cursor: c.Query("cursor"),
+		Name:   c.Query("name"),
+	}
+	if err := validation.Err(); err != nil {
+		return sendBookError(c, err)
+	}
+
+	page, err := s.app.GetAuthors(query)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	response := fiber.Map{"authors": page.Authors}
+	if page.NextCursor != "" {
+		response["nextCursor"] = page.NextCursor
+	}
+
+	return c.JSON(response)
+}
+
+// getAuthorBooks pages through the books of an author like getBooks, with
+// the same query parameters.
+func (s *Server) getAuthorBooks(c *fiber.Ctx) error {
+	authorID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	author, err := s.app.GetAuthor(authorID)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	query, err := bookQueryFrom(c)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+	query.AuthorID = author.ID
+
+	page, err := s.app.GetBooks(query)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	response := fiber.Map{"author": author, "books": page.Books}
+	if page.NextCursor != "" {
+		response["nextCursor"] = page.NextCursor
+	}
+	if err := s.personalize(c, response, page.Books); err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.JSON(response)
+}
+
+// getCategories returns the whole category tree.
+func (s *Server) getCategories(c *fiber.Ctx) error {
+	categories, err := s.app.GetCategoryTree()
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.JSON(fiber.Map{"categories": categories})
+}
+
+func (s *Server) getTags(c *fiber.Ctx) error {
+	tags, err := s.app.GetTags()
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.JSON(fiber.Map{"tags": tags})
+}
+
+// getBook answers conditional requests with 304 Not Modified, so clients
+// showing a book can revalidate their copy without downloading it again.
+func (s *Server) getBook(c *fiber.Ctx) error {
+	bookID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	book, err := s.app.GetBook(bookID)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	etag := `"` + strconv.Itoa(book.ID) + "-" + strconv.FormatInt(book.UpdatedAt.UnixNano(), 36) + `"`
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderLastModified, book.UpdatedAt.UTC().Format(http.TimeFormat))
+	c.Set(fiber.HeaderCacheControl, "public, no-cache")
+
+	if notModified(c, etag, book.UpdatedAt) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	return c.JSON(book)
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since as RFC 9110
+// describes for GET: If-Modified-Since only counts without If-None-Match,
+// and Last-Modified has a precision of one second.
+func notModified(c *fiber.Ctx, etag string, lastModified time.Time) bool {
+	if noneMatch := c.Get(fiber.HeaderIfNoneMatch); noneMatch != "" {
+		for _, candidate := range strings.Split(noneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	since, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince))
+	if err != nil {
+		return false
+	}
+
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+func (s *Server) searchBooks(c *fiber.Ctx) error {
+	validation := ValidationError{}
+	search := BookSearch{
+		Text:   c.Query("q"),
+		Limit:  queryInt(c, "limit", &validation),
+		Offset: queryInt(c, "offset", &validation),
+		Filter: bookFilterFrom(c, &validation),
+	}
+	if err := validation.Err(); err != nil {
+		return sendBookError(c, err)
+	}
+
+	page, err := s.app.SearchBooks(search)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	response := fiber.Map{
+		"results": page.Results,
+		"total":   page.Total,
+		"facets":  fiber.Map{"authors": page.Authors, "categories": page.Categories},
+	}
+
+	books := make([]Book, 0, len(page.Results))
+	for _, result := range page.Results {
+		books = append(books, result.Book)
+	}
+	if err := s.personalize(c, response, books); err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.JSON(response)
+}
+
+// personalize adds the ids of the books the signed-in user has ordered to a
+// catalog response. Anonymous responses are left as they are.
+func (s *Server) personalize(c *fiber.Ctx, response fiber.Map, books []Book) error {
+	claims := optionalClaimsFrom(c)
+	if claims == nil {
+		return nil
+	}
+
+	purchased, err := s.app.GetPurchasedBookIDs(claims.Subject, books)
+	if err != nil {
+		return err
+	}
+	response["purchased"] = purchased
+
+	return nil
+}
+
+// bookQueryFrom reads the query string of GET /v1/books.
+func bookQueryFrom(c *fiber.Ctx) (BookQuery, error) {
+	validation := ValidationError{}
+	filter := bookFilterFrom(c, &validation)
+	query := BookQuery{
+		Limit:     queryInt(c, "limit", &validation),
+		Cursor:    c.Query("cursor"),
+		Sort:      c.Query("sort"),
+		Author:    filter.Author,
+		Category:  filter.Category,
+		Tag:       filter.Tag,
+		MinPrice:  filter.MinPrice,
+		MaxPrice:  filter.MaxPrice,
+		Available: filter.Available,
+	}
+
+	return query, validation.Err()
+}
+
+// bookFilterFrom reads the author, category, tag, minPrice, maxPrice and
+// available filters of the query string.
+func bookFilterFrom(c *fiber.Ctx, validation *ValidationError) BookFilter {
+	filter := BookFilter{Author: c.Query("author"), Category: c.Query("category"), Tag: c.Query("tag")}
+
+	for field, target := range map[string]**Price{"minPrice": &filter.MinPrice, "maxPrice": &filter.MaxPrice} {
+		if price := c.Query(field); price != "" {
+			value, err := ParsePrice(price)
+			if err != nil {
+				validation.Add(field, err.Error())
+			}
+			*target = &value
+		}
+	}
+
+	if available := c.Query("available"); available != "" {
+		value, err := strconv.ParseBool(available)
+		if err != nil {
+			validation.Add("available", "must be true or false")
+		}
+		filter.Available = &value
+	}
+
+	return filter
+}
+
+// queryInt reads the integer query parameter key, which is 0 when absent.
+func queryInt(c *fiber.Ctx, key string, validation *ValidationError) int {
+	raw := c.Query(key)
+	if raw == "" {
+		return 0
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		validation.Add(key, "must be a number")
+	}
+
+	return value
+}
+
+func (s *Server) createBook(c *fiber.Ctx) error {
+	var request BookRequest
+	err := c.BodyParser(&request)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	book, err := s.app.CreateBook(request)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(book)
+}
+
+func (s *Server) putBook(c *fiber.Ctx) error {
+	bookID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var request BookRequest
+	err = c.BodyParser(&request)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	book, err := s.app.ReplaceBook(bookID, request)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.JSON(book)
+}
+
+func (s *Server) patchBook(c *fiber.Ctx) error {
+	bookID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var patch BookPatch
+	err = c.BodyParser(&patch)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	book, err := s.app.PatchBook(bookID, patch)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.JSON(book)
+}
+
+func (s *Server) deleteBook(c *fiber.Ctx) error {
+	bookID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = s.app.DeleteBook(bookID)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *Server) createCategory(c *fiber.Ctx) error {
+	var request CategoryRequest
+	err := c.BodyParser(&request)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	category, err := s.app.CreateCategory(request)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(category)
+}
+
+func (s *Server) putCategory(c *fiber.Ctx) error {
+	categoryID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var request CategoryRequest
+	err = c.BodyParser(&request)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	category, err := s.app.ReplaceCategory(categoryID, request)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.JSON(category)
+}
+
+func (s *Server) deleteCategory(c *fiber.Ctx) error {
+	categoryID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = s.app.DeleteCategory(categoryID)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// putTag renames a tag on every book to the Name of the body.
+func (s *Server) putTag(c *fiber.Ctx) error {
+	tag, err := url.PathUnescape(c.Params("tag"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var body struct{ Name string }
+	err = c.BodyParser(&body)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = s.app.RenameTag(tag, body.Name)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *Server) deleteTag(c *fiber.Ctx) error {
+	tag, err := url.PathUnescape(c.Params("tag"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = s.app.DeleteTag(tag)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// putBookCover takes the JPEG or PNG image as the request body.
+func (s *Server) putBookCover(c *fiber.Ctx) error {
+	bookID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	book, err := s.app.SetBookCover(bookID, c.Body())
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.JSON(book)
+}
+
+func (s *Server) deleteBookCover(c *fiber.Ctx) error {
+	bookID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = s.app.DeleteBookCover(bookID)
+	if err != nil {
+		return sendBookError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// importBooks streams a CSV or ONIX 3.0 file into the catalog. The format is
+// taken from ?format= or else from the content type.
+func (s *Server) importBooks(c *fiber.Ctx) error {
+	format := ImportFormat(c.Query("format"))
+	if format == "" {
+		switch mediaType, _, _ := strings.Cut(c.Get(fiber.HeaderContentType), ";"); strings.TrimSpace(mediaType) {
+		case "text/csv":
+			format = ImportFormatCSV
+		case fiber.MIMEApplicationXML, fiber.MIMETextXML:
+			format = ImportFormatONIX
+		}
+	}
+
+	var body io.Reader = c.Request().BodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	body = &maxBytesReader{reader: body, remaining: s.importBodyLimit}
+
+	report, err := s.app.ImportBooks(body, format)
+	if err != nil {
+		response := fiber.Map{"error": err.Error(), "report": report}
+		var validation *ValidationError
+		if errors.As(err, &validation) {
+			response["fields"] = validation.Fields
+		}
+		if errors.Is(err, fiber.ErrRequestEntityTooLarge) {
+			c.Context().SetConnectionClose()
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(response)
+		}
+		if errors.Is(err, ErrInternal) {
+			return c.Status(fiber.StatusInternalServerError).JSON(response)
+		}
+
+		return c.Status(fiber.StatusBadRequest).JSON(response)
+	}
+
+	return c.JSON(report)
+}
+
+// maxBytesReader fails with fiber.ErrRequestEntityTooLarge once more than
+// remaining bytes are read, instead of cutting the body off silently.
+type maxBytesReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, fiber.ErrRequestEntityTooLarge
+	}
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, fiber.ErrRequestEntityTooLarge
+	}
+
+	return n, err
+}
+
+func sendBookError(c *fiber.Ctx, err error) error {
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error(), "fields": validation.Fields})
+	}
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	if errors.Is(err, ErrConflict) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if errors.Is(err, ErrInternal) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+}
+
+func (s *Server) getOrders(c *fiber.Ctx) error {
+	user := c.Locals("user").(*jwt.Token)
+	userSubject, err := user.Claims.GetSubject()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	orders, err := s.app.GetOrdersByUser(userSubject)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"orders": orders})
+}
+
+func (s *Server) createOrder(c *fiber.Ctx) error {
+	user := c.Locals("user").(*jwt.Token)
+	userSubject, err := user.Claims.GetSubject()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	orderRequest := OrderRequest{}
+	err = c.BodyParser(&orderRequest)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	orderRequest.User = userSubject
+
+	order, err := s.app.CreateOrder(orderRequest)
+	if err != nil {
+		if errors.Is(err, ErrForbidden) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(order)
+}
+
+func (s *Server) getAllOrders(c *fiber.Ctx) error {
+	orders, err := s.app.GetOrders(OrderStatus(c.Query("status")))
+	if err != nil {
+		if errors.Is(err, ErrInvalid) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"orders": orders})
+}
+
+func (s *Server) patchOrder(c *fiber.Ctx) error {
+	orderID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var body struct{ Status OrderStatus }
+	err = c.BodyParser(&body)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	order, err := s.app.UpdateOrderStatus(orderID, body.Status)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, ErrInternal) {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(order)
+}
+
+func (s *Server) putUserRole(c *fiber.Ctx) error {
+	var body struct{ Role Role }
+	err := c.BodyParser(&body)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = s.app.SetUserRole(c.Params("email"), body.Role)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, ErrInternal) {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"user": c.Params("email"), "role": body.Role})
+}
+
+func (s *Server) createAPIKey(c *fiber.Ctx) error {
+	request := APIKeyRequest{}
+	err := c.BodyParser(&request)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	request.User = claimsFrom(c).Subject
+
+	apiKey, key, err := s.app.CreateAPIKey(request)
+	if err != nil {
+		var validation *ValidationError
+		if errors.As(err, &validation) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error(), "fields": validation.Fields})
+		}
+
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"apiKey": apiKey, "key": key})
+}
+
+func (s *Server) getAPIKeys(c *fiber.Ctx) error {
+	apiKeys, err := s.app.GetAPIKeys(claimsFrom(c).Subject)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"apiKeys": apiKeys})
+}
+
+func (s *Server) deleteAPIKey(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = s.app.RevokeAPIKey(claimsFrom(c).Subject, id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
 }
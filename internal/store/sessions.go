@@ -0,0 +1,62 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Session is a login on one device, from the login until logout, expiry of
+// its refresh tokens or termination from another session.
+type Session struct {
+	ID         string
+	Email      string
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	Current    bool
+}
+
+// GetSessions lists the active sessions of email, marking currentID as the
+// session of the caller.
+func (a *App) GetSessions(email, currentID string) ([]Session, error) {
+	sessions, err := getActiveSessions(a.db, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %w: %w", err, ErrInternal)
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentID
+	}
+
+	return sessions, nil
+}
+
+// TerminateSession logs out session id of email. Its refresh tokens are
+// revoked and its access tokens are rejected from now on.
+func (a *App) TerminateSession(email, id string) error {
+	err := terminateSession(a.db, email, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("session %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to terminate session: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
+
+// SeeSession records that the session of claims was just used by client.
+// Failing to record it does not fail the request.
+func (a *App) SeeSession(claims Claims, client Client) {
+	if claims.SessionID == "" {
+		return
+	}
+
+	if err := seeSession(a.db, claims.SessionID, client); err != nil {
+		log.Printf("failed to update session %s: %v", claims.SessionID, err)
+	}
+}
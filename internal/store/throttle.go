@@ -0,0 +1,171 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	throttleScopeEmail = "email"
+	throttleScopeIP    = "ip"
+)
+
+// Client describes where a request comes from.
+type Client struct {
+	IP        string
+	UserAgent string
+}
+
+// ip is the IP truncated to what a session stores.
+func (c Client) ip() string {
+	if len(c.IP) > 64 {
+		return c.IP[:64]
+	}
+
+	return c.IP
+}
+
+// userAgent is the user agent truncated to what a session stores.
+func (c Client) userAgent() string {
+	if len(c.UserAgent) > 512 {
+		return strings.ToValidUTF8(c.UserAgent[:512], "")
+	}
+
+	return c.UserAgent
+}
+
+// ThrottledError is returned while too many failed logins lock an email or IP.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed logins, retry after %s: %s", e.RetryAfter.Round(time.Second), ErrTooManyRequests)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return ErrTooManyRequests
+}
+
+// LoginThrottle allows a number of free failed logins per email and per IP,
+// after which every further failure locks the key for exponentially longer.
+// Failures older than Window are forgotten.
+type LoginThrottle struct {
+	EmailFreeAttempts int
+	IPFreeAttempts    int
+	BaseDelay         time.Duration
+	MaxDelay          time.Duration
+	Window            time.Duration
+}
+
+func NewLoginThrottle(cfg ServerConfig) LoginThrottle {
+	return LoginThrottle{
+		EmailFreeAttempts: cfg.LoginEmailFreeAttempts,
+		IPFreeAttempts:    cfg.LoginIPFreeAttempts,
+		BaseDelay:         cfg.LoginBackoffBase,
+		MaxDelay:          cfg.LoginBackoffMax,
+		Window:            cfg.LoginFailureWindow,
+	}
+}
+
+// delay returns how long a key is locked after its nth failure.
+func (t LoginThrottle) delay(failures, freeAttempts int) time.Duration {
+	if failures <= freeAttempts {
+		return 0
+	}
+
+	exponent := float64(failures - freeAttempts - 1)
+	delay := time.Duration(float64(t.BaseDelay) * math.Pow(2, exponent))
+	if delay > t.MaxDelay || delay <= 0 {
+		return t.MaxDelay
+	}
+
+	return delay
+}
+
+func (t LoginThrottle) freeAttempts(key ThrottleKey) int {
+	if key.Scope == throttleScopeIP {
+		return t.IPFreeAttempts
+	}
+
+	return t.EmailFreeAttempts
+}
+
+// claimLoginAttempt fails with a ThrottledError when the email or the IP is
+// locked, before any password hash is computed. Otherwise the attempt counts
+// as failed right away, checked and counted in one step so that parallel
+// guesses cannot all get in before the lock. Attempts that turn out right
+// are taken back with releaseLoginAttempt or recordLoginSuccess.
+func (a *App) claimLoginAttempt(email string, client Client) error {
+	keys := throttleKeys(email, client)
+	for i, key := range keys {
+		freeAttempts := a.loginThrottle.freeAttempts(key)
+		lockedUntil, err := claimLoginThrottle(a.db, key, a.loginThrottle.Window, func(failures int) time.Duration {
+			return a.loginThrottle.delay(failures, freeAttempts)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to claim login attempt: %w: %w", err, ErrInternal)
+		}
+
+		if retryAfter := time.Until(lockedUntil); retryAfter > 0 {
+			// The keys claimed so far did not get their attempt either.
+			if err := a.releaseLoginKeys(keys[:i]); err != nil {
+				return err
+			}
+
+			return &ThrottledError{RetryAfter: retryAfter}
+		}
+	}
+
+	return nil
+}
+
+// releaseLoginAttempt takes back an attempt claimed by claimLoginAttempt
+// that did not fail, such as a right password still awaiting the second
+// factor.
+func (a *App) releaseLoginAttempt(email string, client Client) error {
+	return a.releaseLoginKeys(throttleKeys(email, client))
+}
+
+func (a *App) releaseLoginKeys(keys []ThrottleKey) error {
+	for _, key := range keys {
+		if err := releaseLoginThrottle(a.db, key, a.loginThrottle.freeAttempts(key)); err != nil {
+			return fmt.Errorf("failed to release login attempt: %w: %w", err, ErrInternal)
+		}
+	}
+
+	return nil
+}
+
+// recordLoginSuccess forgets the failures of the email. Failures of the IP
+// are kept, otherwise an attacker could reset them with an account of their
+// own; only the attempt claimed for this login is taken back.
+func (a *App) recordLoginSuccess(email string, client Client) error {
+	keys := throttleKeys(email, client)
+	if err := resetLoginFailures(a.db, keys[0]); err != nil {
+		return fmt.Errorf("failed to reset login failures: %w: %w", err, ErrInternal)
+	}
+
+	return a.releaseLoginKeys(keys[1:])
+}
+
+type ThrottleKey struct {
+	Scope string
+	Key   string
+}
+
+func throttleKeys(email string, client Client) []ThrottleKey {
+	email = strings.ToLower(email)
+	if len(email) > 255 {
+		email = strings.ToValidUTF8(email[:255], "")
+	}
+
+	keys := []ThrottleKey{{Scope: throttleScopeEmail, Key: email}}
+	if client.IP != "" {
+		keys = append(keys, ThrottleKey{Scope: throttleScopeIP, Key: client.ip()})
+	}
+
+	return keys
+}
@@ -0,0 +1,268 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	recoveryCodeCount = 10
+	purposeMFA        = "mfa-challenge"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
+}
+
+// LoginResult is either a set of tokens or, for accounts with two-factor
+// authentication, a challenge that has to be completed with VerifyMFA.
+type LoginResult struct {
+	Tokens       Tokens
+	MFAChallenge string
+	MFAExpiresAt time.Time
+}
+
+func (r LoginResult) MFARequired() bool {
+	return r.MFAChallenge != ""
+}
+
+// EnrollTOTP generates a new secret for email. It only takes effect once a
+// code generated from it is confirmed with ConfirmTOTP.
+func (a *App) EnrollTOTP(email string) (TOTPEnrollment, error) {
+	login, err := getLoginByEmail(a.db, email)
+	if err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("failed to get login: %w: %w", err, ErrInternal)
+	}
+	if login.TOTPEnabledAt != nil {
+		return TOTPEnrollment{}, fmt.Errorf("two-factor authentication already enabled: %w", ErrConflict)
+	}
+
+	secret := make([]byte, 20)
+	_, err = rand.Read(secret)
+	if err != nil {
+		panic(err)
+	}
+	encoded := totpEncoding.EncodeToString(secret)
+
+	if err := setLoginTOTPSecret(a.db, email, encoded); err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("failed to store totp secret: %w: %w", err, ErrInternal)
+	}
+
+	label := url.PathEscape(a.totpIssuer + ":" + email)
+	query := url.Values{}
+	query.Set("secret", encoded)
+	query.Set("issuer", a.totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	return TOTPEnrollment{
+		Secret: encoded,
+		URI:    "otpauth://totp/" + label + "?" + query.Encode(),
+	}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication when code matches the secret
+// from EnrollTOTP and returns single-use recovery codes, which are only
+// stored hashed and cannot be shown again.
+func (a *App) ConfirmTOTP(email, code string) ([]string, error) {
+	login, err := getLoginByEmail(a.db, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login: %w: %w", err, ErrInternal)
+	}
+	if login.TOTPEnabledAt != nil {
+		return nil, fmt.Errorf("two-factor authentication already enabled: %w", ErrConflict)
+	}
+	if login.TOTPSecret == "" {
+		return nil, fmt.Errorf("two-factor authentication not enrolled: %w", ErrInvalid)
+	}
+
+	if err := a.useTOTPCode(login, code); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+
+	if err := enableLoginTOTP(a.db, email, hashes); err != nil {
+		return nil, fmt.Errorf("failed to enable totp: %w: %w", err, ErrInternal)
+	}
+
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off after checking a current
+// code or a recovery code.
+func (a *App) DisableTOTP(email, code string) error {
+	login, err := getLoginByEmail(a.db, email)
+	if err != nil {
+		return fmt.Errorf("failed to get login: %w: %w", err, ErrInternal)
+	}
+	if login.TOTPEnabledAt == nil {
+		return fmt.Errorf("two-factor authentication not enabled: %w", ErrInvalid)
+	}
+
+	if err := a.useSecondFactor(login, code); err != nil {
+		return err
+	}
+
+	if err := disableLoginTOTP(a.db, email); err != nil {
+		return fmt.Errorf("failed to disable totp: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
+
+// VerifyMFA completes a login started by LoginUser with a TOTP or recovery
+// code. Wrong codes count as failed logins.
+func (a *App) VerifyMFA(challenge, code string, client Client) (Tokens, error) {
+	payload, err := a.verifySignedToken(purposeMFA, challenge)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("invalid mfa challenge: %w: %w", err, ErrUnauthorized)
+	}
+
+	if err := a.claimLoginAttempt(payload.Subject, client); err != nil {
+		return Tokens{}, err
+	}
+
+	login, err := getLoginByEmail(a.db, payload.Subject)
+	if err != nil || login.TOTPEnabledAt == nil {
+		return Tokens{}, fmt.Errorf("mfa failed: %w", ErrUnauthorized)
+	}
+
+	if err := a.useSecondFactor(login, code); err != nil {
+		// Only wrong codes count as failed logins.
+		if !errors.Is(err, ErrUnauthorized) {
+			if err := a.releaseLoginAttempt(payload.Subject, client); err != nil {
+				log.Printf("failed to release login attempt of %s: %v", payload.Subject, err)
+			}
+		}
+
+		return Tokens{}, err
+	}
+
+	if err := a.recordLoginSuccess(payload.Subject, client); err != nil {
+		return Tokens{}, err
+	}
+
+	return a.issueTokens(login, client)
+}
+
+func (a *App) newMFAChallenge(login Login) LoginResult {
+	expiresAt := time.Now().Add(a.mfaChallengeTTL)
+
+	return LoginResult{
+		MFAChallenge: a.signToken(signedPayload{
+			Purpose:   purposeMFA,
+			Subject:   login.Email,
+			ExpiresAt: expiresAt.Unix(),
+		}),
+		MFAExpiresAt: expiresAt,
+	}
+}
+
+// useSecondFactor accepts either a TOTP code or an unused recovery code.
+func (a *App) useSecondFactor(login Login, code string) error {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) == totpDigits {
+		return a.useTOTPCode(login, code)
+	}
+
+	err := useRecoveryCode(a.db, login.Email, hashToken(normalizeRecoveryCode(code)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("invalid code: %w", ErrUnauthorized)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to use recovery code: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
+
+// useTOTPCode checks code against the current time step and its neighbours
+// and remembers the step, so a code cannot be replayed.
+func (a *App) useTOTPCode(login Login, code string) error {
+	secret, err := totpEncoding.DecodeString(login.TOTPSecret)
+	if err != nil {
+		return fmt.Errorf("invalid totp secret: %w: %w", err, ErrInternal)
+	}
+
+	step, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return fmt.Errorf("invalid code: %w", ErrUnauthorized)
+	}
+
+	err = advanceLoginTOTPStep(a.db, login.Email, step)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("code already used: %w", ErrUnauthorized)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store totp step: %w: %w", err, ErrInternal)
+	}
+
+	return nil
+}
+
+func validateTOTP(secret []byte, code string, now time.Time) (step int64, ok bool) {
+	current := now.Unix() / totpPeriod
+	for offset := int64(-totpSkew); offset <= totpSkew; offset++ {
+		expected := hotp(secret, current+offset)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return current + offset, true
+		}
+	}
+
+	return 0, false
+}
+
+// hotp is the RFC 4226 one-time password of counter, which RFC 6238 feeds
+// with the number of periods since the epoch.
+func hotp(secret []byte, counter int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+func newRecoveryCode() string {
+	code := make([]byte, 5)
+	_, err := rand.Read(code)
+	if err != nil {
+		panic(err)
+	}
+	encoded := totpEncoding.EncodeToString(code)
+
+	return encoded[:4] + "-" + encoded[4:]
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
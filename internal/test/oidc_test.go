@@ -0,0 +1,516 @@
+package test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"bookstore.example/store/internal/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcClientID     = "bookstore"
+	oidcClientSecret = "bookstore-secret"
+)
+
+// mockOIDCProvider is an identity provider that signs in whoever it is told
+// to, so the login flow can be tested without a real provider.
+type mockOIDCProvider struct {
+	server  *httptest.Server
+	private ed25519.PrivateKey
+
+	mu       sync.Mutex
+	subject  string
+	email    string
+	verified bool
+	codes    map[string]url.Values
+}
+
+func newMockOIDCProvider() *mockOIDCProvider {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	p := &mockOIDCProvider{private: private, codes: map[string]url.Values{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+
+	return p
+}
+
+func (p *mockOIDCProvider) config() store.OIDCProviderConfig {
+	return store.OIDCProviderConfig{
+		Name:         "mock",
+		Issuer:       p.server.URL,
+		ClientID:     oidcClientID,
+		ClientSecret: oidcClientSecret,
+		RedirectURL:  "http://localhost/v1/oidc/mock/callback",
+		Scopes:       []string{"openid", "email"},
+	}
+}
+
+func (p *mockOIDCProvider) signIn(subject, email string, verified bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.subject, p.email, p.verified = subject, email, verified
+}
+
+func (p *mockOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 p.server.URL,
+		"authorization_endpoint": p.server.URL + "/authorize",
+		"token_endpoint":         p.server.URL + "/token",
+		"jwks_uri":               p.server.URL + "/jwks",
+	})
+}
+
+func (p *mockOIDCProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	public := p.private.Public().(ed25519.PublicKey)
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   base64.RawURLEncoding.EncodeToString(public),
+			"kid": "mock",
+			"alg": "EdDSA",
+			"use": "sig",
+		}},
+	})
+}
+
+// authorize signs in the current user immediately and redirects back with a code.
+func (p *mockOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	query := r.URL.Query()
+	code := randomCode()
+	p.codes[code] = url.Values{
+		"subject":        {p.subject},
+		"email":          {p.email},
+		"verified":       {map[bool]string{true: "true", false: "false"}[p.verified]},
+		"nonce":          {query.Get("nonce")},
+		"code_challenge": {query.Get("code_challenge")},
+		"redirect_uri":   {query.Get("redirect_uri")},
+	}
+
+	redirect := query.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	grant, ok := p.codes[r.FormValue("code")]
+	delete(p.codes, r.FormValue("code"))
+	p.mu.Unlock()
+
+	clientID, clientSecret, _ := r.BasicAuth()
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok ||
+		clientID != oidcClientID ||
+		clientSecret != oidcClientSecret ||
+		r.FormValue("redirect_uri") != grant.Get("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != grant.Get("code_challenge") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+		"iss":            p.server.URL,
+		"sub":            grant.Get("subject"),
+		"aud":            oidcClientID,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          grant.Get("nonce"),
+		"email":          grant.Get("email"),
+		"email_verified": grant.Get("verified") == "true",
+	})
+	token.Header["kid"] = "mock"
+
+	idToken, err := token.SignedString(p.private)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": randomCode(),
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func randomCode() string {
+	code := make([]byte, 16)
+	rand.Read(code)
+
+	return hex.EncodeToString(code)
+}
+
+// oidcLogin follows the whole authorization code flow with the mock provider
+// and returns the response of the callback.
+func (s *StoreTestSuite) oidcLogin() *http.Response {
+	rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/oidc/mock/authorize", nil))
+	s.Require().Equal(302, rsp.StatusCode)
+
+	return s.oidcCallback(rsp.Header.Get("Location"), rsp.Cookies())
+}
+
+// oidcCallback is oidcRedirect followed by redeeming the code the callback
+// redirects to the frontend with, as the frontend would. It returns the
+// response of the callback when it fails and of the redemption otherwise.
+func (s *StoreTestSuite) oidcCallback(authorizationURL string, cookies []*http.Cookie) *http.Response {
+	rsp := s.oidcRedirect(authorizationURL, cookies)
+	if rsp.StatusCode != 302 {
+		return rsp
+	}
+
+	return s.redeemOIDCLogin(rsp)
+}
+
+func (s *StoreTestSuite) redeemOIDCLogin(callbackRsp *http.Response) *http.Response {
+	loginURL, err := url.Parse(callbackRsp.Header.Get("Location"))
+	s.Require().NoError(err)
+
+	req := httptest.NewRequest(
+		"POST",
+		"/v1/oidc/token",
+		strings.NewReader(`{"token": "`+loginURL.Query().Get("token")+`"}`),
+	)
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, _ := s.server.Test(req)
+
+	return rsp
+}
+
+// oidcRedirect signs in at the authorization URL of the mock provider and
+// returns the response of the callback it redirects to, sent with the
+// cookies the flow was started with.
+func (s *StoreTestSuite) oidcRedirect(authorizationURL string, cookies []*http.Cookie) *http.Response {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	providerRsp, err := client.Get(authorizationURL)
+	s.Require().NoError(err)
+	s.Require().Equal(302, providerRsp.StatusCode)
+
+	callback, err := url.Parse(providerRsp.Header.Get("Location"))
+	s.Require().NoError(err)
+
+	req := httptest.NewRequest("GET", "/v1/oidc/mock/callback?"+callback.RawQuery, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	rsp, _ := s.server.Test(req)
+
+	return rsp
+}
+
+func (s *StoreTestSuite) TestOIDC() {
+	s.db.Exec("DELETE FROM external_identities WHERE provider = 'mock'")
+	s.db.Exec("DELETE FROM logins WHERE email IN ('oidc@domain.example', 'oidc-unverified@domain.example')")
+
+	s.Run("authorize with unknown provider, expect 404", func() {
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/oidc/unknown/authorize", nil))
+
+		s.Equal(404, rsp.StatusCode)
+	})
+
+	s.Run("authorize, expect redirect with pkce challenge", func() {
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/oidc/mock/authorize", nil))
+
+		s.Require().Equal(302, rsp.StatusCode)
+
+		location, err := url.Parse(rsp.Header.Get("Location"))
+		s.Require().NoError(err)
+		s.Equal(s.oidc.server.URL+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+		s.Equal(oidcClientID, location.Query().Get("client_id"))
+		s.Equal("S256", location.Query().Get("code_challenge_method"))
+		s.NotEmpty(location.Query().Get("state"))
+		s.NotEmpty(location.Query().Get("nonce"))
+	})
+
+	s.Run("authorize, expect http only binding cookie for the callback", func() {
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/oidc/mock/authorize", nil))
+
+		s.Require().Equal(302, rsp.StatusCode)
+		s.Require().Len(rsp.Cookies(), 1)
+		s.True(rsp.Cookies()[0].HttpOnly)
+		s.Equal(http.SameSiteLaxMode, rsp.Cookies()[0].SameSite)
+		s.Equal("/v1/oidc", rsp.Cookies()[0].Path)
+	})
+
+	s.Run("callback with unknown state, expect 401", func() {
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/oidc/mock/callback?code=abc&state=unknown", nil))
+
+		s.Equal(401, rsp.StatusCode)
+	})
+
+	s.Run("callback in another browser than the one that authorized, expect 401", func() {
+		s.oidc.signIn("subject-1", "oidc@domain.example", true)
+
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/oidc/mock/authorize", nil))
+		s.Require().Equal(302, rsp.StatusCode)
+
+		rsp = s.oidcCallback(rsp.Header.Get("Location"), nil)
+
+		s.Equal(401, rsp.StatusCode)
+
+		var count int
+		s.db.QueryRow("SELECT COUNT(*) FROM logins WHERE email = 'oidc@domain.example'").Scan(&count)
+		s.Equal(0, count)
+	})
+
+	s.Run("login with unverified provider email, expect 403", func() {
+		s.oidc.signIn("subject-unverified", "oidc-unverified@domain.example", false)
+
+		rsp := s.oidcLogin()
+
+		s.Equal(403, rsp.StatusCode)
+	})
+
+	s.Run("login with new identity, expect token for verified login", func() {
+		s.oidc.signIn("subject-1", "oidc@domain.example", true)
+
+		rsp := s.oidcLogin()
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var body struct{ Token string }
+		json.NewDecoder(rsp.Body).Decode(&body)
+		s.NotEmpty(body.Token)
+
+		var verifiedAt *time.Time
+		s.db.QueryRow("SELECT verified_at FROM logins WHERE email = 'oidc@domain.example'").Scan(&verifiedAt)
+		s.NotNil(verifiedAt)
+	})
+
+	s.Run("login, expect redirect to the frontend with a code that works once", func() {
+		s.oidc.signIn("subject-1", "oidc@domain.example", true)
+
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/oidc/mock/authorize", nil))
+		s.Require().Equal(302, rsp.StatusCode)
+
+		callbackRsp := s.oidcRedirect(rsp.Header.Get("Location"), rsp.Cookies())
+
+		s.Require().Equal(302, callbackRsp.StatusCode)
+		s.Equal("no-store", callbackRsp.Header.Get("Cache-Control"))
+		s.True(strings.HasPrefix(callbackRsp.Header.Get("Location"), "http://localhost:3000/oidc-login?token="))
+
+		s.Equal(200, s.redeemOIDCLogin(callbackRsp).StatusCode)
+		s.Equal(401, s.redeemOIDCLogin(callbackRsp).StatusCode)
+	})
+
+	s.Run("login with linked identity after email changed, expect same login", func() {
+		s.oidc.signIn("subject-1", "changed@domain.example", true)
+
+		rsp := s.oidcLogin()
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var count int
+		s.db.QueryRow("SELECT COUNT(*) FROM logins WHERE email = 'changed@domain.example'").Scan(&count)
+		s.Equal(0, count)
+	})
+
+	s.Run("login with password of oidc login, expect 401", func() {
+		req := httptest.NewRequest("POST", "/v1/login", nil)
+		basicAuth := base64.StdEncoding.EncodeToString([]byte("oidc@domain.example:!"))
+		req.Header.Set("Authorization", "Basic "+basicAuth)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(401, rsp.StatusCode)
+	})
+}
+
+func (s *StoreTestSuite) TestOIDCLinking() {
+	s.db.Exec("DELETE FROM external_identities WHERE provider = 'mock' AND subject LIKE 'subject-link%'")
+	s.db.Exec("DELETE FROM logins WHERE email IN ('oidc-taken@domain.example', 'oidc-link@domain.example')")
+
+	s.registerAndLogin("oidc-taken@domain.example", "Strong-Pass-1")
+
+	s.Run("login with email of unverified password login, expect 409 and login untouched", func() {
+		var hash string
+		s.db.QueryRow("SELECT hash FROM logins WHERE email = 'oidc-taken@domain.example'").Scan(&hash)
+
+		s.oidc.signIn("subject-link-1", "oidc-taken@domain.example", true)
+
+		rsp := s.oidcLogin()
+
+		s.Equal(409, rsp.StatusCode)
+
+		var linked int
+		s.db.QueryRow("SELECT COUNT(*) FROM external_identities WHERE subject = 'subject-link-1'").Scan(&linked)
+		s.Equal(0, linked)
+
+		var after string
+		var verifiedAt *time.Time
+		s.db.QueryRow("SELECT hash, verified_at FROM logins WHERE email = 'oidc-taken@domain.example'").Scan(&after, &verifiedAt)
+		s.Equal(hash, after)
+		s.Nil(verifiedAt)
+	})
+
+	s.Run("link identity while logged in, expect login linked whatever the provider email", func() {
+		token := s.registerAndLogin("oidc-link@domain.example", "Strong-Pass-1")
+
+		req := httptest.NewRequest("POST", "/v1/oidc/mock/link", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var body struct{ URL string }
+		json.NewDecoder(rsp.Body).Decode(&body)
+
+		s.oidc.signIn("subject-link-2", "elsewhere@domain.example", false)
+
+		rsp = s.oidcCallback(body.URL, rsp.Cookies())
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var email string
+		s.db.QueryRow("SELECT email FROM external_identities WHERE subject = 'subject-link-2'").Scan(&email)
+		s.Equal("oidc-link@domain.example", email)
+	})
+
+	s.Run("link identity after the session that started linking ended, expect 401", func() {
+		token := s.login("oidc-link@domain.example", "Strong-Pass-1")
+
+		req := httptest.NewRequest("POST", "/v1/oidc/mock/link", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var body struct{ URL string }
+		json.NewDecoder(rsp.Body).Decode(&body)
+		cookies := rsp.Cookies()
+
+		req = httptest.NewRequest("POST", "/v1/logout", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rsp, _ = s.server.Test(req)
+		s.Require().Equal(204, rsp.StatusCode)
+
+		s.oidc.signIn("subject-link-3", "elsewhere@domain.example", false)
+
+		rsp = s.oidcCallback(body.URL, cookies)
+
+		s.Equal(401, rsp.StatusCode)
+
+		var linked int
+		s.db.QueryRow("SELECT COUNT(*) FROM external_identities WHERE subject = 'subject-link-3'").Scan(&linked)
+		s.Equal(0, linked)
+	})
+
+	s.Run("login with explicitly linked identity, expect 200", func() {
+		s.oidc.signIn("subject-link-2", "elsewhere@domain.example", false)
+
+		rsp := s.oidcLogin()
+
+		s.Equal(200, rsp.StatusCode)
+	})
+
+	s.Run("link identity linked to another login, expect 409", func() {
+		token := s.login("oidc-taken@domain.example", "Strong-Pass-1")
+
+		req := httptest.NewRequest("POST", "/v1/oidc/mock/link", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var body struct{ URL string }
+		json.NewDecoder(rsp.Body).Decode(&body)
+
+		s.oidc.signIn("subject-link-2", "elsewhere@domain.example", false)
+
+		rsp = s.oidcCallback(body.URL, rsp.Cookies())
+
+		s.Equal(409, rsp.StatusCode)
+	})
+}
+
+func (s *StoreTestSuite) TestOIDCReauthentication() {
+	s.db.Exec("DELETE FROM external_identities WHERE provider = 'mock' AND subject = 'subject-reauth'")
+	s.db.Exec("DELETE FROM logins WHERE email = 'oidc-reauth@domain.example'")
+
+	s.oidc.signIn("subject-reauth", "oidc-reauth@domain.example", true)
+
+	rsp := s.oidcLogin()
+
+	s.Require().Equal(200, rsp.StatusCode)
+
+	var login struct{ Token string }
+	json.NewDecoder(rsp.Body).Decode(&login)
+
+	send := func(method, target, body string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+login.Token)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		return rsp.StatusCode
+	}
+
+	reauthToken := func() string {
+		s.Require().Equal(202, send("POST", "/v1/account/reauthenticate", ""))
+
+		mail, sent := s.mailer.LastMessageTo("oidc-reauth@domain.example")
+		s.Require().True(sent)
+
+		return tokenFromMail(mail.Body)
+	}
+
+	s.Run("delete account without password, expect 400", func() {
+		s.Equal(400, send("DELETE", "/v1/account", `{"currentPassword": ""}`))
+	})
+
+	s.Run("delete account with superseded reauthentication token, expect 400", func() {
+		superseded := reauthToken()
+		reauthToken()
+
+		s.Equal(400, send("DELETE", "/v1/account", `{"reauthToken": "`+superseded+`"}`))
+	})
+
+	s.Run("set first password with reauthentication token, expect 200 and token used up", func() {
+		token := reauthToken()
+
+		s.Equal(200, send("PUT", "/v1/password", `{"reauthToken": "`+token+`", "newPassword": "Strong-Pass-1"}`))
+		s.NotEmpty(s.login("oidc-reauth@domain.example", "Strong-Pass-1"))
+
+		login.Token = s.login("oidc-reauth@domain.example", "Strong-Pass-1")
+		s.Equal(400, send("DELETE", "/v1/account", `{"reauthToken": "`+token+`"}`))
+	})
+
+	s.Run("delete account with reauthentication token, expect 204", func() {
+		s.Equal(204, send("DELETE", "/v1/account", `{"reauthToken": "`+reauthToken()+`"}`))
+	})
+}
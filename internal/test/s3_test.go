@@ -0,0 +1,162 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+
+	"bookstore.example/store/internal/infra"
+)
+
+const (
+	s3Bucket    = "bookstore"
+	s3Region    = "us-east-1"
+	s3AccessKey = "test-access-key"
+	s3SecretKey = "test-secret-key"
+)
+
+type s3Object struct {
+	ContentType string
+	Data        []byte
+}
+
+// mockS3 is an S3 compatible object store keeping one bucket in memory. It
+// checks Signature Version 4 like S3 does and serves objects publicly.
+type mockS3 struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]s3Object
+}
+
+func newMockS3() *mockS3 {
+	m := &mockS3{objects: map[string]s3Object{}}
+	m.server = httptest.NewServer(http.HandlerFunc(m.serve))
+
+	return m
+}
+
+func (m *mockS3) config() *infra.BlobConfig {
+	return &infra.BlobConfig{
+		Backend:     "s3",
+		S3Endpoint:  m.server.URL,
+		S3Region:    s3Region,
+		S3Bucket:    s3Bucket,
+		S3AccessKey: s3AccessKey,
+		S3SecretKey: s3SecretKey,
+	}
+}
+
+func (m *mockS3) object(key string) (s3Object, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	object, ok := m.objects[key]
+	return object, ok
+}
+
+func (m *mockS3) serve(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+s3Bucket+"/")
+	if !ok {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		object, ok := m.object(key)
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", object.ContentType)
+		w.Write(object.Data)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	if !m.verify(r, body) {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		m.objects[key] = s3Object{ContentType: r.Header.Get("Content-Type"), Data: body}
+	case http.MethodDelete:
+		delete(m.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// verify recomputes the signature of r from the headers it claims to sign.
+// The signer itself is checked against the examples of AWS in infra.
+func (m *mockS3) verify(r *http.Request, body []byte) bool {
+	authorization, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return false
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(authorization, ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+
+	payloadHash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payloadHash[:]) {
+		return false
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) != len("20060102T150405Z") {
+		return false
+	}
+	scope := amzDate[:8] + "/" + s3Region + "/s3/aws4_request"
+	if fields["Credential"] != s3AccessKey+"/"+scope {
+		return false
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signed) {
+		return false
+	}
+	canonical := ""
+	for _, name := range signed {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonical += name + ":" + value + "\n"
+	}
+
+	request := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		canonical,
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(request))
+
+	key := []byte("AWS4" + s3SecretKey)
+	for _, part := range []string{amzDate[:8], s3Region, "s3", "aws4_request"} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])))
+
+	return hmac.Equal([]byte(fields["Signature"]), []byte(hex.EncodeToString(mac.Sum(nil))))
+}
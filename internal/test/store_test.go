@@ -1,47 +1,82 @@
 package test
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha1"
 	"database/sql"
+	"encoding/base32"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"bookstore.example/store/internal/infra"
 	"bookstore.example/store/internal/store"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/argon2"
 )
 
 type StoreTestSuite struct {
 	suite.Suite
 	server  *store.Server
 	secrets store.Secrets
+	mailer  *infra.MemoryMailer
 	db      *sql.DB
+	oidc    *mockOIDCProvider
+	s3      *mockS3
 }
 
 type testSecret struct{}
 
+const retiredAuthKey = "0B7E6F4F5C3C2A1D9E8F7A6B5C4D3E2F1A0B9C8D7E6F5A4B3C2D1E0F9A8B7C6D"
+
 func (s *testSecret) GetAuthKey() string {
 	return "64D4D1E3ABE3C7A2EB09305A1C8A7B896110674735C671E5586D968ED0561415"
 }
 
+func (s *testSecret) GetRetiredAuthKeys() map[string]time.Time {
+	return map[string]time.Time{retiredAuthKey: time.Now().Add(time.Hour)}
+}
+
 func (s *StoreTestSuite) SetupSuite() {
 	godotenv.Load("../../.env")
 
 	s.secrets = &testSecret{}
+	s.mailer = infra.NewMemoryMailer()
 
 	dbCfg := infra.ParsePostgresDBConfig()
 	s.T().Logf("dbCfg: %+v", dbCfg)
 	s.db = infra.NewDB(infra.ParsePostgresDBConfig())
 	infra.Migrate(s.db, "../../migrations/storedb")
+	s.db.Exec("DELETE FROM login_throttles")
+
+	s.oidc = newMockOIDCProvider()
+	s.s3 = newMockS3()
 
 	cfg := store.ParseServerConfig()
-	server := store.NewServer(cfg, s.secrets, s.db)
+	cfg.OIDC = []store.OIDCProviderConfig{s.oidc.config()}
+	server := store.NewServer(cfg, s.secrets, s.db, s.mailer, infra.NewS3BlobStore(s.s3.config()))
 	s.server = &server
 
 	go s.server.Start()
@@ -49,15 +84,83 @@ func (s *StoreTestSuite) SetupSuite() {
 
 func (s *StoreTestSuite) TearDownSuite() {
 	s.server.Stop()
+	s.oidc.server.Close()
+	s.s3.server.Close()
 	s.db.Close()
 }
 
+func (s *StoreTestSuite) TestPublicCatalog() {
+	s.db.Exec("DELETE FROM order_items WHERE \"user\" = 'pia@domain.example'")
+	s.db.Exec("DELETE FROM orders WHERE \"user\" = 'pia@domain.example'")
+	s.db.Exec("DELETE FROM logins WHERE email = 'pia@domain.example'")
+	s.db.Exec("DELETE FROM books WHERE author = 'Public Author'")
+	s.db.Exec(`INSERT INTO books (title, author, price) VALUES
+        ('Public One', 'Public Author', 10.00),
+        ('Public Two', 'Public Author', 20.00)`)
+
+	var purchasedID int
+	s.db.QueryRow("SELECT id FROM books WHERE title = 'Public Two'").Scan(&purchasedID)
+	s.db.Exec(`WITH o AS (
+            INSERT INTO orders ("user", date, status) VALUES ('pia@domain.example', NOW(), 'paid') RETURNING id
+        )
+        INSERT INTO order_items ("user", order_id, book_id, quantity) SELECT 'pia@domain.example', id, $1, 1 FROM o`, purchasedID)
+
+	token := s.registerAndLogin("pia@domain.example", "Strong-Pass-1")
+
+	type page struct {
+		Books     []store.Book
+		Purchased []int
+	}
+	getBooks := func(path, token string) (*http.Response, page) {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rsp, _ := s.server.Test(req)
+
+		var body page
+		json.NewDecoder(rsp.Body).Decode(&body)
+
+		return rsp, body
+	}
+
+	s.Run("browse anonymously, expect books without personalization", func() {
+		rsp, body := getBooks("/v1/books?author=public", "")
+
+		s.Require().Equal(200, rsp.StatusCode)
+		s.Len(body.Books, 2)
+		s.Nil(body.Purchased)
+		s.Equal("60", rsp.Header.Get("X-RateLimit-Limit"))
+	})
+
+	s.Run("search anonymously, expect 200", func() {
+		rsp, _ := getBooks("/v1/books/search?q=public", "")
+
+		s.Equal(200, rsp.StatusCode)
+	})
+
+	s.Run("browse signed in, expect purchased books and user rate limit", func() {
+		rsp, body := getBooks("/v1/books?author=public", token)
+
+		s.Require().Equal(200, rsp.StatusCode)
+		s.Equal([]int{purchasedID}, body.Purchased)
+		s.Equal("300", rsp.Header.Get("X-RateLimit-Limit"))
+	})
+
+	s.Run("browse with invalid token, expect 401", func() {
+		rsp, _ := getBooks("/v1/books", "invalid")
+
+		s.Equal(401, rsp.StatusCode)
+	})
+}
+
 func (s *StoreTestSuite) TestRegistration() {
 	s.Run("register a new user without email, expect 400", func() {
 		req := httptest.NewRequest(
 			"POST",
 			"/v1/users",
-			strings.NewReader(`{"password": "password"}`),
+			strings.NewReader(`{"password": "Strong-Pass-1"}`),
 		)
 		req.Header.Set("Content-Type", "application/json")
 
@@ -83,7 +186,37 @@ func (s *StoreTestSuite) TestRegistration() {
 		req := httptest.NewRequest(
 			"POST",
 			"/v1/users",
-			strings.NewReader(`{"email": "invalid", "password": "password"}`),
+			strings.NewReader(`{"email": "invalid", "password": "Strong-Pass-1"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(400, rsp.StatusCode)
+	})
+
+	s.Run("register a new user with weak password, expect 400 with field details", func() {
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/users",
+			strings.NewReader(`{"email": "email@domain.example", "password": "password"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(400, rsp.StatusCode)
+
+		var rspBody struct{ Fields map[string][]string }
+		json.NewDecoder(rsp.Body).Decode(&rspBody)
+		s.NotEmpty(rspBody.Fields["password"])
+	})
+
+	s.Run("register a new user with email as password, expect 400", func() {
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/users",
+			strings.NewReader(`{"email": "email@domain.example", "password": "Email@Domain.example"}`),
 		)
 		req.Header.Set("Content-Type", "application/json")
 
@@ -98,7 +231,7 @@ func (s *StoreTestSuite) TestRegistration() {
 		req := httptest.NewRequest(
 			"POST",
 			"/v1/users",
-			strings.NewReader(`{"email": "email@domain.example", "password": "password"}`),
+			strings.NewReader(`{"email": "email@domain.example", "password": "Strong-Pass-1"}`),
 		)
 		req.Header.Set("Content-Type", "application/json")
 
@@ -111,7 +244,7 @@ func (s *StoreTestSuite) TestRegistration() {
 		req := httptest.NewRequest(
 			"POST",
 			"/v1/users",
-			strings.NewReader(`{"email": "email@domain.example", "password": "password"}`),
+			strings.NewReader(`{"email": "email@domain.example", "password": "Strong-Pass-1"}`),
 		)
 		req.Header.Set("Content-Type", "application/json")
 
@@ -136,7 +269,7 @@ func (s *StoreTestSuite) TestLogin() {
 			nil,
 		)
 		req.Header.Set("Content-Type", "application/json")
-		basicAuth := base64.StdEncoding.EncodeToString([]byte("budi@domain.example:password1"))
+		basicAuth := base64.StdEncoding.EncodeToString([]byte("budi@domain.example:budi-Reads-42"))
 		req.Header.Set("Authorization", "Basic "+basicAuth)
 
 		rsp, _ := s.server.Test(req)
@@ -147,7 +280,7 @@ func (s *StoreTestSuite) TestLogin() {
 	req := httptest.NewRequest(
 		"POST",
 		"/v1/users",
-		strings.NewReader(`{"email": "budi@domain.example", "password": "password1"}`),
+		strings.NewReader(`{"email": "budi@domain.example", "password": "budi-Reads-42"}`),
 	)
 	req.Header.Set("Content-Type", "application/json")
 
@@ -163,7 +296,7 @@ func (s *StoreTestSuite) TestLogin() {
 		)
 
 		req.Header.Set("Content-Type", "application/json")
-		basicAuth := base64.StdEncoding.EncodeToString([]byte("budi@domain.example:password1"))
+		basicAuth := base64.StdEncoding.EncodeToString([]byte("budi@domain.example:budi-Reads-42"))
 		req.Header.Set("Authorization", "Basic "+basicAuth)
 
 		rsp, _ := s.server.Test(req)
@@ -186,7 +319,7 @@ func (s *StoreTestSuite) TestLogin() {
 			nil,
 		)
 		req.Header.Set("Content-Type", "application/json")
-		basicAuth := base64.StdEncoding.EncodeToString([]byte("budi@domain.example:password2"))
+		basicAuth := base64.StdEncoding.EncodeToString([]byte("budi@domain.example:budi-Reads-43"))
 		req.Header.Set("Authorization", "Basic "+basicAuth)
 
 		rsp, _ := s.server.Test(req)
@@ -196,18 +329,26 @@ func (s *StoreTestSuite) TestLogin() {
 }
 
 func (s *StoreTestSuite) TestOrders() {
-	s.Run("get books without token, expect 401", func() {
+	s.Run("get books without token, expect 200", func() {
 		req := httptest.NewRequest("GET", "/v1/books", nil)
 		req.Header.Set("Content-Type", "application/json")
 		rsp, _ := s.server.Test(req)
 
+		s.Equal(200, rsp.StatusCode)
+	})
+
+	s.Run("get orders without token, expect 401", func() {
+		req := httptest.NewRequest("GET", "/v1/orders", nil)
+		req.Header.Set("Content-Type", "application/json")
+		rsp, _ := s.server.Test(req)
+
 		s.Equal(401, rsp.StatusCode)
 	})
 
 	req := httptest.NewRequest(
 		"POST",
 		"/v1/users",
-		strings.NewReader(`{"email": "cahyo@domain.example", "password": "password"}`),
+		strings.NewReader(`{"email": "cahyo@domain.example", "password": "Strong-Pass-1"}`),
 	)
 	req.Header.Set("Content-Type", "application/json")
 	rsp, _ := s.server.Test(req)
@@ -218,7 +359,7 @@ func (s *StoreTestSuite) TestOrders() {
 		nil,
 	)
 	req.Header.Set("Content-Type", "application/json")
-	basicAuth := base64.StdEncoding.EncodeToString([]byte("budi@domain.example:password1"))
+	basicAuth := base64.StdEncoding.EncodeToString([]byte("budi@domain.example:budi-Reads-42"))
 	req.Header.Set("Authorization", "Basic "+basicAuth)
 
 	rsp, _ = s.server.Test(req)
@@ -246,7 +387,11 @@ func (s *StoreTestSuite) TestOrders() {
 		s.Run("expect valid books in response", func() {
 			var books struct{ Books []store.Book }
 			json.NewDecoder(rsp.Body).Decode(&books)
-			s.NotEmpty(books)
+			s.Require().NotEmpty(books.Books)
+			for _, book := range books.Books {
+				s.Positive(book.Price)
+				s.False(book.CreatedAt.IsZero())
+			}
 		})
 	})
 
@@ -282,6 +427,38 @@ func (s *StoreTestSuite) TestOrders() {
 		s.Equal(400, rsp.StatusCode)
 	})
 
+	s.Run("create order with unverified email, expect 403", func() {
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/orders",
+			strings.NewReader(`{"items": [{ "bookId": 1, "quantity": 1 }]}`),
+		)
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, err := s.server.Test(req)
+
+		s.NoError(err)
+		s.Equal(403, rsp.StatusCode)
+	})
+
+	s.Run("verify email with mailed token, expect 204", func() {
+		mail, sent := s.mailer.LastMessageTo("budi@domain.example")
+		s.Require().True(sent)
+
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/users/verify",
+			strings.NewReader(`{"token": "`+tokenFromMail(mail.Body)+`"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, err := s.server.Test(req)
+
+		s.NoError(err)
+		s.Equal(204, rsp.StatusCode)
+	})
+
 	s.Run("create order with item, expect 201", func() {
 		req := httptest.NewRequest(
 			"POST",
@@ -319,6 +496,1990 @@ func (s *StoreTestSuite) TestOrders() {
 	})
 }
 
+func (s *StoreTestSuite) TestTokens() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'dewi@domain.example'")
+
+	req := httptest.NewRequest(
+		"POST",
+		"/v1/users",
+		strings.NewReader(`{"email": "dewi@domain.example", "password": "Strong-Pass-1"}`),
+	)
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, _ := s.server.Test(req)
+
+	s.Equal(201, rsp.StatusCode)
+
+	req = httptest.NewRequest("POST", "/v1/login", nil)
+	basicAuth := base64.StdEncoding.EncodeToString([]byte("dewi@domain.example:Strong-Pass-1"))
+	req.Header.Set("Authorization", "Basic "+basicAuth)
+
+	rsp, _ = s.server.Test(req)
+
+	s.Equal(200, rsp.StatusCode)
+
+	var tokens struct {
+		Token        string
+		RefreshToken string
+	}
+	json.NewDecoder(rsp.Body).Decode(&tokens)
+	s.NotEmpty(tokens.RefreshToken)
+
+	var refreshed struct {
+		Token        string
+		RefreshToken string
+	}
+
+	s.Run("refresh with valid refresh token, expect new tokens", func() {
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/token/refresh",
+			strings.NewReader(`{"refreshToken": "`+tokens.RefreshToken+`"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(200, rsp.StatusCode)
+		json.NewDecoder(rsp.Body).Decode(&refreshed)
+		s.NotEmpty(refreshed.Token)
+		s.NotEqual(tokens.RefreshToken, refreshed.RefreshToken)
+	})
+
+	s.Run("refresh with rotated refresh token, expect 401 and session terminated", func() {
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/token/refresh",
+			strings.NewReader(`{"refreshToken": "`+tokens.RefreshToken+`"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(401, rsp.StatusCode)
+
+		req = httptest.NewRequest(
+			"POST",
+			"/v1/token/refresh",
+			strings.NewReader(`{"refreshToken": "`+refreshed.RefreshToken+`"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ = s.server.Test(req)
+
+		s.Equal(401, rsp.StatusCode)
+
+		req = httptest.NewRequest("GET", "/v1/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+refreshed.Token)
+
+		rsp, _ = s.server.Test(req)
+
+		s.Equal(401, rsp.StatusCode)
+	})
+
+	s.Run("logout, expect access token rejected afterwards", func() {
+		token := s.login("dewi@domain.example", "Strong-Pass-1")
+
+		req := httptest.NewRequest("POST", "/v1/logout", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(204, rsp.StatusCode)
+
+		req = httptest.NewRequest("GET", "/v1/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ = s.server.Test(req)
+
+		s.Equal(401, rsp.StatusCode)
+	})
+}
+
+func (s *StoreTestSuite) TestAdmin() {
+	s.db.Exec("DELETE FROM logins WHERE email IN ('eko@domain.example', 'fajar@domain.example')")
+
+	customerToken := s.registerAndLogin("eko@domain.example", "Strong-Pass-1")
+
+	s.registerAndLogin("fajar@domain.example", "Strong-Pass-1")
+	s.db.Exec("UPDATE logins SET role = 'admin' WHERE email = 'fajar@domain.example'")
+	adminToken := s.login("fajar@domain.example", "Strong-Pass-1")
+
+	s.Run("list all orders as customer, expect 403", func() {
+		req := httptest.NewRequest("GET", "/v1/admin/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+customerToken)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(403, rsp.StatusCode)
+	})
+
+	s.Run("list all orders as admin, expect 200", func() {
+		req := httptest.NewRequest("GET", "/v1/admin/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(200, rsp.StatusCode)
+	})
+
+	s.Run("promote customer to staff as admin, expect 200", func() {
+		req := httptest.NewRequest(
+			"PUT",
+			"/v1/admin/users/eko@domain.example/role",
+			strings.NewReader(`{"role": "staff"}`),
+		)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(200, rsp.StatusCode)
+
+		staffToken := s.login("eko@domain.example", "Strong-Pass-1")
+
+		req = httptest.NewRequest("GET", "/v1/admin/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+staffToken)
+
+		rsp, _ = s.server.Test(req)
+
+		s.Equal(200, rsp.StatusCode)
+	})
+
+	s.Run("set unknown role, expect 400", func() {
+		req := httptest.NewRequest(
+			"PUT",
+			"/v1/admin/users/eko@domain.example/role",
+			strings.NewReader(`{"role": "superuser"}`),
+		)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(400, rsp.StatusCode)
+	})
+}
+
+func (s *StoreTestSuite) TestPasswordReset() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'gita@domain.example'")
+
+	s.registerAndLogin("gita@domain.example", "Strong-Pass-1")
+
+	s.Run("request reset for unknown email, expect 202 and no mail", func() {
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/password/reset",
+			strings.NewReader(`{"email": "nobody@domain.example"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(202, rsp.StatusCode)
+		_, sent := s.mailer.LastMessageTo("nobody@domain.example")
+		s.False(sent)
+	})
+
+	req := httptest.NewRequest(
+		"POST",
+		"/v1/password/reset",
+		strings.NewReader(`{"email": "gita@domain.example"}`),
+	)
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, _ := s.server.Test(req)
+
+	s.Equal(202, rsp.StatusCode)
+
+	mail, sent := s.mailer.LastMessageTo("gita@domain.example")
+	s.Require().True(sent)
+	token := tokenFromMail(mail.Body)
+	s.Require().NotEmpty(token)
+
+	s.Run("confirm reset with valid token, expect 204 and new password works", func() {
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/password/reset/confirm",
+			strings.NewReader(`{"token": "`+token+`", "password": "Another-Pass-2"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(204, rsp.StatusCode)
+		s.NotEmpty(s.login("gita@domain.example", "Another-Pass-2"))
+	})
+
+	s.Run("confirm reset with used token, expect 400", func() {
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/password/reset/confirm",
+			strings.NewReader(`{"token": "`+token+`", "password": "Third-Pass-3"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(400, rsp.StatusCode)
+	})
+}
+
+// tokenFromMail extracts the token query parameter of the first link in a mail body.
+func tokenFromMail(body string) string {
+	for _, field := range strings.Fields(body) {
+		link, err := url.Parse(field)
+		if err != nil || link.Query().Get("token") == "" {
+			continue
+		}
+
+		return link.Query().Get("token")
+	}
+
+	return ""
+}
+
+func (s *StoreTestSuite) TestLoginThrottling() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'hadi@domain.example'")
+	s.db.Exec("DELETE FROM login_throttles WHERE key = 'hadi@domain.example'")
+
+	s.registerAndLogin("hadi@domain.example", "Strong-Pass-1")
+
+	basicAuth := base64.StdEncoding.EncodeToString([]byte("hadi@domain.example:Wrong-Pass-1"))
+
+	s.Run("failed logins within the free attempts, expect 401", func() {
+		for i := 0; i < 5; i++ {
+			req := httptest.NewRequest("POST", "/v1/login", nil)
+			req.Header.Set("Authorization", "Basic "+basicAuth)
+
+			rsp, _ := s.server.Test(req)
+
+			s.Equal(401, rsp.StatusCode)
+		}
+	})
+
+	s.Run("failed login after the free attempts, expect 401 then 429 with Retry-After", func() {
+		req := httptest.NewRequest("POST", "/v1/login", nil)
+		req.Header.Set("Authorization", "Basic "+basicAuth)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(401, rsp.StatusCode)
+
+		req = httptest.NewRequest("POST", "/v1/login", nil)
+		correctAuth := base64.StdEncoding.EncodeToString([]byte("hadi@domain.example:Strong-Pass-1"))
+		req.Header.Set("Authorization", "Basic "+correctAuth)
+
+		rsp, _ = s.server.Test(req)
+
+		s.Equal(429, rsp.StatusCode)
+		s.NotEmpty(rsp.Header.Get("Retry-After"))
+	})
+
+	s.db.Exec("DELETE FROM login_throttles WHERE key = 'hadi@domain.example'")
+}
+
+func (s *StoreTestSuite) TestLoginThrottlingParallel() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'ilham@domain.example'")
+	s.db.Exec("DELETE FROM login_throttles WHERE key = 'ilham@domain.example'")
+
+	s.registerAndLogin("ilham@domain.example", "Strong-Pass-1")
+
+	basicAuth := base64.StdEncoding.EncodeToString([]byte("ilham@domain.example:Wrong-Pass-1"))
+
+	s.Run("parallel failed logins, expect no more 401 than the free attempts and one more", func() {
+		statuses := make(chan int, 20)
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest("POST", "/v1/login", nil)
+				req.Header.Set("Authorization", "Basic "+basicAuth)
+
+				rsp, err := s.server.Test(req, -1)
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				statuses <- rsp.StatusCode
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+
+		unauthorized := 0
+		for status := range statuses {
+			if status == 401 {
+				unauthorized++
+			} else {
+				s.Equal(429, status)
+			}
+		}
+		s.Equal(6, unauthorized)
+	})
+
+	s.db.Exec("DELETE FROM login_throttles WHERE key = 'ilham@domain.example'")
+}
+
+func (s *StoreTestSuite) TestLegacyPasswordHash() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'indah@domain.example'")
+
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("Strong-Pass-1"), salt, 1, 64*1024, 1, 32)
+	legacyHash := base64.StdEncoding.EncodeToString(key) + "." + base64.StdEncoding.EncodeToString(salt)
+
+	_, err := s.db.Exec(
+		"INSERT INTO logins (email, hash, verified_at) VALUES ('indah@domain.example', $1, NOW())",
+		legacyHash,
+	)
+	s.Require().NoError(err)
+
+	s.Run("login with legacy hash, expect 200 and hash upgraded to PHC format", func() {
+		s.NotEmpty(s.login("indah@domain.example", "Strong-Pass-1"))
+
+		var hash string
+		s.db.QueryRow("SELECT hash FROM logins WHERE email = 'indah@domain.example'").Scan(&hash)
+		s.True(strings.HasPrefix(hash, "$argon2id$v=19$"))
+
+		s.NotEmpty(s.login("indah@domain.example", "Strong-Pass-1"))
+	})
+}
+
+func (s *StoreTestSuite) TestKeyRotation() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'joko@domain.example'")
+
+	activeToken := s.registerAndLogin("joko@domain.example", "Strong-Pass-1")
+
+	req := httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+
+	rsp, _ := s.server.Test(req)
+
+	s.Equal(200, rsp.StatusCode)
+
+	var jwks struct {
+		Keys []struct {
+			Kty string
+			Crv string
+			Kid string
+			X   string
+		}
+	}
+	json.NewDecoder(rsp.Body).Decode(&jwks)
+	s.Require().Len(jwks.Keys, 2)
+	s.Equal("OKP", jwks.Keys[0].Kty)
+	s.Equal("Ed25519", jwks.Keys[0].Crv)
+
+	s.Run("token stamped with the active kid, expect 200", func() {
+		header, _ := base64.RawURLEncoding.DecodeString(strings.Split(activeToken, ".")[0])
+		s.Contains(string(header), jwks.Keys[0].Kid)
+
+		req := httptest.NewRequest("GET", "/v1/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+activeToken)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(200, rsp.StatusCode)
+	})
+
+	s.Run("token signed with a retired key that has not expired, expect 200", func() {
+		seed, _ := hex.DecodeString(retiredAuthKey)
+		now := time.Now()
+		token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, store.Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        "retired-key-token",
+				Issuer:    "gotu",
+				Audience:  jwt.ClaimStrings{"bookstore"},
+				Subject:   "joko@domain.example",
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+				IssuedAt:  jwt.NewNumericDate(now),
+				NotBefore: jwt.NewNumericDate(now),
+			},
+			Role: store.RoleCustomer,
+		})
+		token.Header["kid"] = jwks.Keys[1].Kid
+		signed, err := token.SignedString(ed25519.NewKeyFromSeed(seed))
+		s.Require().NoError(err)
+
+		req := httptest.NewRequest("GET", "/v1/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+signed)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(200, rsp.StatusCode)
+	})
+}
+
+func (s *StoreTestSuite) TestTokenClaims() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'kiki@domain.example'")
+
+	token := s.registerAndLogin("kiki@domain.example", "Strong-Pass-1")
+
+	s.Run("login, expect configured issuer, audience and user id", func() {
+		var claims store.Claims
+		_, _, err := jwt.NewParser().ParseUnverified(token, &claims)
+		s.Require().NoError(err)
+
+		s.Equal("gotu", claims.Issuer)
+		s.Equal(jwt.ClaimStrings{"bookstore"}, claims.Audience)
+		s.Positive(claims.UserID)
+		s.Equal(store.RoleCustomer, claims.Role)
+	})
+
+	sign := func(issuer, audience string, issuedAt, expiresAt time.Time) string {
+		seed, _ := hex.DecodeString(s.secrets.GetAuthKey())
+		token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, store.Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        "claims-" + audience + "-" + expiresAt.Format(time.RFC3339Nano),
+				Issuer:    issuer,
+				Audience:  jwt.ClaimStrings{audience},
+				Subject:   "kiki@domain.example",
+				ExpiresAt: jwt.NewNumericDate(expiresAt),
+				IssuedAt:  jwt.NewNumericDate(issuedAt),
+				NotBefore: jwt.NewNumericDate(issuedAt),
+			},
+			Role: store.RoleCustomer,
+		})
+		signed, err := token.SignedString(ed25519.NewKeyFromSeed(seed))
+		s.Require().NoError(err)
+
+		return signed
+	}
+
+	getOrders := func(token string) int {
+		req := httptest.NewRequest("GET", "/v1/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		return rsp.StatusCode
+	}
+
+	now := time.Now()
+
+	s.Run("token for another audience, expect 401", func() {
+		s.Equal(401, getOrders(sign("gotu", "staging", now, now.Add(time.Minute))))
+	})
+
+	s.Run("token of another issuer, expect 401", func() {
+		s.Equal(401, getOrders(sign("elsewhere", "bookstore", now, now.Add(time.Minute))))
+	})
+
+	s.Run("token expired within the leeway, expect 200", func() {
+		s.Equal(200, getOrders(sign("gotu", "bookstore", now.Add(-time.Minute), now.Add(-10*time.Second))))
+	})
+
+	s.Run("token expired beyond the leeway, expect 401", func() {
+		s.Equal(401, getOrders(sign("gotu", "bookstore", now.Add(-time.Hour), now.Add(-time.Minute))))
+	})
+}
+
+func (s *StoreTestSuite) TestTOTP() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'kartika@domain.example'")
+	s.db.Exec("DELETE FROM recovery_codes WHERE email = 'kartika@domain.example'")
+
+	token := s.registerAndLogin("kartika@domain.example", "Strong-Pass-1")
+
+	req := httptest.NewRequest("POST", "/v1/mfa/totp", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rsp, _ := s.server.Test(req)
+
+	s.Require().Equal(201, rsp.StatusCode)
+
+	var enrollment struct {
+		Secret string
+		URI    string
+	}
+	json.NewDecoder(rsp.Body).Decode(&enrollment)
+	s.True(strings.HasPrefix(enrollment.URI, "otpauth://totp/"))
+
+	var recoveryCodes []string
+
+	s.Run("confirm enrollment with current code, expect recovery codes", func() {
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/mfa/totp/confirm",
+			strings.NewReader(`{"code": "`+totpCode(enrollment.Secret, time.Now())+`"}`),
+		)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(200, rsp.StatusCode)
+
+		var rspBody struct{ RecoveryCodes []string }
+		json.NewDecoder(rsp.Body).Decode(&rspBody)
+		s.Len(rspBody.RecoveryCodes, 10)
+		recoveryCodes = rspBody.RecoveryCodes
+	})
+
+	req = httptest.NewRequest("POST", "/v1/login", nil)
+	basicAuth := base64.StdEncoding.EncodeToString([]byte("kartika@domain.example:Strong-Pass-1"))
+	req.Header.Set("Authorization", "Basic "+basicAuth)
+
+	rsp, _ = s.server.Test(req)
+
+	s.Equal(200, rsp.StatusCode)
+
+	var challenge struct {
+		MFARequired  bool
+		MFAChallenge string
+		Token        string
+	}
+	json.NewDecoder(rsp.Body).Decode(&challenge)
+	s.True(challenge.MFARequired)
+	s.Empty(challenge.Token)
+
+	s.Run("complete login with wrong code, expect 401", func() {
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/login/mfa",
+			strings.NewReader(`{"mfaChallenge": "`+challenge.MFAChallenge+`", "code": "000000"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(401, rsp.StatusCode)
+	})
+
+	s.Run("complete login with recovery code, expect token once", func() {
+		s.Require().NotEmpty(recoveryCodes)
+
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/login/mfa",
+			strings.NewReader(`{"mfaChallenge": "`+challenge.MFAChallenge+`", "code": "`+recoveryCodes[0]+`"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(200, rsp.StatusCode)
+
+		var tokens struct{ Token string }
+		json.NewDecoder(rsp.Body).Decode(&tokens)
+		s.NotEmpty(tokens.Token)
+
+		req = httptest.NewRequest(
+			"POST",
+			"/v1/login/mfa",
+			strings.NewReader(`{"mfaChallenge": "`+challenge.MFAChallenge+`", "code": "`+recoveryCodes[0]+`"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ = s.server.Test(req)
+
+		s.Equal(401, rsp.StatusCode)
+	})
+
+	s.db.Exec("DELETE FROM login_throttles WHERE key = 'kartika@domain.example'")
+}
+
+// totpCode computes the RFC 6238 code of a base32 secret at t.
+func totpCode(secret string, t time.Time) string {
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/30))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+func (s *StoreTestSuite) TestAPIKeys() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'lukas@domain.example'")
+	s.db.Exec("DELETE FROM api_keys WHERE email = 'lukas@domain.example'")
+
+	token := s.registerAndLogin("lukas@domain.example", "Strong-Pass-1")
+
+	req := httptest.NewRequest(
+		"POST",
+		"/v1/apikeys",
+		strings.NewReader(`{"name": "warehouse", "scopes": ["books:read", "orders:read"]}`),
+	)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, _ := s.server.Test(req)
+
+	s.Require().Equal(201, rsp.StatusCode)
+
+	var created struct {
+		APIKey struct{ ID int }
+		Key    string
+	}
+	json.NewDecoder(rsp.Body).Decode(&created)
+	s.True(strings.HasPrefix(created.Key, "bk_"))
+
+	s.Run("read orders with api key, expect 200", func() {
+		req := httptest.NewRequest("GET", "/v1/orders", nil)
+		req.Header.Set("X-API-Key", created.Key)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(200, rsp.StatusCode)
+	})
+
+	s.Run("create order with api key lacking scope, expect 403", func() {
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/orders",
+			strings.NewReader(`{"items": [{ "bookId": 1, "quantity": 1 }]}`),
+		)
+		req.Header.Set("Authorization", "ApiKey "+created.Key)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(403, rsp.StatusCode)
+	})
+
+	s.Run("manage api keys with an api key, expect 403", func() {
+		req := httptest.NewRequest("GET", "/v1/apikeys", nil)
+		req.Header.Set("X-API-Key", created.Key)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(403, rsp.StatusCode)
+	})
+
+	s.Run("list api keys with token, expect key without secret", func() {
+		req := httptest.NewRequest("GET", "/v1/apikeys", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(200, rsp.StatusCode)
+
+		var listed struct {
+			APIKeys []struct {
+				ID         int
+				Name       string
+				LastUsedAt *time.Time
+				Hash       string
+			}
+		}
+		json.NewDecoder(rsp.Body).Decode(&listed)
+		s.Require().Len(listed.APIKeys, 1)
+		s.Equal("warehouse", listed.APIKeys[0].Name)
+		s.NotNil(listed.APIKeys[0].LastUsedAt)
+		s.Empty(listed.APIKeys[0].Hash)
+	})
+
+	s.Run("revoke api key, expect it to be rejected afterwards", func() {
+		req := httptest.NewRequest("DELETE", fmt.Sprintf("/v1/apikeys/%d", created.APIKey.ID), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(204, rsp.StatusCode)
+
+		req = httptest.NewRequest("GET", "/v1/orders", nil)
+		req.Header.Set("X-API-Key", created.Key)
+
+		rsp, _ = s.server.Test(req)
+
+		s.Equal(401, rsp.StatusCode)
+	})
+}
+
+func (s *StoreTestSuite) TestAccountDeletion() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'iwan@domain.example'")
+
+	token := s.registerAndLogin("iwan@domain.example", "Strong-Pass-1")
+	s.db.Exec("UPDATE logins SET verified_at = NOW() WHERE email = 'iwan@domain.example'")
+
+	req := httptest.NewRequest(
+		"POST",
+		"/v1/orders",
+		strings.NewReader(`{"items": [{ "bookId": 1, "quantity": 2 }]}`),
+	)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, _ := s.server.Test(req)
+
+	s.Require().Equal(201, rsp.StatusCode)
+
+	var order store.Order
+	json.NewDecoder(rsp.Body).Decode(&order)
+
+	s.Run("export account, expect attachment with login and orders", func() {
+		req := httptest.NewRequest("GET", "/v1/account/export", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Require().Equal(200, rsp.StatusCode)
+		s.Contains(rsp.Header.Get("Content-Disposition"), "attachment")
+
+		var export store.AccountExport
+		json.NewDecoder(rsp.Body).Decode(&export)
+		s.Equal("iwan@domain.example", export.Account.Email)
+		s.Require().Len(export.Orders, 1)
+		s.Equal(order.ID, export.Orders[0].ID)
+		s.Require().Len(export.Orders[0].Items, 1)
+		s.Equal(2, export.Orders[0].Items[0].Quantity)
+	})
+
+	deleteAccount := func(password string) int {
+		req := httptest.NewRequest(
+			"DELETE",
+			"/v1/account",
+			strings.NewReader(`{"currentPassword": "`+password+`"}`),
+		)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		return rsp.StatusCode
+	}
+
+	s.Run("delete account with wrong password, expect 400", func() {
+		s.Equal(400, deleteAccount("Wrong-Pass-1"))
+	})
+
+	s.Run("delete account, expect 204 and anonymized orders kept", func() {
+		s.Equal(204, deleteAccount("Strong-Pass-1"))
+
+		var user string
+		err := s.db.QueryRow(`SELECT "user" FROM orders WHERE id = $1`, order.ID).Scan(&user)
+		s.Require().NoError(err)
+		s.True(strings.HasPrefix(user, "deleted:"))
+
+		var items int
+		s.db.QueryRow(`SELECT COUNT(*) FROM order_items WHERE "user" = $1`, user).Scan(&items)
+		s.Equal(1, items)
+	})
+
+	s.Run("use token of deleted account, expect 401", func() {
+		req := httptest.NewRequest("GET", "/v1/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(401, rsp.StatusCode)
+	})
+
+	s.Run("register the email again, expect token of deleted account 401", func() {
+		s.registerAndLogin("iwan@domain.example", "Strong-Pass-2")
+
+		req := httptest.NewRequest("GET", "/v1/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(401, rsp.StatusCode)
+	})
+}
+
+func (s *StoreTestSuite) TestAuthors() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'ayu@domain.example'")
+	s.db.Exec("DELETE FROM books WHERE title IN ('Shared Pages', 'Solo Pages')")
+	s.db.Exec("DELETE FROM authors WHERE name IN ('Rina Writer', 'Budi Writer', 'Tono Translator')")
+
+	s.registerAndLogin("ayu@domain.example", "Strong-Pass-1")
+	s.db.Exec("UPDATE logins SET role = 'admin' WHERE email = 'ayu@domain.example'")
+	admin := s.login("ayu@domain.example", "Strong-Pass-1")
+
+	send := func(method, target, body string) *http.Response {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+admin)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		return rsp
+	}
+
+	var shared store.Book
+	s.Run("create co-authored book, expect contributors and byline of the authors", func() {
+		rsp := send("POST", "/v1/books", `{"title": "Shared Pages", "price": 10, "contributors": [
+            {"name": "Rina Writer"},
+            {"name": "Budi Writer", "role": "author"},
+            {"name": "Tono Translator", "role": "translator"}
+        ]}`)
+
+		s.Require().Equal(201, rsp.StatusCode)
+
+		json.NewDecoder(rsp.Body).Decode(&shared)
+		s.Equal("Rina Writer, Budi Writer", shared.Author)
+		s.Require().Len(shared.Contributors, 3)
+		s.Equal(store.ContributorTranslator, shared.Contributors[2].Role)
+		s.NotZero(shared.Contributors[0].AuthorID)
+	})
+
+	s.Run("create book with author only, expect existing author credited", func() {
+		rsp := send("POST", "/v1/books", `{"title": "Solo Pages", "author": "Rina Writer", "price": 5}`)
+
+		s.Require().Equal(201, rsp.StatusCode)
+
+		var solo store.Book
+		json.NewDecoder(rsp.Body).Decode(&solo)
+		s.Require().Len(solo.Contributors, 1)
+		s.Equal(shared.Contributors[0].AuthorID, solo.Contributors[0].AuthorID)
+	})
+
+	s.Run("create book with unknown role, expect 400", func() {
+		rsp := send("POST", "/v1/books", `{"title": "Bad Role", "price": 5, "contributors": [{"name": "X", "role": "illustrator"}]}`)
+
+		s.Equal(400, rsp.StatusCode)
+	})
+
+	s.Run("list authors by name, expect book counts", func() {
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/authors?name=writer", nil))
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var body struct{ Authors []store.Author }
+		json.NewDecoder(rsp.Body).Decode(&body)
+		counts := map[string]int{}
+		for _, author := range body.Authors {
+			counts[author.Name] = author.BookCount
+		}
+		s.Equal(2, counts["Rina Writer"])
+		s.Equal(1, counts["Budi Writer"])
+	})
+
+	s.Run("list authors page by page, expect cursor", func() {
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/authors?name=writer&limit=1", nil))
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var body struct {
+			Authors    []store.Author
+			NextCursor string
+		}
+		json.NewDecoder(rsp.Body).Decode(&body)
+		s.Len(body.Authors, 1)
+		s.NotEmpty(body.NextCursor)
+	})
+
+	s.Run("get books of author, expect every book crediting them", func() {
+		path := "/v1/authors/" + strconv.Itoa(shared.Contributors[0].AuthorID) + "/books?sort=title"
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", path, nil))
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var body struct {
+			Author store.Author
+			Books  []store.Book
+		}
+		json.NewDecoder(rsp.Body).Decode(&body)
+		s.Equal("Rina Writer", body.Author.Name)
+		s.Require().Len(body.Books, 2)
+		s.Equal("Shared Pages", body.Books[0].Title)
+		s.Len(body.Books[0].Contributors, 3)
+	})
+
+	s.Run("get books of unknown author, expect 404", func() {
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/authors/0/books", nil))
+
+		s.Equal(404, rsp.StatusCode)
+	})
+
+	s.Run("patch contributors, expect byline derived again", func() {
+		rsp := send("PATCH", "/v1/books/"+strconv.Itoa(shared.ID), `{"contributors": [{"name": "Budi Writer"}]}`)
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var patched store.Book
+		json.NewDecoder(rsp.Body).Decode(&patched)
+		s.Equal("Budi Writer", patched.Author)
+		s.Len(patched.Contributors, 1)
+	})
+}
+
+func (s *StoreTestSuite) TestBookCovers() {
+	s.db.Exec("DELETE FROM logins WHERE email IN ('vina@domain.example', 'wawan@domain.example')")
+	s.db.Exec("DELETE FROM books WHERE author = 'Cover Author'")
+
+	s.registerAndLogin("vina@domain.example", "Strong-Pass-1")
+	s.db.Exec("UPDATE logins SET role = 'admin' WHERE email = 'vina@domain.example'")
+	admin := s.login("vina@domain.example", "Strong-Pass-1")
+	customer := s.registerAndLogin("wawan@domain.example", "Strong-Pass-1")
+
+	send := func(method, target, token string, body []byte) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "image/png")
+
+		rsp, _ := s.server.Test(req)
+
+		return rsp
+	}
+	picture := func(width, height int) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+			}
+		}
+
+		var buf bytes.Buffer
+		png.Encode(&buf, img)
+
+		return buf.Bytes()
+	}
+	thumbnailSize := func(url string) (int, int) {
+		rsp, err := http.Get(url)
+		s.Require().NoError(err)
+		defer rsp.Body.Close()
+		s.Require().Equal(200, rsp.StatusCode)
+		s.Equal("image/jpeg", rsp.Header.Get("Content-Type"))
+
+		config, err := jpeg.DecodeConfig(rsp.Body)
+		s.Require().NoError(err)
+
+		return config.Width, config.Height
+	}
+	exists := func(url string) bool {
+		rsp, err := http.Get(url)
+		s.Require().NoError(err)
+		rsp.Body.Close()
+
+		return rsp.StatusCode == 200
+	}
+
+	var book store.Book
+	s.db.QueryRow("INSERT INTO books (title, author, price) VALUES ('Covered', 'Cover Author', 5) RETURNING id, updated_at").
+		Scan(&book.ID, &book.UpdatedAt)
+	coverURL := "/v1/books/" + strconv.Itoa(book.ID) + "/cover"
+
+	s.Run("upload cover as customer, expect 403", func() {
+		s.Equal(403, send("PUT", coverURL, customer, picture(200, 300)).StatusCode)
+	})
+
+	s.Run("upload something else than an image, expect 400", func() {
+		s.Equal(400, send("PUT", coverURL, admin, []byte("not an image")).StatusCode)
+	})
+
+	s.Run("upload tiny image, expect 400", func() {
+		s.Equal(400, send("PUT", coverURL, admin, picture(50, 50)).StatusCode)
+	})
+
+	s.Run("upload cover to unknown book, expect 404", func() {
+		s.Equal(404, send("PUT", "/v1/books/0/cover", admin, picture(200, 300)).StatusCode)
+	})
+
+	var first store.BookCover
+	s.Run("upload cover, expect thumbnails resized to fit", func() {
+		rsp := send("PUT", coverURL, admin, picture(800, 1200))
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var covered store.Book
+		json.NewDecoder(rsp.Body).Decode(&covered)
+		s.Require().NotNil(covered.Cover)
+		s.True(covered.UpdatedAt.After(book.UpdatedAt))
+		first = *covered.Cover
+
+		width, height := thumbnailSize(first.Large)
+		s.Equal([2]int{600, 900}, [2]int{width, height})
+		width, height = thumbnailSize(first.Medium)
+		s.Equal([2]int{300, 450}, [2]int{width, height})
+		width, height = thumbnailSize(first.Small)
+		s.Equal([2]int{120, 180}, [2]int{width, height})
+	})
+
+	s.Run("get book, expect cover URLs", func() {
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/books/"+strconv.Itoa(book.ID), nil))
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var detail store.Book
+		json.NewDecoder(rsp.Body).Decode(&detail)
+		s.Require().NotNil(detail.Cover)
+		s.Equal(first, *detail.Cover)
+	})
+
+	s.Run("replace cover, expect new thumbnails and old ones removed", func() {
+		rsp := send("PUT", coverURL, admin, picture(1000, 500))
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var covered store.Book
+		json.NewDecoder(rsp.Body).Decode(&covered)
+		s.Require().NotNil(covered.Cover)
+		s.NotEqual(first.Large, covered.Cover.Large)
+
+		width, height := thumbnailSize(covered.Cover.Large)
+		s.Equal([2]int{600, 300}, [2]int{width, height})
+		s.False(exists(first.Large))
+		first = *covered.Cover
+	})
+
+	s.Run("delete cover, expect thumbnails removed", func() {
+		s.Require().Equal(204, send("DELETE", coverURL, admin, nil).StatusCode)
+		s.False(exists(first.Small))
+
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/books/"+strconv.Itoa(book.ID), nil))
+		var detail store.Book
+		json.NewDecoder(rsp.Body).Decode(&detail)
+		s.Nil(detail.Cover)
+
+		s.Equal(404, send("DELETE", coverURL, admin, nil).StatusCode)
+	})
+
+	s.Run("delete book with cover, expect thumbnails removed", func() {
+		rsp := send("PUT", coverURL, admin, picture(200, 300))
+		s.Require().Equal(200, rsp.StatusCode)
+		var covered store.Book
+		json.NewDecoder(rsp.Body).Decode(&covered)
+		s.Require().NotNil(covered.Cover)
+
+		s.Require().Equal(204, send("DELETE", "/v1/books/"+strconv.Itoa(book.ID), admin, nil).StatusCode)
+		s.False(exists(covered.Cover.Large))
+	})
+}
+
+func (s *StoreTestSuite) TestBookDetail() {
+	s.db.Exec("DELETE FROM books WHERE author = 'Detail Author'")
+
+	var bookID int
+	s.db.QueryRow(`INSERT INTO books (title, author, price, description)
+        VALUES ('Detail Book', 'Detail Author', 12.50, 'The whole record.') RETURNING id`).Scan(&bookID)
+	path := "/v1/books/" + strconv.Itoa(bookID)
+
+	getBook := func(path string, headers map[string]string) *http.Response {
+		req := httptest.NewRequest("GET", path, nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+
+		rsp, _ := s.server.Test(req)
+
+		return rsp
+	}
+
+	var etag, lastModified string
+
+	s.Run("get book, expect full record with validators", func() {
+		rsp := getBook(path, nil)
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var book store.Book
+		json.NewDecoder(rsp.Body).Decode(&book)
+		s.Equal("Detail Book", book.Title)
+		s.Equal("The whole record.", book.Description)
+
+		etag = rsp.Header.Get("ETag")
+		lastModified = rsp.Header.Get("Last-Modified")
+		s.NotEmpty(etag)
+		s.NotEmpty(lastModified)
+	})
+
+	s.Run("get book with matching etag, expect 304", func() {
+		rsp := getBook(path, map[string]string{"If-None-Match": etag})
+
+		s.Equal(304, rsp.StatusCode)
+	})
+
+	s.Run("get book not modified since last modified, expect 304", func() {
+		rsp := getBook(path, map[string]string{"If-Modified-Since": lastModified})
+
+		s.Equal(304, rsp.StatusCode)
+	})
+
+	s.Run("get book changed since, expect 200 with new etag", func() {
+		s.db.Exec("UPDATE books SET price = 15.00, updated_at = updated_at + INTERVAL '1 minute' WHERE id = $1", bookID)
+
+		rsp := getBook(path, map[string]string{"If-None-Match": etag})
+
+		s.Require().Equal(200, rsp.StatusCode)
+		s.NotEqual(etag, rsp.Header.Get("ETag"))
+
+		rsp = getBook(path, map[string]string{"If-Modified-Since": lastModified})
+
+		s.Equal(200, rsp.StatusCode)
+	})
+
+	s.Run("get unknown book, expect 404", func() {
+		rsp := getBook("/v1/books/0", nil)
+
+		s.Equal(404, rsp.StatusCode)
+	})
+
+	s.Run("get book with invalid id, expect 400", func() {
+		rsp := getBook("/v1/books/abc", nil)
+
+		s.Equal(400, rsp.StatusCode)
+	})
+}
+
+func (s *StoreTestSuite) TestBodyLimit() {
+	s.Run("post multipart body above the limit, expect 413", func() {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		file, err := form.CreateFormFile("file", "large.bin")
+		s.Require().NoError(err)
+		file.Write(make([]byte, 5<<20))
+		form.Close()
+
+		req := httptest.NewRequest("POST", "/v1/users", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+
+		rsp, err := s.server.Test(req, -1)
+
+		s.Require().NoError(err)
+		s.Equal(413, rsp.StatusCode)
+	})
+}
+
+func (s *StoreTestSuite) TestBookImport() {
+	s.db.Exec("DELETE FROM logins WHERE email IN ('ines@domain.example', 'ino@domain.example')")
+	s.db.Exec("DELETE FROM books WHERE isbn IN ('9781861972712', '9780143039433', '9780099549482')")
+	s.db.Exec("INSERT INTO books (title, author, price, isbn) VALUES ('Old Title', 'Import Author', 1.00, '9781861972712')")
+
+	s.registerAndLogin("ines@domain.example", "Strong-Pass-1")
+	s.db.Exec("UPDATE logins SET role = 'admin' WHERE email = 'ines@domain.example'")
+	admin := s.login("ines@domain.example", "Strong-Pass-1")
+	customer := s.registerAndLogin("ino@domain.example", "Strong-Pass-1")
+
+	importFile := func(token, contentType, body string) (int, store.ImportReport) {
+		req := httptest.NewRequest("POST", "/v1/admin/books/import", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", contentType)
+
+		rsp, _ := s.server.Test(req)
+
+		var report store.ImportReport
+		json.NewDecoder(rsp.Body).Decode(&report)
+
+		return rsp.StatusCode, report
+	}
+
+	const csvFile = "isbn,title,author,price,published_at,page_count\n" +
+		"1-86197-271-7,New Title,Import Author,9.99,2001-05-01,120\n" +
+		"9780143039433,The Grapes of Wrath,Import Author,12.50,,\n" +
+		"9780143039434,Wrong Check Digit,Import Author,5,,\n" +
+		",No ISBN,Import Author,5,,\n"
+
+	s.Run("import csv as customer, expect 403", func() {
+		status, _ := importFile(customer, "text/csv", csvFile)
+
+		s.Equal(403, status)
+	})
+
+	s.Run("import csv, expect valid rows upserted and bad rows reported", func() {
+		status, report := importFile(admin, "text/csv", csvFile)
+
+		s.Require().Equal(200, status)
+		s.Equal(4, report.Rows)
+		s.Equal(1, report.Created)
+		s.Equal(1, report.Updated)
+		s.Equal(2, report.Failed)
+		s.Require().Len(report.Errors, 2)
+		s.Equal(4, report.Errors[0].Row)
+		s.Contains(report.Errors[0].Fields, "isbn")
+		s.Equal(5, report.Errors[1].Row)
+
+		var title string
+		s.db.QueryRow("SELECT title FROM books WHERE isbn = '9781861972712'").Scan(&title)
+		s.Equal("New Title", title)
+	})
+
+	s.Run("import same csv again, expect nothing changed", func() {
+		status, report := importFile(admin, "text/csv", csvFile)
+
+		s.Require().Equal(200, status)
+		s.Equal(2, report.Unchanged)
+		s.Zero(report.Created)
+		s.Zero(report.Updated)
+	})
+
+	s.Run("import csv with a price below a cent, expect row reported", func() {
+		status, report := importFile(admin, "text/csv", "isbn,title,author,price\n9781861972712,New Title,Import Author,9.995\n")
+
+		s.Require().Equal(200, status)
+		s.Equal(1, report.Failed)
+		s.Require().Len(report.Errors, 1)
+		s.Contains(report.Errors[0].Fields, "price")
+	})
+
+	s.Run("import csv with a column named twice, expect 400", func() {
+		status, _ := importFile(admin, "text/csv", "isbn,title,author,price,Title\n9781861972712,New Title,Import Author,9.99,Other Title\n")
+
+		s.Equal(400, status)
+	})
+
+	s.Run("import narrower csv over a full record, expect columns left out kept", func() {
+		status, report := importFile(admin, "text/csv",
+			"isbn,title,author,editor,price,description,publisher,published_at,language,page_count,available\n"+
+				"9781861972712,New Title,Import Author,Import Editor,9.99,A description.,Import House,2001-05-01,en,120,false\n")
+		s.Require().Equal(200, status)
+		s.Require().Equal(1, report.Updated)
+
+		status, report = importFile(admin, "text/csv", "isbn,title,author,price\n9781861972712,Newer Title,Import Author,10.99\n")
+
+		s.Require().Equal(200, status)
+		s.Equal(1, report.Updated)
+
+		var title, description, publisher, language string
+		var publishedAt time.Time
+		var pageCount int
+		var available bool
+		err := s.db.
+			QueryRow(`SELECT title, description, publisher, published_at, language, page_count, available
+                FROM books WHERE isbn = '9781861972712'`).
+			Scan(&title, &description, &publisher, &publishedAt, &language, &pageCount, &available)
+		s.Require().NoError(err)
+		s.Equal("Newer Title", title)
+		s.Equal("A description.", description)
+		s.Equal("Import House", publisher)
+		s.Equal("2001-05-01", publishedAt.Format(time.DateOnly))
+		s.Equal("en", language)
+		s.Equal(120, pageCount)
+		s.False(available)
+
+		var editors int
+		s.db.QueryRow(`SELECT COUNT(*) FROM book_authors ba JOIN books b ON b.id = ba.book_id
+            WHERE b.isbn = '9781861972712' AND ba.role = 'editor'`).Scan(&editors)
+		s.Equal(1, editors)
+	})
+
+	s.Run("import csv without required columns, expect 400", func() {
+		status, _ := importFile(admin, "text/csv", "isbn,title\n9780099549482,Title\n")
+
+		s.Equal(400, status)
+	})
+
+	s.Run("import onix, expect product mapped to book", func() {
+		const onix = `<?xml version="1.0" encoding="UTF-8"?>
+<ONIXMessage release="3.0" xmlns="http://ns.editeur.org/onix/3.0/reference">
+  <Header><Sender><SenderName>Publisher</SenderName></Sender></Header>
+  <Product>
+    <RecordReference>import-1</RecordReference>
+    <NotificationType>03</NotificationType>
+    <ProductIdentifier><ProductIDType>15</ProductIDType><IDValue>9780099549482</IDValue></ProductIdentifier>
+    <DescriptiveDetail>
+      <TitleDetail>
+        <TitleType>01</TitleType>
+        <TitleElement><TitleElementLevel>01</TitleElementLevel><TitleText>Norwegian Wood</TitleText></TitleElement>
+      </TitleDetail>
+      <Contributor><ContributorRole>A01</ContributorRole><PersonName>Haruki Murakami</PersonName></Contributor>
+      <Language><LanguageRole>01</LanguageRole><LanguageCode>eng</LanguageCode></Language>
+      <Extent><ExtentType>00</ExtentType><ExtentValue>389</ExtentValue><ExtentUnit>03</ExtentUnit></Extent>
+    </DescriptiveDetail>
+    <PublishingDetail>
+      <Publisher><PublishingRole>01</PublishingRole><PublisherName>Vintage</PublisherName></Publisher>
+      <PublishingDate><PublishingDateRole>01</PublishingDateRole><Date>20000905</Date></PublishingDate>
+    </PublishingDetail>
+    <ProductSupply>
+      <SupplyDetail>
+        <ProductAvailability>40</ProductAvailability>
+        <Price><PriceAmount>10.99</PriceAmount><CurrencyCode>USD</CurrencyCode></Price>
+      </SupplyDetail>
+    </ProductSupply>
+  </Product>
+</ONIXMessage>`
+
+		status, report := importFile(admin, "application/xml", onix)
+
+		s.Require().Equal(200, status)
+		s.Equal(1, report.Created)
+
+		var book struct {
+			Title, Author, Publisher string
+			PageCount                int
+			Available                bool
+		}
+		s.db.QueryRow("SELECT title, author, publisher, page_count, available FROM books WHERE isbn = '9780099549482'").
+			Scan(&book.Title, &book.Author, &book.Publisher, &book.PageCount, &book.Available)
+		s.Equal("Norwegian Wood", book.Title)
+		s.Equal("Haruki Murakami", book.Author)
+		s.Equal("Vintage", book.Publisher)
+		s.Equal(389, book.PageCount)
+		s.False(book.Available)
+	})
+
+	s.Run("import malformed onix, expect 400", func() {
+		status, _ := importFile(admin, "application/xml", "<ONIXMessage><Product><broken></Product>")
+
+		s.Equal(400, status)
+	})
+}
+
+func (s *StoreTestSuite) TestBookPagination() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'mira@domain.example'")
+	s.db.Exec("DELETE FROM books WHERE author = 'Pagination Author'")
+	s.db.Exec(`INSERT INTO books (title, author, price, available) VALUES
+        ('Page One', 'Pagination Author', 10.00, TRUE),
+        ('Page Two', 'Pagination Author', 20.00, TRUE),
+        ('Page Three', 'Pagination Author', 30.00, TRUE),
+        ('Page Four', 'Pagination Author', 40.00, FALSE)`)
+
+	token := s.registerAndLogin("mira@domain.example", "Strong-Pass-1")
+
+	type page struct {
+		Books      []store.Book
+		NextCursor string
+	}
+	getBooks := func(query string) (int, page) {
+		req := httptest.NewRequest("GET", "/v1/books?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		var body page
+		json.NewDecoder(rsp.Body).Decode(&body)
+
+		return rsp.StatusCode, body
+	}
+	titles := func(books []store.Book) (titles []string) {
+		for _, book := range books {
+			titles = append(titles, book.Title)
+		}
+		return titles
+	}
+
+	s.Run("page through available books by descending price, expect cursor until the last page", func() {
+		status, first := getBooks("author=pagination&available=true&sort=-price&limit=2")
+
+		s.Require().Equal(200, status)
+		s.Equal([]string{"Page Three", "Page Two"}, titles(first.Books))
+		s.Require().NotEmpty(first.NextCursor)
+
+		status, second := getBooks("author=pagination&available=true&sort=-price&limit=2&cursor=" + first.NextCursor)
+
+		s.Require().Equal(200, status)
+		s.Equal([]string{"Page One"}, titles(second.Books))
+		s.Empty(second.NextCursor)
+	})
+
+	s.Run("filter by price range, expect books within it", func() {
+		status, body := getBooks("author=pagination&minPrice=15&maxPrice=40&sort=price")
+
+		s.Require().Equal(200, status)
+		s.Equal([]string{"Page Two", "Page Three", "Page Four"}, titles(body.Books))
+	})
+
+	s.Run("unknown sort, expect 400", func() {
+		status, _ := getBooks("sort=isbn")
+
+		s.Equal(400, status)
+	})
+
+	s.Run("cursor of another sort, expect 400", func() {
+		_, first := getBooks("author=pagination&sort=title&limit=1")
+		s.Require().NotEmpty(first.NextCursor)
+
+		status, _ := getBooks("author=pagination&sort=price&cursor=" + first.NextCursor)
+
+		s.Equal(400, status)
+	})
+
+	s.Run("cursor with a value that is no price, expect 400", func() {
+		cursor := base64.RawURLEncoding.EncodeToString([]byte(`{"s":"price","v":"not-a-price","i":1}`))
+
+		status, _ := getBooks("sort=price&cursor=" + cursor)
+
+		s.Equal(400, status)
+	})
+
+	s.Run("cursor with a value that is no timestamp, expect 400", func() {
+		cursor := base64.RawURLEncoding.EncodeToString([]byte(`{"s":"-created_at","v":"yesterday","i":1}`))
+
+		status, _ := getBooks("sort=-created_at&cursor=" + cursor)
+
+		s.Equal(400, status)
+	})
+
+	s.Run("limit above maximum, expect 400", func() {
+		status, _ := getBooks("limit=1000")
+
+		s.Equal(400, status)
+	})
+}
+
+func (s *StoreTestSuite) TestBookSearch() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'sena@domain.example'")
+	s.db.Exec("DELETE FROM books WHERE author IN ('Search Author', 'Other Search Author')")
+	s.db.Exec(`INSERT INTO books (title, author, price, description) VALUES
+        ('Quokka Island', 'Search Author', 10.00, 'A story about a small marsupial.'),
+        ('Island Life', 'Search Author', 20.00, 'Meeting a quokka on a sunny morning.'),
+        ('Quokka Tales', 'Other Search Author', 30.00, 'More stories.'),
+        ('Wombat <script>alert(1)</script>', 'Search Author', 5.00, 'A wombat & <i>friends</i>.')`)
+	s.db.Exec("INSERT INTO authors (name) VALUES ('Search Author'), ('Other Search Author') ON CONFLICT DO NOTHING")
+	s.db.Exec(`INSERT INTO book_authors (book_id, author_id, role, position)
+        SELECT b.id, a.id, 'author', 0 FROM books b JOIN authors a ON a.name = b.author
+        WHERE b.author IN ('Search Author', 'Other Search Author')`)
+
+	token := s.registerAndLogin("sena@domain.example", "Strong-Pass-1")
+
+	type result struct {
+		Book                 store.Book
+		Rank                 float64
+		TitleHighlight       string
+		DescriptionHighlight string
+	}
+	type page struct {
+		Results []result
+		Total   int
+		Facets  struct{ Authors []store.FacetCount }
+	}
+	search := func(query string) (int, page) {
+		req := httptest.NewRequest("GET", "/v1/books/search?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		var body page
+		json.NewDecoder(rsp.Body).Decode(&body)
+
+		return rsp.StatusCode, body
+	}
+
+	s.Run("search a word, expect title matches ranked first and highlighted", func() {
+		status, body := search("q=quokka&author=search")
+
+		s.Require().Equal(200, status)
+		s.Equal(3, body.Total)
+		s.Require().Len(body.Results, 3)
+		s.NotEqual("Island Life", body.Results[0].Book.Title)
+		s.Equal("Island Life", body.Results[2].Book.Title)
+		s.Contains(body.Results[0].TitleHighlight, "<b>Quokka</b>")
+		s.Contains(body.Results[2].DescriptionHighlight, "<b>quokka</b>")
+	})
+
+	s.Run("search with limit, expect total of all matches and author facets", func() {
+		status, body := search("q=quokka&author=search&limit=1")
+
+		s.Require().Equal(200, status)
+		s.Equal(3, body.Total)
+		s.Len(body.Results, 1)
+		s.Equal([]store.FacetCount{
+			{Value: "Search Author", Count: 2},
+			{Value: "Other Search Author", Count: 1},
+		}, body.Facets.Authors)
+	})
+
+	s.Run("search excluding a word, expect it filtered out", func() {
+		status, body := search("q=" + url.QueryEscape("quokka -island") + "&author=search")
+
+		s.Require().Equal(200, status)
+		s.Require().Len(body.Results, 1)
+		s.Equal("Quokka Tales", body.Results[0].Book.Title)
+	})
+
+	s.Run("search a word in markup, expect highlights HTML escaped", func() {
+		status, body := search("q=wombat&author=search")
+
+		s.Require().Equal(200, status)
+		s.Require().Len(body.Results, 1)
+		s.Contains(body.Results[0].TitleHighlight, "<b>Wombat</b>")
+		s.Contains(body.Results[0].TitleHighlight, "&lt;script&gt;")
+		s.NotContains(body.Results[0].TitleHighlight, "<script>")
+		s.Contains(body.Results[0].DescriptionHighlight, "&lt;i&gt;")
+		s.NotContains(body.Results[0].DescriptionHighlight, "<i>")
+	})
+
+	s.Run("search without q, expect 400", func() {
+		status, _ := search("author=search")
+
+		s.Equal(400, status)
+	})
+}
+
+func (s *StoreTestSuite) TestCatalogManagement() {
+	s.db.Exec("DELETE FROM logins WHERE email IN ('lina@domain.example', 'lino@domain.example')")
+	s.db.Exec("DELETE FROM books WHERE isbn IN ('9780306406157', '9780804429573')")
+
+	s.registerAndLogin("lina@domain.example", "Strong-Pass-1")
+	s.db.Exec("UPDATE logins SET role = 'admin' WHERE email = 'lina@domain.example'")
+	admin := s.login("lina@domain.example", "Strong-Pass-1")
+	customer := s.registerAndLogin("lino@domain.example", "Strong-Pass-1")
+
+	send := func(method, target, token, body string) *http.Response {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		return rsp
+	}
+
+	const book = `{"title": "Laskar Pelangi", "author": "Andrea Hirata", "price": 7.5,
+        "isbn": "978-0-306-40615-7", "language": "id", "pageCount": 529}`
+
+	s.Run("create book as customer, expect 403", func() {
+		s.Equal(403, send("POST", "/v1/books", customer, book).StatusCode)
+	})
+
+	s.Run("create invalid book, expect 400 with fields", func() {
+		rsp := send("POST", "/v1/books", admin, `{"author": "Andrea Hirata", "price": -1, "isbn": "978-0-306-40615-8"}`)
+
+		s.Require().Equal(400, rsp.StatusCode)
+
+		var body struct{ Fields map[string][]string }
+		json.NewDecoder(rsp.Body).Decode(&body)
+		s.Contains(body.Fields, "title")
+		s.Contains(body.Fields, "price")
+		s.Contains(body.Fields, "isbn")
+	})
+
+	var created store.Book
+	s.Run("create book, expect 201 with normalized isbn", func() {
+		rsp := send("POST", "/v1/books", admin, book)
+
+		s.Require().Equal(201, rsp.StatusCode)
+
+		json.NewDecoder(rsp.Body).Decode(&created)
+		s.Equal("9780306406157", created.ISBN)
+		s.Equal(store.Price(750), created.Price)
+	})
+
+	s.Run("create book with duplicate isbn, expect 409", func() {
+		s.Equal(409, send("POST", "/v1/books", admin, book).StatusCode)
+	})
+
+	bookURL := "/v1/books/" + strconv.Itoa(created.ID)
+
+	s.Run("patch price, expect other fields kept and updatedAt bumped", func() {
+		rsp := send("PATCH", bookURL, admin, `{"price": 8.25}`)
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var patched store.Book
+		json.NewDecoder(rsp.Body).Decode(&patched)
+		s.Equal(store.Price(825), patched.Price)
+		s.Equal("Laskar Pelangi", patched.Title)
+		s.Equal("9780306406157", patched.ISBN)
+		s.True(patched.UpdatedAt.After(created.UpdatedAt))
+	})
+
+	s.Run("patch price with more than two decimals, expect 400 and price kept", func() {
+		s.Equal(400, send("PATCH", bookURL, admin, `{"price": 8.255}`).StatusCode)
+
+		var price string
+		s.db.QueryRow("SELECT price FROM books WHERE id = $1", created.ID).Scan(&price)
+		s.Equal("8.25", price)
+	})
+
+	s.Run("replace book, expect unset fields cleared", func() {
+		rsp := send("PUT", bookURL, admin, `{"title": "Laskar Pelangi", "author": "Andrea Hirata", "price": 9}`)
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var replaced store.Book
+		json.NewDecoder(rsp.Body).Decode(&replaced)
+		s.Empty(replaced.ISBN)
+		s.Nil(replaced.PageCount)
+	})
+
+	s.Run("patch unknown book, expect 404", func() {
+		s.Equal(404, send("PATCH", "/v1/books/0", admin, `{"price": 1}`).StatusCode)
+	})
+
+	s.Run("delete book, expect 204 then 404", func() {
+		s.Equal(204, send("DELETE", bookURL, admin, "").StatusCode)
+		s.Equal(404, send("DELETE", bookURL, admin, "").StatusCode)
+	})
+}
+
+func (s *StoreTestSuite) TestCategories() {
+	s.db.Exec("DELETE FROM logins WHERE email IN ('tari@domain.example', 'umar@domain.example')")
+	s.db.Exec("DELETE FROM books WHERE author = 'Shelf Author'")
+	s.db.Exec("DELETE FROM categories WHERE slug = 'shelf-space-opera'")
+	s.db.Exec("DELETE FROM categories WHERE slug = 'shelf-science-fiction'")
+	s.db.Exec("DELETE FROM categories WHERE slug = 'shelf-fiction'")
+
+	s.registerAndLogin("tari@domain.example", "Strong-Pass-1")
+	s.db.Exec("UPDATE logins SET role = 'admin' WHERE email = 'tari@domain.example'")
+	admin := s.login("tari@domain.example", "Strong-Pass-1")
+	customer := s.registerAndLogin("umar@domain.example", "Strong-Pass-1")
+
+	send := func(method, target, token, body string) *http.Response {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		return rsp
+	}
+	getBooks := func(query string) []store.Book {
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/books?author=Shelf+Author&sort=title&"+query, nil))
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var body struct{ Books []store.Book }
+		json.NewDecoder(rsp.Body).Decode(&body)
+
+		return body.Books
+	}
+
+	var fiction, scienceFiction, spaceOpera store.Category
+	s.Run("create category tree, expect slugs derived from names", func() {
+		rsp := send("POST", "/v1/categories", admin, `{"name": "Shelf Fiction"}`)
+		s.Require().Equal(201, rsp.StatusCode)
+		json.NewDecoder(rsp.Body).Decode(&fiction)
+		s.Equal("shelf-fiction", fiction.Slug)
+		s.Nil(fiction.ParentID)
+
+		rsp = send("POST", "/v1/categories", admin, fmt.Sprintf(`{"name": "Shelf Science Fiction", "parentId": %d}`, fiction.ID))
+		s.Require().Equal(201, rsp.StatusCode)
+		json.NewDecoder(rsp.Body).Decode(&scienceFiction)
+
+		rsp = send("POST", "/v1/categories", admin, fmt.Sprintf(`{"name": "Shelf Space Opera", "parentId": %d}`, scienceFiction.ID))
+		s.Require().Equal(201, rsp.StatusCode)
+		json.NewDecoder(rsp.Body).Decode(&spaceOpera)
+		s.Require().NotNil(spaceOpera.ParentID)
+		s.Equal(scienceFiction.ID, *spaceOpera.ParentID)
+	})
+
+	s.Run("create category with slug in use, expect 409", func() {
+		rsp := send("POST", "/v1/categories", admin, `{"name": "Other", "slug": "shelf-fiction"}`)
+
+		s.Equal(409, rsp.StatusCode)
+	})
+
+	s.Run("create category as customer, expect 403", func() {
+		rsp := send("POST", "/v1/categories", customer, `{"name": "Shelf Poetry"}`)
+
+		s.Equal(403, rsp.StatusCode)
+	})
+
+	var opera store.Book
+	s.Run("create books with categories and tags, expect tags normalized", func() {
+		rsp := send("POST", "/v1/books", admin, fmt.Sprintf(`{"title": "Opera", "author": "Shelf Author", "price": 9,
+            "categoryIds": [%d], "tags": ["Shelf  Classic", "shelf classic", "Shelf Award"]}`, spaceOpera.ID))
+		s.Require().Equal(201, rsp.StatusCode)
+		json.NewDecoder(rsp.Body).Decode(&opera)
+		s.Equal([]string{"shelf classic", "shelf award"}, opera.Tags)
+		s.Require().Len(opera.Categories, 1)
+		s.Equal("shelf-space-opera", opera.Categories[0].Slug)
+
+		rsp = send("POST", "/v1/books", admin, fmt.Sprintf(`{"title": "Saga", "author": "Shelf Author", "price": 9,
+            "categoryIds": [%d], "tags": ["shelf classic"]}`, fiction.ID))
+		s.Require().Equal(201, rsp.StatusCode)
+	})
+
+	s.Run("create book with unknown category, expect 400", func() {
+		rsp := send("POST", "/v1/books", admin, `{"title": "Lost", "author": "Shelf Author", "price": 9, "categoryIds": [0]}`)
+
+		s.Equal(400, rsp.StatusCode)
+	})
+
+	s.Run("filter by category, expect books of descendants included", func() {
+		s.Len(getBooks("category=shelf-fiction"), 2)
+		s.Len(getBooks("category=shelf-science-fiction"), 1)
+		s.Len(getBooks("category="+strconv.Itoa(spaceOpera.ID)), 1)
+	})
+
+	s.Run("filter by tag, expect only tagged books", func() {
+		books := getBooks("tag=" + url.QueryEscape("Shelf Award"))
+
+		s.Require().Len(books, 1)
+		s.Equal("Opera", books[0].Title)
+	})
+
+	s.Run("get category tree, expect children nested", func() {
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/categories", nil))
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var body struct{ Categories []store.Category }
+		json.NewDecoder(rsp.Body).Decode(&body)
+		for _, category := range body.Categories {
+			if category.ID == fiction.ID {
+				s.Require().Len(category.Children, 1)
+				s.Require().Len(category.Children[0].Children, 1)
+				s.Equal("Shelf Space Opera", category.Children[0].Children[0].Name)
+				return
+			}
+		}
+		s.Fail("category missing from the tree")
+	})
+
+	s.Run("move category below its descendant, expect 400", func() {
+		rsp := send("PUT", "/v1/categories/"+strconv.Itoa(fiction.ID), admin,
+			fmt.Sprintf(`{"name": "Shelf Fiction", "parentId": %d}`, spaceOpera.ID))
+
+		s.Equal(400, rsp.StatusCode)
+	})
+
+	s.Run("delete category with subcategories, expect 409", func() {
+		rsp := send("DELETE", "/v1/categories/"+strconv.Itoa(scienceFiction.ID), admin, "")
+
+		s.Equal(409, rsp.StatusCode)
+	})
+
+	s.Run("list tags, expect book counts", func() {
+		rsp, _ := s.server.Test(httptest.NewRequest("GET", "/v1/tags", nil))
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var body struct{ Tags []store.Tag }
+		json.NewDecoder(rsp.Body).Decode(&body)
+		s.Contains(body.Tags, store.Tag{Name: "shelf classic", BookCount: 2})
+		s.Contains(body.Tags, store.Tag{Name: "shelf award", BookCount: 1})
+	})
+
+	s.Run("rename tag to one the book has, expect tags merged", func() {
+		rsp := send("PUT", "/v1/tags/"+url.PathEscape("shelf award"), admin, `{"name": "Shelf Classic"}`)
+		s.Require().Equal(204, rsp.StatusCode)
+
+		books := getBooks("tag=" + url.QueryEscape("shelf classic"))
+		s.Require().Len(books, 2)
+		s.Equal([]string{"shelf classic"}, books[0].Tags)
+	})
+
+	s.Run("delete tag, expect it removed from every book", func() {
+		rsp := send("DELETE", "/v1/tags/"+url.PathEscape("shelf classic"), admin, "")
+		s.Require().Equal(204, rsp.StatusCode)
+		s.Empty(getBooks("tag=" + url.QueryEscape("shelf classic")))
+
+		rsp = send("DELETE", "/v1/tags/"+url.PathEscape("shelf classic"), admin, "")
+		s.Equal(404, rsp.StatusCode)
+	})
+
+	s.Run("delete leaf category, expect books no longer filed under it", func() {
+		rsp := send("DELETE", "/v1/categories/"+strconv.Itoa(spaceOpera.ID), admin, "")
+		s.Require().Equal(204, rsp.StatusCode)
+
+		s.Len(getBooks("category=shelf-fiction"), 1)
+	})
+}
+
+func (s *StoreTestSuite) TestCredentialChanges() {
+	s.db.Exec(`DELETE FROM logins
+        WHERE email IN ('hana@domain.example', 'hana.new@domain.example', 'hana.taken@domain.example', 'hana.other@domain.example')`)
+
+	token := s.registerAndLogin("hana@domain.example", "Strong-Pass-1")
+	s.registerAndLogin("hana.taken@domain.example", "Strong-Pass-1")
+
+	changePassword := func(token, body string) *http.Response {
+		req := httptest.NewRequest("PUT", "/v1/password", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		return rsp
+	}
+
+	getOrders := func(token string) int {
+		req := httptest.NewRequest("GET", "/v1/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		return rsp.StatusCode
+	}
+
+	s.Run("change password with wrong current password, expect 400", func() {
+		rsp := changePassword(token, `{"currentPassword": "Wrong-Pass-1", "newPassword": "Changed-Pass-2"}`)
+
+		s.Equal(400, rsp.StatusCode)
+	})
+
+	s.Run("change password to a weak one, expect 400", func() {
+		rsp := changePassword(token, `{"currentPassword": "Strong-Pass-1", "newPassword": "short"}`)
+
+		s.Equal(400, rsp.StatusCode)
+	})
+
+	s.Run("change password, expect new token and old token rejected", func() {
+		rsp := changePassword(token, `{"currentPassword": "Strong-Pass-1", "newPassword": "Changed-Pass-2"}`)
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var body struct{ Token string }
+		json.NewDecoder(rsp.Body).Decode(&body)
+		s.Equal(200, getOrders(body.Token))
+		s.Equal(401, getOrders(token))
+
+		token = body.Token
+	})
+
+	s.Run("login with new password, expect 200", func() {
+		s.NotEmpty(s.login("hana@domain.example", "Changed-Pass-2"))
+	})
+
+	requestEmailChange := func(newEmail string) *http.Response {
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/email",
+			strings.NewReader(`{"currentPassword": "Changed-Pass-2", "newEmail": "`+newEmail+`"}`),
+		)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		return rsp
+	}
+
+	s.Run("change email to an invalid address, expect 400", func() {
+		s.Equal(400, requestEmailChange("not-an-email").StatusCode)
+	})
+
+	s.Run("change email to a registered address, expect 409", func() {
+		s.Equal(409, requestEmailChange("hana.taken@domain.example").StatusCode)
+	})
+
+	s.Require().Equal(202, requestEmailChange("hana.other@domain.example").StatusCode)
+
+	mail, sent := s.mailer.LastMessageTo("hana.other@domain.example")
+	s.Require().True(sent)
+	supersededToken := tokenFromMail(mail.Body)
+	s.Require().NotEmpty(supersededToken)
+
+	s.Require().Equal(202, requestEmailChange("hana.new@domain.example").StatusCode)
+
+	mail, sent = s.mailer.LastMessageTo("hana.new@domain.example")
+	s.Require().True(sent)
+	changeToken := tokenFromMail(mail.Body)
+	s.Require().NotEmpty(changeToken)
+
+	confirm := func(changeToken string) *http.Response {
+		req := httptest.NewRequest(
+			"POST",
+			"/v1/email/confirm",
+			strings.NewReader(`{"token": "`+changeToken+`"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		rsp, _ := s.server.Test(req)
+
+		return rsp
+	}
+
+	s.Run("confirm superseded email change, expect 400", func() {
+		s.Equal(400, confirm(supersededToken).StatusCode)
+	})
+
+	s.Run("confirm email change, expect 204 and old token rejected", func() {
+		s.Equal(204, confirm(changeToken).StatusCode)
+		s.Equal(401, getOrders(token))
+		s.NotEmpty(s.login("hana.new@domain.example", "Changed-Pass-2"))
+	})
+
+	s.Run("confirm email change again, expect 400", func() {
+		s.Equal(400, confirm(changeToken).StatusCode)
+	})
+
+	s.Run("confirm email change again after the old email is registered anew, expect 400", func() {
+		s.registerAndLogin("hana@domain.example", "Strong-Pass-1")
+
+		s.Equal(400, confirm(changeToken).StatusCode)
+	})
+}
+
+func (s *StoreTestSuite) TestSessions() {
+	s.db.Exec("DELETE FROM logins WHERE email = 'joni@domain.example'")
+
+	laptop := s.registerAndLogin("joni@domain.example", "Strong-Pass-1")
+
+	req := httptest.NewRequest("POST", "/v1/login", nil)
+	basicAuth := base64.StdEncoding.EncodeToString([]byte("joni@domain.example:Strong-Pass-1"))
+	req.Header.Set("Authorization", "Basic "+basicAuth)
+	req.Header.Set("User-Agent", "Bookstore-Phone/1.0")
+
+	rsp, _ := s.server.Test(req)
+
+	s.Require().Equal(200, rsp.StatusCode)
+
+	var phone struct{ Token string }
+	json.NewDecoder(rsp.Body).Decode(&phone)
+
+	type session struct {
+		ID        string
+		UserAgent string
+		Current   bool
+	}
+	getSessions := func(token string) []session {
+		req := httptest.NewRequest("GET", "/v1/sessions", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Require().Equal(200, rsp.StatusCode)
+
+		var body struct{ Sessions []session }
+		json.NewDecoder(rsp.Body).Decode(&body)
+
+		return body.Sessions
+	}
+
+	var phoneSession session
+	s.Run("list sessions, expect both devices with the current one marked", func() {
+		sessions := getSessions(laptop)
+
+		s.Require().Len(sessions, 2)
+		for _, session := range sessions {
+			if session.UserAgent == "Bookstore-Phone/1.0" {
+				phoneSession = session
+			}
+		}
+		s.NotEmpty(phoneSession.ID)
+		s.False(phoneSession.Current)
+	})
+
+	s.Run("terminate unknown session, expect 404", func() {
+		req := httptest.NewRequest("DELETE", "/v1/sessions/unknown", nil)
+		req.Header.Set("Authorization", "Bearer "+laptop)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(404, rsp.StatusCode)
+	})
+
+	s.Run("terminate other session, expect its token rejected", func() {
+		req := httptest.NewRequest("DELETE", "/v1/sessions/"+phoneSession.ID, nil)
+		req.Header.Set("Authorization", "Bearer "+laptop)
+
+		rsp, _ := s.server.Test(req)
+
+		s.Equal(204, rsp.StatusCode)
+
+		req = httptest.NewRequest("GET", "/v1/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+phone.Token)
+
+		rsp, _ = s.server.Test(req)
+
+		s.Equal(401, rsp.StatusCode)
+		s.Len(getSessions(laptop), 1)
+	})
+}
+
+func (s *StoreTestSuite) registerAndLogin(email, password string) string {
+	req := httptest.NewRequest(
+		"POST",
+		"/v1/users",
+		strings.NewReader(`{"email": "`+email+`", "password": "`+password+`"}`),
+	)
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, _ := s.server.Test(req)
+
+	s.Require().Equal(201, rsp.StatusCode)
+
+	return s.login(email, password)
+}
+
+func (s *StoreTestSuite) login(email, password string) string {
+	req := httptest.NewRequest("POST", "/v1/login", nil)
+	basicAuth := base64.StdEncoding.EncodeToString([]byte(email + ":" + password))
+	req.Header.Set("Authorization", "Basic "+basicAuth)
+
+	rsp, _ := s.server.Test(req)
+
+	s.Require().Equal(200, rsp.StatusCode)
+
+	var token struct{ Token string }
+	json.NewDecoder(rsp.Body).Decode(&token)
+
+	return token.Token
+}
+
 func TestStore(t *testing.T) {
 	suite.Run(t, new(StoreTestSuite))
 }
@@ -0,0 +1 @@
+ALTER TABLE logins DROP COLUMN IF EXISTS role;
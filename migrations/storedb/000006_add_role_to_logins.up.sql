@@ -0,0 +1,3 @@
+ALTER TABLE logins
+    ADD COLUMN role VARCHAR(32) NOT NULL DEFAULT 'customer'
+    CHECK (role IN ('customer', 'staff', 'admin'));
@@ -0,0 +1,4 @@
+ALTER TABLE logins ADD COLUMN verified_at TIMESTAMP WITH TIME ZONE;
+
+-- Accounts created before verification existed keep working.
+UPDATE logins SET verified_at = created_at;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS external_identities;
+DROP TABLE IF EXISTS oidc_states;
+
+ALTER TABLE logins DROP COLUMN IF EXISTS oidc_login_nonce;
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS oidc_states (
+    state VARCHAR(64) PRIMARY KEY,
+    provider VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    -- link_email and link_session are the login and session that started the
+    -- flow to link an identity explicitly, empty for a plain login.
+    link_email VARCHAR(255) NOT NULL DEFAULT '',
+    link_session VARCHAR(64) NOT NULL DEFAULT '',
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- oidc_login_nonce is carried by the code an OIDC callback redirects to the
+-- frontend with, so the code is redeemed once.
+ALTER TABLE logins ADD COLUMN oidc_login_nonce VARCHAR(64);
+
+CREATE TABLE IF NOT EXISTS external_identities (
+    provider VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (provider, subject)
+);
@@ -0,0 +1,4 @@
+ALTER TABLE logins
+    DROP COLUMN IF EXISTS reauth_nonce,
+    DROP COLUMN IF EXISTS email_change_nonce,
+    DROP COLUMN IF EXISTS tokens_valid_after;
@@ -0,0 +1,11 @@
+-- Access tokens issued before this moment are rejected, set whenever the
+-- password or email of a login changes.
+ALTER TABLE logins ADD COLUMN tokens_valid_after TIMESTAMP WITH TIME ZONE;
+
+-- email_change_nonce is carried by the confirmation link of the latest email
+-- change, so the link works once and earlier links stop working.
+ALTER TABLE logins ADD COLUMN email_change_nonce VARCHAR(64);
+
+-- reauth_nonce is carried by the latest reauthentication token mailed to the
+-- login, so the token works once.
+ALTER TABLE logins ADD COLUMN reauth_nonce VARCHAR(64);
@@ -0,0 +1,14 @@
+-- A session is a login on one device. Its id is the family of its refresh
+-- tokens and the sid claim of its access tokens.
+CREATE TABLE IF NOT EXISTS sessions (
+    id VARCHAR(64) PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    last_jti VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    terminated_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX sessions_email_idx ON sessions (email);
@@ -0,0 +1,7 @@
+ALTER TABLE books
+    DROP COLUMN IF EXISTS isbn,
+    DROP COLUMN IF EXISTS description,
+    DROP COLUMN IF EXISTS publisher,
+    DROP COLUMN IF EXISTS published_at,
+    DROP COLUMN IF EXISTS language,
+    DROP COLUMN IF EXISTS page_count;
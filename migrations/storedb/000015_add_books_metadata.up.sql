@@ -0,0 +1,7 @@
+ALTER TABLE books
+    ADD COLUMN isbn VARCHAR(13) UNIQUE,
+    ADD COLUMN description TEXT NOT NULL DEFAULT '',
+    ADD COLUMN publisher VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN published_at DATE,
+    ADD COLUMN language VARCHAR(35) NOT NULL DEFAULT '',
+    ADD COLUMN page_count INT CHECK (page_count > 0);
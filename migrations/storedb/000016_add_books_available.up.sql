@@ -0,0 +1,7 @@
+ALTER TABLE books ADD COLUMN available BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- Keyset pagination orders by the sort column, then id.
+CREATE INDEX books_title_id_idx ON books (title, id);
+CREATE INDEX books_author_id_idx ON books (author, id);
+CREATE INDEX books_price_id_idx ON books (price, id);
+CREATE INDEX books_created_at_id_idx ON books (created_at, id);
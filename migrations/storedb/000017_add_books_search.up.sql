@@ -0,0 +1,9 @@
+-- Title matches rank above author matches, which rank above description
+-- matches.
+ALTER TABLE books ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (
+    SETWEIGHT(TO_TSVECTOR('english', COALESCE(title, '')), 'A') ||
+    SETWEIGHT(TO_TSVECTOR('english', COALESCE(author, '')), 'B') ||
+    SETWEIGHT(TO_TSVECTOR('english', COALESCE(description, '')), 'C')
+) STORED;
+
+CREATE INDEX books_search_idx ON books USING GIN (search);
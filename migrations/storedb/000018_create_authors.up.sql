@@ -0,0 +1,24 @@
+-- Authors are shared between books, each credited in a role. books.author
+-- stays as the byline that is shown, sorted and searched.
+CREATE TABLE IF NOT EXISTS authors (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS book_authors (
+    book_id INT NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    author_id INT NOT NULL REFERENCES authors(id),
+    role VARCHAR(20) NOT NULL CHECK (role IN ('author', 'editor', 'translator')),
+    position INT NOT NULL,
+    PRIMARY KEY (book_id, author_id, role)
+);
+
+CREATE INDEX book_authors_author_id_idx ON book_authors (author_id);
+
+-- Every existing byline becomes the only author of its book.
+INSERT INTO authors (name)
+SELECT DISTINCT TRIM(author) FROM books WHERE TRIM(author) != '';
+
+INSERT INTO book_authors (book_id, author_id, role, position)
+SELECT b.id, a.id, 'author', 0 FROM books b JOIN authors a ON a.name = TRIM(b.author);
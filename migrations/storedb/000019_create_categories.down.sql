@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS books_tags_idx;
+
+ALTER TABLE books DROP COLUMN IF EXISTS tags;
+
+DROP TABLE IF EXISTS book_categories;
+DROP TABLE IF EXISTS categories;
@@ -0,0 +1,25 @@
+-- Categories form a tree: a book in "Epic Fantasy" is also found on the
+-- "Fantasy" shelf above it.
+CREATE TABLE IF NOT EXISTS categories (
+    id SERIAL PRIMARY KEY,
+    parent_id INT REFERENCES categories(id),
+    name VARCHAR(100) NOT NULL,
+    slug VARCHAR(100) NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX categories_parent_id_idx ON categories (parent_id);
+
+CREATE TABLE IF NOT EXISTS book_categories (
+    book_id INT NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    category_id INT NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+    PRIMARY KEY (book_id, category_id)
+);
+
+CREATE INDEX book_categories_category_id_idx ON book_categories (category_id);
+
+-- Tags are free-form labels kept on the book itself.
+ALTER TABLE books ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX books_tags_idx ON books USING GIN (tags);
@@ -0,0 +1,2 @@
+-- cover is the blob key prefix of the cover thumbnails, NULL without cover.
+ALTER TABLE books ADD COLUMN cover VARCHAR(255);